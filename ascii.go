@@ -0,0 +1,114 @@
+package dither
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// ToASCII returns the image as text, with one character for each pixel and a
+// newline at the end of each row. This is fun for terminals, and useful for
+// debugging.
+//
+// The palette colors are sorted by LinearLuminance, and each one is given a
+// character from the ramp: the darkest color gets the first character, the
+// lightest color gets the last one, and the others are spread out in between.
+// So the ramp should go from dark to light, like " ░▒▓█" or " .:-=+*#%@" for a
+// terminal with a dark background. Transparent palette colors are always a
+// space.
+//
+// The function will panic if the ramp is empty.
+func ToASCII(p *image.Paletted, ramp []rune) string {
+	if len(ramp) == 0 {
+		panic("dither: ToASCII: ramp is empty")
+	}
+
+	// Indexes of the opaque palette colors, sorted by luminance
+	order := luminanceOrder(p.Palette)
+	for len(order) > 0 && isTransparent(p.Palette[order[0]]) {
+		order = order[1:]
+	}
+
+	// Transparent palette colors stay as spaces
+	chars := make([]rune, len(p.Palette))
+	for i := range chars {
+		chars[i] = ' '
+	}
+	for k, i := range order {
+		pos := 0
+		if len(order) > 1 {
+			// Round to the nearest ramp position
+			pos = (k*(len(ramp)-1)*2 + len(order) - 1) / ((len(order) - 1) * 2)
+		}
+		chars[i] = ramp[pos]
+	}
+
+	var sb strings.Builder
+	b := p.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if i := int(p.ColorIndexAt(x, y)); i < len(chars) {
+				sb.WriteRune(chars[i])
+			} else {
+				// Pixels with indexes outside the palette are spaces too
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// ToANSI writes the image to w as text for terminals that support 24-bit
+// "truecolor" ANSI escape codes, which most modern ones do. Each character is
+// an upper half block (▀), with the color of one pixel as the foreground and
+// the pixel below it as the background, so every row of text shows two rows of
+// pixels. This can be used to preview dithered images from the command line.
+//
+// If maxWidth is above zero and the image is wider than that, it's scaled down
+// to maxWidth pixels wide first, using ResizeLinear. Remember that dithered
+// images don't look right when they're scaled down, so it's better to dither
+// an image that's already small enough.
+//
+// Fully transparent pixels use the terminal's default colors, and all other
+// pixels are shown as opaque.
+func ToANSI(w io.Writer, img image.Image, maxWidth int) error {
+	b := img.Bounds()
+	if maxWidth > 0 && b.Dx() > maxWidth {
+		h := (b.Dy()*maxWidth + b.Dx()/2) / b.Dx()
+		if h < 1 {
+			h = 1
+		}
+		img = ResizeLinear(img, maxWidth, h)
+		b = img.Bounds()
+	}
+
+	bw := bufio.NewWriter(w)
+	for y := b.Min.Y; y < b.Max.Y; y += 2 {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			top := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			var bottom color.NRGBA
+			if y+1 < b.Max.Y {
+				bottom = color.NRGBAModel.Convert(img.At(x, y+1)).(color.NRGBA)
+			}
+
+			switch {
+			case top.A == 0 && bottom.A == 0:
+				bw.WriteString("\x1b[39;49m ")
+			case top.A == 0:
+				// The lower half block is used so the top can be the background
+				fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%d;49m▄", bottom.R, bottom.G, bottom.B)
+			case bottom.A == 0:
+				fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%d;49m▀", top.R, top.G, top.B)
+			default:
+				fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%d;48;2;%d;%d;%dm▀",
+					top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+			}
+		}
+		bw.WriteString("\x1b[0m\n")
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,90 @@
+package dither
+
+import (
+	"image"
+	"image/color"
+)
+
+// Bitmap is an image with a two color palette, where each pixel takes up a
+// single bit. It is returned by DitherBinary.
+//
+// The pixels are packed 8 to a byte, with the leftmost pixel in the most
+// significant bit. Each row starts at a new byte, so if the width isn't a
+// multiple of 8, the last byte of each row is padded with zeros. This is the
+// layout most e-ink displays, thermal printers, and formats like PBM expect.
+type Bitmap struct {
+	// Pix holds the image's pixels, as bits. A 0 bit is Palette[0], and a 1
+	// bit is Palette[1]. The pixel at (x, y) is in the byte at
+	// Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)/8].
+	Pix []uint8
+	// Stride is the Pix stride (in bytes) between vertically adjacent pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+	// Palette is the image's palette. It has two colors.
+	Palette color.Palette
+}
+
+// NewBitmap returns a new Bitmap image with the given bounds and palette.
+// The palette must have two colors.
+func NewBitmap(r image.Rectangle, p color.Palette) *Bitmap {
+	if len(p) != 2 {
+		panic("dither: NewBitmap: palette must have two colors")
+	}
+	w, h := r.Dx(), r.Dy()
+	if w < 0 || h < 0 {
+		w, h = 0, 0
+	}
+	stride := (w + 7) / 8
+	return &Bitmap{
+		Pix:     make([]uint8, stride*h),
+		Stride:  stride,
+		Rect:    r,
+		Palette: p,
+	}
+}
+
+func (p *Bitmap) ColorModel() color.Model { return p.Palette }
+
+func (p *Bitmap) Bounds() image.Rectangle { return p.Rect }
+
+func (p *Bitmap) At(x, y int) color.Color {
+	return p.Palette[p.ColorIndexAt(x, y)]
+}
+
+// pixBit returns the index of the element of Pix that holds the pixel at
+// (x, y), and the bit of that element that is the pixel.
+func (p *Bitmap) pixBit(x, y int) (int, uint8) {
+	x -= p.Rect.Min.X
+	return (y-p.Rect.Min.Y)*p.Stride + x/8, 0x80 >> uint(x%8)
+}
+
+// Set sets the pixel at (x, y) to the palette color closest to c.
+func (p *Bitmap) Set(x, y int, c color.Color) {
+	p.SetColorIndex(x, y, uint8(p.Palette.Index(c)))
+}
+
+func (p *Bitmap) ColorIndexAt(x, y int) uint8 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	i, bit := p.pixBit(x, y)
+	if p.Pix[i]&bit != 0 {
+		return 1
+	}
+	return 0
+}
+
+// SetColorIndex sets the pixel at (x, y) to the palette color at index, which
+// must be 0 or 1.
+func (p *Bitmap) SetColorIndex(x, y int, index uint8) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	i, bit := p.pixBit(x, y)
+	if index == 0 {
+		p.Pix[i] &^= bit
+	} else {
+		p.Pix[i] |= bit
+	}
+}
@@ -0,0 +1,182 @@
+package dither
+
+import (
+	"math"
+	"sort"
+)
+
+// cacheMinColors is the palette size at which UseCache starts being used.
+// With fewer colors, checking every one is about as fast as the cache.
+const cacheMinColors = 16
+
+// cacheBits is how many of the top bits of each linear RGB channel are used to
+// find the cell of a color in a colorCache. There are 2^(3*cacheBits) cells.
+const cacheBits = 6
+
+// cacheMargin is how much closer, in colorDist units, the cached palette color
+// has to be than every other one. colorDist truncates, so it can be up to 4
+// less than the exact distance.
+const cacheMargin = 8
+
+// colorCache caches the palette colors that can be the closest for each cell
+// of a coarse grid in linear RGB, for UseCache. Usually that's only one color,
+// and otherwise only those few colors have to be checked. It returns the exact
+// same results as Ditherer.closestColor.
+type colorCache struct {
+	d *Ditherer
+	// weights are the weights of each channel in the distance
+	weights [3]float64
+	// radius is the distance from the center of a cell to its corners
+	radius float64
+	// cells holds the palette index plus one for each cell with a single
+	// closest color. Otherwise it holds minus the index in lists plus one.
+	// Zero means the cell hasn't been checked yet.
+	cells []int32
+	// lists holds the palette indexes that can be the closest for cells with
+	// more than one, in increasing order
+	lists [][]int
+	// neighbors holds the other palette colors for each palette color, sorted
+	// by their distance to it. They're only found when needed.
+	neighbors [][]cacheNeighbor
+}
+
+type cacheNeighbor struct {
+	i    int
+	dist float64
+}
+
+// newColorCache returns a colorCache for the linearized Ditherer, or nil if
+// the cache can't be used with its palette and settings.
+func newColorCache(d *Ditherer) *colorCache {
+	if len(d.linearPalette) < cacheMinColors || d.Quantizer != nil ||
+		d.ColorSpace == ColorSpaceOklab || d.PaletteWeights != nil || d.grayLevels != nil {
+		return nil
+	}
+	c := &colorCache{
+		d:         d,
+		weights:   [3]float64{1, 1, 1},
+		cells:     make([]int32, 1<<(3*cacheBits)),
+		neighbors: make([][]cacheNeighbor, len(d.linearPalette)),
+	}
+	if d.LuminanceWeighting {
+		c.weights = colorWeights
+	}
+	half := float64(1 << (16 - cacheBits) / 2)
+	c.radius = c.dist([3]float64{half, half, half}, [3]float64{})
+	return c
+}
+
+// dist returns the Euclidean distance between two colors, with the channels
+// weighted like in colorDist.
+func (c *colorCache) dist(a, b [3]float64) float64 {
+	var sum float64
+	for k := range a {
+		sum += c.weights[k] * (a[k] - b[k]) * (a[k] - b[k])
+	}
+	return math.Sqrt(sum)
+}
+
+// closest returns the index of the closest palette color, like
+// Ditherer.closestColor.
+func (c *colorCache) closest(r, g, b uint16) int {
+	cell := [3]int{int(r >> (16 - cacheBits)), int(g >> (16 - cacheBits)), int(b >> (16 - cacheBits))}
+	i := cell[0]<<(2*cacheBits) | cell[1]<<cacheBits | cell[2]
+	if c.cells[i] == 0 {
+		c.cells[i] = c.check(cell)
+	}
+	if c.cells[i] > 0 {
+		return int(c.cells[i] - 1)
+	}
+
+	// Same as closestColorLinear or closestColorUnweighted, but only for the
+	// colors in the list
+	color, best := -1, uint32(math.MaxUint32)
+	for _, j := range c.lists[-c.cells[i]-1] {
+		pc := c.d.linearPalette[j]
+		var dist uint32
+		if c.d.LuminanceWeighting {
+			dist = colorDist(r, g, b, pc)
+		} else {
+			dist = sqDiff(r, pc[0]) + sqDiff(g, pc[1]) + sqDiff(b, pc[2])
+		}
+		if dist < best {
+			color, best = j, dist
+		}
+	}
+	return color
+}
+
+// check returns the value of the cell for cells, adding to lists if needed.
+func (c *colorCache) check(cell [3]int) int32 {
+	var lo, hi, center [3]float64
+	for k := range cell {
+		lo[k] = float64(cell[k] << (16 - cacheBits))
+		hi[k] = lo[k] + 1<<(16-cacheBits) - 1
+		center[k] = (lo[k] + hi[k]) / 2
+	}
+	best := c.d.closestColor(uint16(center[0]), uint16(center[1]), uint16(center[2]))
+	bc := toFloats(c.d.linearPalette[best])
+
+	// Colors further than this from the best one are further from every color
+	// in the cell too, by the triangle inequality, so only closer ones have to
+	// be checked. The margin is also added, converted from colorDist units.
+	limit := 2*(c.dist(center, bc)+c.radius) + 2*math.Sqrt(4*cacheMargin)
+	list := []int{best}
+	for _, n := range c.sortedNeighbors(best) {
+		if n.dist > limit {
+			break
+		}
+		if c.d.transparents[n.i] {
+			continue
+		}
+		oc := toFloats(c.d.linearPalette[n.i])
+		if oc == bc {
+			if n.i < best {
+				// Ties go to the lower index
+				list = append(list, n.i)
+			}
+			continue
+		}
+		// How much further the other color is than the best one. That's
+		// linear in each channel, so the smallest value in the cell is at one
+		// of its corners.
+		var diff float64
+		for k := range cell {
+			atLo := c.weights[k] * (bc[k] - oc[k]) * (2*lo[k] - oc[k] - bc[k])
+			atHi := c.weights[k] * (bc[k] - oc[k]) * (2*hi[k] - oc[k] - bc[k])
+			diff += math.Min(atLo, atHi)
+		}
+		// colorDist divides the squared differences by 4
+		if diff/4 <= cacheMargin {
+			list = append(list, n.i)
+		}
+	}
+	if len(list) == 1 {
+		return int32(best + 1)
+	}
+	sort.Ints(list)
+	c.lists = append(c.lists, list)
+	return -int32(len(c.lists))
+}
+
+// sortedNeighbors returns the neighbors of the palette color at i.
+func (c *colorCache) sortedNeighbors(i int) []cacheNeighbor {
+	if c.neighbors[i] != nil {
+		return c.neighbors[i]
+	}
+	ic := toFloats(c.d.linearPalette[i])
+	ns := make([]cacheNeighbor, 0, len(c.d.linearPalette)-1)
+	for j, jc := range c.d.linearPalette {
+		if j != i {
+			ns = append(ns, cacheNeighbor{j, c.dist(ic, toFloats(jc))})
+		}
+	}
+	sort.Slice(ns, func(a, b int) bool { return ns[a].dist < ns[b].dist })
+	c.neighbors[i] = ns
+	return ns
+}
+
+// toFloats converts a linear RGB color to floats.
+func toFloats(c [3]uint16) [3]float64 {
+	return [3]float64{float64(c[0]), float64(c[1]), float64(c[2])}
+}
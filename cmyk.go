@@ -0,0 +1,45 @@
+package dither
+
+import (
+	"image"
+	"image/color"
+)
+
+// DitherCMYK dithers a copy of the src image into an *image.CMYK, for print
+// workflows. The closest palette colors are still found in linear RGB like
+// usual, only the output is stored as CMYK.
+//
+// Palette colors that are color.CMYK are stored exactly as they were given to
+// NewDitherer, so ink combinations like a rich black are kept. Other palette
+// colors are converted the same way as the image/color package does, without
+// any color profile: K = 1 - max(R, G, B), and then C = (1 - R - K) / (1 - K),
+// and the same for M with G and Y with B. Going from CMYK to RGB is the
+// reverse, R = (1 - C) * (1 - K) and so on.
+//
+// *image.CMYK has no alpha channel, so src should be opaque. Pixels that
+// aren't come out as if they were drawn on top of black.
+func (d *Ditherer) DitherCMYK(src image.Image) *image.CMYK {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+	dst := image.NewCMYK(src.Bounds())
+	d.ditherInto(&cmykImage{dst, d.inks}, src, true, ditherOptions{})
+	return dst
+}
+
+// cmykImage sets palette colors in an *image.CMYK as the CMYK colors they came
+// from, instead of converting them back from RGB, which isn't always the same.
+type cmykImage struct {
+	*image.CMYK
+	inks map[color.RGBA64]color.CMYK
+}
+
+func (p *cmykImage) Set(x, y int, c color.Color) {
+	if rgba, ok := c.(color.RGBA64); ok {
+		if ink, ok := p.inks[rgba]; ok {
+			p.SetCMYK(x, y, ink)
+			return
+		}
+	}
+	p.CMYK.Set(x, y, c)
+}
@@ -3,6 +3,7 @@ package dither
 import (
 	"image/color"
 	"math"
+	"sync"
 )
 
 // linearize1 linearizes an R, G, or B channel value from an sRGB color.
@@ -14,38 +15,352 @@ func linearize1(v float64) float64 {
 	return math.Pow((v+0.055)/1.055, 2.4)
 }
 
-func linearize65535(i uint16) uint16 {
-	v := float64(i) / 65535.0
-	return uint16(math.RoundToEven(linearize1(v) * 65535.0))
+// delinearize1 is the inverse of linearize1.
+// Must be in the range [0, 1].
+func delinearize1(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// delinearTable is a lookup table for delinearize65535, created the first time
+// it's needed.
+var (
+	delinearOnce  sync.Once
+	delinearTable []uint16
+)
+
+func delinearize65535(i uint16) uint16 {
+	delinearOnce.Do(func() {
+		delinearTable = make([]uint16, 65536)
+		for j := range delinearTable {
+			v := float64(j) / 65535.0
+			delinearTable[j] = uint16(math.RoundToEven(delinearize1(v) * 65535.0))
+		}
+	})
+	return delinearTable[i]
+}
+
+// SRGBToLinear converts a color to linear RGB, the color space that
+// PixelMappers work in. The color is assumed to be sRGB, and the returned
+// values are in the range [0, 65535].
+//
+// Colors that aren't opaque are unpremultiplied first, and the alpha value is
+// not returned.
+func SRGBToLinear(c color.Color) (uint16, uint16, uint16) {
+	r, g, b, _ := unpremultAndLinearize(c, TransferSRGB)
+	return r, g, b
+}
+
+// LinearToSRGB converts linear RGB values back to sRGB. It is the inverse of
+// SRGBToLinear, and can be used in a PixelMapper to get the sRGB values of the
+// colors it's given. All values are in the range [0, 65535].
+//
+// Converting back and forth may not give the exact same values, due to
+// rounding.
+func LinearToSRGB(r, g, b uint16) (uint16, uint16, uint16) {
+	return delinearize65535(r), delinearize65535(g), delinearize65535(b)
+}
+
+// The luminance weights of linear red, green, and blue, as fractions of
+// lumaTotal. They're 0.2126, 0.7152, and 0.0722, taken from Wikipedia:
+// https://en.wikipedia.org/wiki/Grayscale#Colorimetric_(perceptual_luminance-preserving)_conversion_to_grayscale
+//
+// All the luminance calculations use these, so they always agree.
+const (
+	lumaR     = 1063
+	lumaG     = 3576
+	lumaB     = 361
+	lumaTotal = lumaR + lumaG + lumaB // 5000
+)
+
+// LinearLuminance returns the luminance of a linear RGB color, which is the
+// linear gray that looks just as bright. This is how the grayscale
+// PixelMappers like RandomNoiseGrayscale and ThresholdGrayscale turn colors
+// into grays, and it can be used to write custom ones.
+//
+// The weights are 0.2126, 0.7152, and 0.0722, taken from Wikipedia:
+// https://en.wikipedia.org/wiki/Grayscale#Colorimetric_(perceptual_luminance-preserving)_conversion_to_grayscale
+func LinearLuminance(r, g, b uint16) uint16 {
+	// The weights are converted to fractions of 65536 so a shift can be used
+	// instead of division. They're 13933, 46871, and 4732, which add up to
+	// 65536, so white stays white.
+	const (
+		wr = (lumaR<<16 + lumaTotal/2) / lumaTotal
+		wg = (lumaG<<16 + lumaTotal/2) / lumaTotal
+		wb = 1<<16 - wr - wg
+	)
+	return uint16((wr*uint32(r) + wg*uint32(g) + wb*uint32(b) + 1<<15) >> 16)
+}
+
+// TransferFunction is the transfer function of the color space that an image
+// and palette are in. It describes how the color values are related to linear
+// light, and is used to convert colors to linear RGB before they are compared
+// and dithered.
+//
+// Almost all images are sRGB, which is the default. If dithered images come
+// out too dark or too light, the input might be in a different color space.
+type TransferFunction int
+
+const (
+	// TransferSRGB is the sRGB transfer function. It is the default.
+	TransferSRGB TransferFunction = iota
+
+	// TransferRec709 is the transfer function from ITU-R BT.709, used for HD
+	// video.
+	TransferRec709
+
+	// TransferGamma22 is a pure power function with a gamma of 2.2.
+	TransferGamma22
+
+	// TransferLinear means the colors are already linear, and aren't changed.
+	TransferLinear
+
+	numTransfers
+)
+
+// linearize1 linearizes a color channel value using the transfer function.
+// Must be in the range [0, 1].
+func (tf TransferFunction) linearize1(v float64) float64 {
+	switch tf {
+	case TransferRec709:
+		if v < 0.081 {
+			return v / 4.5
+		}
+		return math.Pow((v+0.099)/1.099, 1/0.45)
+	case TransferGamma22:
+		return math.Pow(v, 2.2)
+	case TransferLinear:
+		return v
+	}
+	return linearize1(v)
+}
+
+// delinearize1 is the inverse of linearize1.
+// Must be in the range [0, 1].
+func (tf TransferFunction) delinearize1(v float64) float64 {
+	switch tf {
+	case TransferRec709:
+		if v < 0.018 {
+			return v * 4.5
+		}
+		return 1.099*math.Pow(v, 0.45) - 0.099
+	case TransferGamma22:
+		return math.Pow(v, 1/2.2)
+	case TransferLinear:
+		return v
+	}
+	return delinearize1(v)
 }
 
-func linearize255to65535(i uint8) uint16 {
-	v := float64(i) / 255.0
-	return uint16(math.RoundToEven(linearize1(v) * 65535.0))
+// linearTables holds lookup tables for linearizing with each transfer
+// function, since calling math.Pow for every pixel is slow.
+//
+// The 8-bit tables are small, and are created when the package is loaded.
+// The 16-bit tables are created the first time they are needed.
+var linearTables [numTransfers]struct {
+	table255   [256]uint16
+	once65535  sync.Once
+	table65535 []uint16
 }
 
-// toLinearRGB converts a non-linear sRGB color to a linear RGB color space.
-// RGB values are taken directly and alpha value is ignored, so this will not
-// handle non-opaque colors properly.
-func toLinearRGB(c color.Color) (uint16, uint16, uint16) {
+func init() {
+	for tf := range linearTables {
+		for i := range linearTables[tf].table255 {
+			v := float64(i) / 255.0
+			linearTables[tf].table255[i] = uint16(math.RoundToEven(TransferFunction(tf).linearize1(v) * 65535.0))
+		}
+	}
+}
+
+func (tf TransferFunction) linearize65535(i uint16) uint16 {
+	if tf == TransferLinear {
+		return i
+	}
+	lt := &linearTables[tf]
+	lt.once65535.Do(func() {
+		lt.table65535 = make([]uint16, 65536)
+		for j := range lt.table65535 {
+			v := float64(j) / 65535.0
+			lt.table65535[j] = uint16(math.RoundToEven(tf.linearize1(v) * 65535.0))
+		}
+	})
+	return lt.table65535[i]
+}
+
+func (tf TransferFunction) linearize255to65535(i uint8) uint16 {
+	return linearTables[tf].table255[i]
+}
+
+// toLinearRGB converts a non-linear color to a linear RGB color space, using
+// the transfer function. RGB values are taken directly and alpha value is
+// ignored, so this will not handle non-opaque colors properly.
+func toLinearRGB(c color.Color, tf TransferFunction) (uint16, uint16, uint16) {
 	// Optimize for different color types
 	switch v := c.(type) {
 	case color.Gray:
-		g := linearize255to65535(v.Y)
+		g := tf.linearize255to65535(v.Y)
 		return g, g, g
 	case color.Gray16:
-		g := linearize65535(v.Y)
+		g := tf.linearize65535(v.Y)
 		return g, g, g
 	case color.NRGBA:
-		return linearize255to65535(v.R), linearize255to65535(v.G), linearize255to65535(v.B)
+		return tf.linearize255to65535(v.R), tf.linearize255to65535(v.G), tf.linearize255to65535(v.B)
 	case color.NRGBA64:
-		return linearize65535(v.R), linearize65535(v.G), linearize65535(v.B)
+		return tf.linearize65535(v.R), tf.linearize65535(v.G), tf.linearize65535(v.B)
 	case color.RGBA:
-		return linearize255to65535(v.R), linearize255to65535(v.G), linearize255to65535(v.B)
+		return tf.linearize255to65535(v.R), tf.linearize255to65535(v.G), tf.linearize255to65535(v.B)
 	case color.RGBA64:
-		return linearize65535(v.R), linearize65535(v.G), linearize65535(v.B)
+		return tf.linearize65535(v.R), tf.linearize65535(v.G), tf.linearize65535(v.B)
 	}
 
 	r, g, b, _ := c.RGBA()
-	return linearize65535(uint16(r)), linearize65535(uint16(g)), linearize65535(uint16(b))
+	return tf.linearize65535(uint16(r)), tf.linearize65535(uint16(g)), tf.linearize65535(uint16(b))
+}
+
+// ColorSpace is the color space that colors are compared and dithered in,
+// after they've been converted to linear RGB using the TransferFunction.
+type ColorSpace int
+
+const (
+	// ColorSpaceRGB means colors are compared and dithered in linear RGB, or
+	// in the image's own color space if Ditherer.LinearRGB is false. It is the
+	// default.
+	ColorSpaceRGB ColorSpace = iota
+
+	// ColorSpaceOklab means colors are compared and dithered in Oklab, a
+	// perceptually uniform color space. See https://bottosson.github.io/posts/oklab/
+	ColorSpaceOklab
+
+	numColorSpaces
+)
+
+// linearToOklab converts a linear RGB color to Oklab. The L value is in the
+// range [0, 1], and a and b are roughly in the range [-0.5, 0.5].
+//
+// The matrices are from https://bottosson.github.io/posts/oklab/
+func linearToOklab(r, g, b uint16) [3]float32 {
+	fr, fg, fb := float64(r)/65535, float64(g)/65535, float64(b)/65535
+
+	l := math.Cbrt(0.4122214708*fr + 0.5363325363*fg + 0.0514459929*fb)
+	m := math.Cbrt(0.2119034982*fr + 0.6806995451*fg + 0.1073969566*fb)
+	s := math.Cbrt(0.0883024619*fr + 0.2817188376*fg + 0.6299787005*fb)
+
+	return [3]float32{
+		float32(0.2104542553*l + 0.7936177850*m - 0.0040720468*s),
+		float32(1.9779984951*l - 2.4285922050*m + 0.4505937099*s),
+		float32(0.0259040371*l + 0.7827717662*m - 0.8086757660*s),
+	}
+}
+
+// oklabToLinear1 converts an Oklab color to linear RGB, without clamping. The
+// returned values are in the range [0, 1] if the color is in the RGB gamut.
+func oklabToLinear1(L, a, b float64) (float64, float64, float64) {
+	l := L + 0.3963377774*a + 0.2158037573*b
+	m := L - 0.1055613458*a - 0.0638541728*b
+	s := L - 0.0894841775*a - 1.2914855480*b
+	l, m, s = l*l*l, m*m*m, s*s*s
+
+	return 4.0767416621*l - 3.3077115913*m + 0.2309699292*s,
+		-1.2684380046*l + 2.6097574011*m - 0.3413193965*s,
+		-0.0041960863*l - 0.7034186147*m + 1.7076147010*s
+}
+
+// GamutMapping is how colors outside the RGB gamut are brought back into it,
+// after error diffusion has pushed them out. It's only used when dithering in
+// a color space other than RGB, see Ditherer.GamutMapping.
+type GamutMapping int
+
+const (
+	// GamutMappingNone means colors aren't mapped before finding the closest
+	// palette color. It is the default. When the colors need to be converted
+	// to RGB, GamutMappingChroma is used.
+	GamutMappingNone GamutMapping = iota
+
+	// GamutMappingClip clips each linear RGB channel to its range. It's fast,
+	// but can change the hue and lightness of the color.
+	GamutMappingClip
+
+	// GamutMappingChroma keeps the lightness and hue of the color, and reduces
+	// its chroma until it fits.
+	GamutMappingChroma
+
+	numGamutMappings
+)
+
+// mapOklab returns the Oklab color brought into the RGB gamut. With
+// GamutMappingNone it's returned as it is.
+func (gm GamutMapping) mapOklab(lab [3]float32) [3]float32 {
+	if gm == GamutMappingNone {
+		return lab
+	}
+	return linearToOklab(oklabToLinear(lab, gm))
+}
+
+// oklabToLinear converts an Oklab color to linear RGB, with values in the
+// range [0, 65535]. Colors outside the RGB gamut are mapped into it with
+// GamutMappingClip if gm says so, and otherwise with GamutMappingChroma.
+func oklabToLinear(lab [3]float32, gm GamutMapping) (uint16, uint16, uint16) {
+	L, a, b := float64(lab[0]), float64(lab[1]), float64(lab[2])
+	if gm == GamutMappingClip {
+		r, g, bl := oklabToLinear1(L, a, b)
+		return RoundClamp(float32(r * 65535)), RoundClamp(float32(g * 65535)), RoundClamp(float32(bl * 65535))
+	}
+	if L <= 0 {
+		return 0, 0, 0
+	}
+	if L >= 1 {
+		return 65535, 65535, 65535
+	}
+
+	const eps = 1e-6
+	inGamut := func(r, g, b float64) bool {
+		return r >= -eps && r <= 1+eps && g >= -eps && g <= 1+eps && b >= -eps && b <= 1+eps
+	}
+
+	r, g, bl := oklabToLinear1(L, a, b)
+	if !inGamut(r, g, bl) {
+		// Binary search for the largest chroma scale that's in gamut. Gray is
+		// always in gamut, so lo stays valid.
+		lo, hi := 0.0, 1.0
+		for i := 0; i < 20; i++ {
+			mid := (lo + hi) / 2
+			if inGamut(oklabToLinear1(L, a*mid, b*mid)) {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		r, g, bl = oklabToLinear1(L, a*lo, b*lo)
+	}
+	return RoundClamp(float32(r * 65535)), RoundClamp(float32(g * 65535)), RoundClamp(float32(bl * 65535))
+}
+
+// oklabMin and oklabMax are the smallest and largest L, a, and b values of
+// colors in the RGB gamut, rounded outward.
+var (
+	oklabMin = [3]float32{0, -0.234, -0.312}
+	oklabMax = [3]float32{1, 0.277, 0.199}
+)
+
+// clampOklab clamps each value of the Oklab color to the range of values that
+// colors in the RGB gamut have. The color may still be outside the gamut.
+func clampOklab(lab [3]float32) [3]float32 {
+	for i := range lab {
+		if lab[i] < oklabMin[i] {
+			lab[i] = oklabMin[i]
+		} else if lab[i] > oklabMax[i] {
+			lab[i] = oklabMax[i]
+		}
+	}
+	return lab
+}
+
+// oklabDist returns the squared Euclidean distance between two Oklab colors.
+func oklabDist(c1, c2 [3]float32) float64 {
+	dl := float64(c1[0] - c2[0])
+	da := float64(c1[1] - c2[1])
+	db := float64(c1[2] - c2[2])
+	return dl*dl + da*da + db*db
 }
@@ -6,6 +6,9 @@ import (
 	"image/draw"
 	"math"
 	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 // copyPalette deeply copies colors and returns a new slice that is unrelated.
@@ -26,9 +29,14 @@ func copyPalette(p []color.Color) []color.Color {
 // in-between dithering images, if you would like to dither again.
 // If you change those public methods while an image is being dithered, the
 // output image will have problems, so only change in-between dithering.
+// To dither with different settings at the same time, use Clone to make a
+// separate Ditherer for each.
 //
-// You can only set one of Matrix, Mapper, or Special. Trying to dither when
-// none or more than one of those are set will cause the function to panic.
+// You can only set one of Matrix, Mapper, StatefulMapper, or Special. Trying to
+// dither when more than one of those are set will cause the function to panic.
+// If none of them are set, the image is quantized without dithering: each pixel
+// is set to the closest palette color, found the same way as when dithering.
+// This is useful for comparing dithered images to plain quantization.
 //
 // All methods can handle images with transparency, unless otherwise specified.
 // Read the docs before using!
@@ -37,11 +45,42 @@ type Ditherer struct {
 	// Matrix is the ErrorDiffusionMatrix for dithering.
 	Matrix ErrorDiffusionMatrix
 
+	// MatrixOrigin is the position of the current pixel in Matrix, as a column
+	// and row. If it is nil, the current pixel is found using
+	// Matrix.CurrentPixel, which assumes it's in the top row.
+	//
+	// Setting this is required for matrices where that assumption doesn't
+	// work, like ones where the top row has zeros after the current pixel.
+	//
+	// The current pixel can be on any row, but all the non-zero values must
+	// come after it: below it, or to the right of it in the same row. Error
+	// can't be diffused to pixels that have already been processed, so
+	// symmetric kernels that diffuse upward aren't supported, and the Ditherer
+	// is invalid if Matrix has them.
+	MatrixOrigin *image.Point
+
+	// NormalizeMatrix controls whether Matrix is scaled so its values add up
+	// to 1 before dithering. Matrices that add up to more than 1 diffuse more
+	// error than there is, which builds up and blows out the image. This can
+	// happen with custom matrices that weren't normalized properly.
+	//
+	// Note that some matrices, like Atkinson, add up to less than 1 on purpose.
+	// Normalizing those will change how they look.
+	//
+	// If this is set and the Matrix values add up to zero or less, the matrix
+	// can't be normalized and the Ditherer is invalid.
+	NormalizeMatrix bool
+
 	// Mapper is the ColorMapper function for dithering.
 	Mapper PixelMapper
 
-	// Special is the special dithering algorithm that's being used. The default
-	// value of 0 indicates that no special dithering algorithm is being used.
+	// StatefulMapper is like Mapper, but for mappers that need state for each
+	// worker. Everything that applies to Mapper applies to it too.
+	StatefulMapper StatefulPixelMapper
+
+	// Special is the special dithering algorithm that's being used, like
+	// SoftNearest. The default value of 0 indicates that no special dithering
+	// algorithm is being used.
 	Special SpecialDither
 
 	// SingleThreaded controls whether the dithering happens sequentially or using
@@ -58,65 +97,792 @@ type Ditherer struct {
 
 	// Serpentine controls whether the error diffusion matrix is applied in a
 	// serpentine manner, meaning that it goes right-to-left every other line.
-	// This greatly reduces line-type artifacts. If a Mapper is being used this
-	// field will have no effect.
+	// This greatly reduces line-type artifacts.
+	//
+	// If a Mapper is being used this field will only have an effect when
+	// SingleThreaded is also true. Then the Mapper is called in the same
+	// serpentine order, which only matters for a Mapper that uses numbers
+	// sequentially, like RandomNoiseGrayscale.
+	//
+	// Setting this is the same as using SerpentineHorizontal for ScanOrder. If
+	// ScanOrder is RasterVertical, setting this makes it SerpentineVertical.
 	Serpentine bool
 
+	// ScanOrder is the order pixels are processed in when using Matrix or
+	// LumaDiffusion. The default is RasterHorizontal, which goes row by row,
+	// like reading text. The vertical orders go column by column instead, and
+	// the matrix is transposed so that error is still diffused to the pixels
+	// that haven't been processed yet. That moves the directional artifacts of
+	// error diffusion, which can help with images that have vertical banding.
+	//
+	// Diagonal goes along anti-diagonals, with the matrix sheared to match, so
+	// the artifacts run at 45 degrees instead of along the rows or columns.
+	// Serpentine makes every other anti-diagonal go the other way.
+	//
+	// With a Mapper, only horizontal serpentine order has an effect, see
+	// Serpentine.
+	ScanOrder ScanOrder
+
+	// UseCache controls whether palette color lookups are cached while dithering
+	// using Matrix. This speeds up dithering with large palettes. Colors are
+	// grouped into the cells of a coarse grid, and the palette colors that can
+	// be the closest to any color in a cell are cached for it. Usually that's
+	// only one, so most lookups don't have to search the palette at all. The
+	// output is exactly the same as without the cache.
+	//
+	// The cache is only used with palettes of at least 16 colors, because it
+	// doesn't help smaller ones. It's also not used with a Quantizer,
+	// PaletteWeights, ColorSpaceOklab, or grayscale palettes, which find the
+	// closest color differently. It uses about 1 MiB of memory, and only lasts
+	// for one call to Dither. This field has no effect when a Mapper is being
+	// used.
+	UseCache bool
+
+	// AlphaLevels are the alpha values the dithered image is allowed to use.
+	// If it's empty, the alpha channel is kept the same as the input image.
+	// Otherwise the alpha channel is dithered too, using the Matrix or Mapper.
+	// For example, setting it to []uint8{0, 255} will turn a soft 50% transparent
+	// edge into a pattern of fully transparent and fully opaque pixels. That's
+	// useful for image formats that don't support partial transparency.
+	//
+	// Pixels that are fully transparent in the input image are never changed.
+	//
+	// To use this with DitherPaletted or DitherPalettedConfig, the levels must
+	// be 0 and 255, and the palette must have a transparent color. See
+	// DitherPaletted for details.
+	AlphaLevels []uint8
+
+	// Background is the color that images with transparency are put on top of
+	// before they're dithered. Each pixel is alpha-composited over it in
+	// linear RGB, so the dithered image is fully opaque, and fully transparent
+	// pixels become the background color. It must be opaque, and it doesn't
+	// have to be in the palette. The default is nil, which means transparency
+	// is kept.
+	//
+	// When it's set, AlphaLevels and the transparent palette color aren't
+	// used, since there's no transparency left.
+	Background color.Color
+
+	// Transfer is the transfer function of the color space that the images
+	// and palette are in. The default is TransferSRGB, which is correct for
+	// almost all images.
+	Transfer TransferFunction
+
+	// LinearRGB controls whether colors are converted to linear RGB before
+	// they're compared and dithered. It is set to true by NewDitherer, which is
+	// the most accurate.
+	//
+	// Setting it to false means colors are used as they are, in sRGB or
+	// whatever color space the image is in, and Transfer is ignored. That's what
+	// many other dithering tools do, so it can be used to match how they look.
+	// Images will usually come out lighter.
+	LinearRGB bool
+
+	// ColorSpace is the color space colors are compared and dithered in. The
+	// default is ColorSpaceRGB.
+	//
+	// With ColorSpaceOklab, the closest palette color is found in Oklab, which
+	// matches how different colors look better than weighted RGB, and avoids
+	// the darkening LuminanceWeighting can cause. When using Matrix, the error
+	// is diffused in Oklab too, and ChannelStrength applies to its L, a, and b
+	// channels. LuminanceWeighting isn't used, and the faster searches for
+	// grayscale and large palettes can't be used, so this is slower.
+	ColorSpace ColorSpace
+
+	// GamutMapping controls how colors that error diffusion has pushed outside
+	// the RGB gamut are mapped back into it, before the closest palette color
+	// is found. It's only used when ColorSpace isn't ColorSpaceRGB, since RGB
+	// values are always clipped. The default is GamutMappingNone.
+	//
+	// Mapping the colors can avoid odd colors at high-contrast edges, where a
+	// lot of error builds up. But with small palettes, the built up error is
+	// often what picks the right color, so mapping can shift hues instead.
+	// The error that's diffused is still measured from the unmapped color, so
+	// none of it is lost.
+	GamutMapping GamutMapping
+
+	// ChannelStrength scales the error diffused in the red, green, and blue
+	// channels, when using Matrix. It is set to {1, 1, 1} by NewDitherer.
+	//
+	// Like ErrorDiffusionStrength, values below 1 mean less error is diffused,
+	// which increases contrast, but this works per channel. For example,
+	// lowering only blue can reduce color noise in blue areas.
+	ChannelStrength [3]float32
+
+	// StrengthMap is a grayscale image that sets the dithering strength for
+	// each pixel, so it can vary across the image. White means full strength,
+	// and black means no dithering, just picking the closest palette color.
+	// Pixels outside of the StrengthMap bounds use full strength. It uses the
+	// same coordinates as the image being dithered. If it's nil, full strength
+	// is used everywhere.
+	//
+	// When using Matrix, the strength scales the error diffused from each
+	// pixel. When using a Mapper, it scales how much the Mapper changes the
+	// color, which for Bayer and other ordered dithering is the same as scaling
+	// the strength argument. Only the RGB channels are affected, not alpha.
+	//
+	// For example, using a map of the edges in an image can keep flat areas
+	// like the sky smooth, while still dithering the details.
+	StrengthMap image.Image
+
+	// EdgeEnhance sharpens edges in the dithered image, when using Matrix.
+	// Before each pixel is quantized, EdgeEnhance times the difference between
+	// that pixel and the average of its four neighbors in the input image is
+	// added to it. The error is still measured from the pixel without that
+	// difference, so the overall brightness of the image doesn't change.
+	//
+	// 0 disables it, and is the default. Values between 0 and 1 are usually
+	// best, as higher values exaggerate the edges and add noise around them.
+	// Negative values are invalid.
+	EdgeEnhance float32
+
+	// PreNoise adds random noise to each pixel before it's quantized, when
+	// using Matrix. Each linear RGB channel is changed by up to PreNoise*65535
+	// in either direction. Like EdgeEnhance, the error is still measured from
+	// the pixel without noise, and it's diffused as usual. A small amount like
+	// 0.02 breaks up the repetitive "worm" patterns that error diffusion can
+	// create in flat areas of the image.
+	//
+	// 0 disables it, and is the default. Negative values are invalid.
+	//
+	// The noise only depends on the position of each pixel, so the output is
+	// the same every time, with or without SingleThreaded. Error diffusion is
+	// always done in a single thread anyway.
+	PreNoise float32
+
+	// ThresholdModulation is applied to each pixel right before it's quantized,
+	// when using Matrix. This combines ordered dithering with error diffusion:
+	// using a weak ordered pattern like Bayer(4, 4, 0.2) breaks up the worm
+	// patterns error diffusion creates in gradients and flat areas, and makes
+	// the dots more even. Like EdgeEnhance and PreNoise, the error is still
+	// measured from the pixel before it was changed, and diffused as usual.
+	//
+	// It's nil by default, which disables it. Low strengths work best, because
+	// at full strength it mostly looks like ordered dithering.
+	ThresholdModulation PixelMapper
+
+	// BidirectionalPasses sets how many times the image is dithered in
+	// different directions, when using Matrix. It reduces the directional
+	// smear that error diffusion creates, because the error is always pushed
+	// the same way.
+	//
+	// 0 and 1 mean the image is dithered once, top-to-bottom, which is the
+	// default. 2 adds a pass that goes bottom-to-top, and 4 adds two more that
+	// go right-to-left, in both vertical directions. No other values are valid.
+	// Serpentine is applied to every pass.
+	//
+	// The output is put together from 8x8 tiles of the passes, picking the
+	// pass that best matches the input image in each tile. So the output is
+	// always the same for the same input.
+	//
+	// Each pass takes about as long as dithering the whole image. It also uses
+	// more memory, about 6 bytes per pixel for each pass, plus a copy of the
+	// image in linear RGB, which is another 6 or 8 bytes per pixel.
+	BidirectionalPasses int
+
+	// PreserveExtremes makes input pixels that are nearly black use the darkest
+	// palette color, and ones that are nearly white use the lightest palette
+	// color, instead of being dithered. This keeps black and white areas clean
+	// when the palette has other colors, like grays, that the dithering could
+	// mix in.
+	//
+	// A pixel is nearly black if its red, green, and blue values are all 8 or
+	// below, out of 255. It's nearly white if they're all 247 or above. This is
+	// checked before any error is diffused. When using Matrix, those pixels
+	// don't diffuse any error, and any error diffused to them is dropped.
+	PreserveExtremes bool
+
+	// ErrorThreshold stops pixels that are already very close to a palette
+	// color from diffusing their error, when using Matrix. If the quantization
+	// error of each channel of a pixel is below it, the error is dropped. The
+	// errors are in linear RGB, in the range [0, 1], and include any error
+	// that was diffused to the pixel. The default is 0, which means all error
+	// is diffused.
+	//
+	// With small palettes, tiny errors in flat areas build up until they
+	// suddenly flip a pixel to a different color, which leaves stray colored
+	// speckles. A small threshold like 0.02 keeps those areas clean, but
+	// gradients that are close to palette colors lose some smoothness, since
+	// their error isn't spread out anymore.
+	ErrorThreshold float32
+
+	// Rounding is how values are rounded after diffusing error, and after
+	// the other changes the Ditherer makes to pixels, like StrengthMap and
+	// PreNoise. The default is RoundToEven, which is what RoundClamp does.
+	// Other tools may round differently, so changing this can help to match
+	// their output exactly. The PixelMappers in this library always use
+	// RoundClamp.
+	Rounding Rounding
+
+	// LuminanceWeighting controls whether the red, green, and blue channels are
+	// weighted by how much they contribute to luminance, when finding the
+	// closest palette color. It is set to true by NewDitherer, which matches
+	// how humans perceive color differences best.
+	//
+	// With palettes that mix saturated colors with black and white, the
+	// weighting can favor the darker palette colors, making the image come out
+	// too dark. Setting it to false uses plain Euclidean distance in linear
+	// RGB, which may look better for those palettes. The faster searches used
+	// for grayscale and large palettes only work with the weighting, so this
+	// can be slower.
+	LuminanceWeighting bool
+
+	// GrayscaleMatch makes each input pixel be replaced by a gray with the
+	// same luminance before the closest palette color is found, when the
+	// palette only has grays. Any chroma in the input is ignored, so error is
+	// only diffused for luminance. It has no effect with other palettes.
+	//
+	// Without it, error is diffused for each channel, and the channels are
+	// clamped separately, so saturated colors can come out lighter or darker
+	// than they should. And when LuminanceWeighting is false or ColorSpace is
+	// ColorSpaceOklab, the closest gray isn't always the one closest in
+	// luminance.
+	GrayscaleMatch bool
+
+	// Premultiply controls whether the dithered colors are set in the image as
+	// premultiplied colors (color.RGBA64) or as colors with straight alpha
+	// (color.NRGBA64). It is set to true by NewDitherer. This only matters for
+	// pixels that aren't opaque.
+	//
+	// The image type decides how colors are actually stored. Images like
+	// *image.RGBA always store premultiplied colors, and images like
+	// *image.NRGBA always store straight alpha. Setting the color that's
+	// already in the right form avoids rounding errors, so this should be set
+	// to false when dithering an *image.NRGBA or *image.NRGBA64. When false,
+	// Dither also returns an *image.NRGBA instead of an *image.RGBA when it has
+	// to make a copy. DitherCopy always returns an *image.RGBA.
+	Premultiply bool
+
+	// PaletteWeights biases which palette colors are chosen. If it's not nil,
+	// it must have one value for each palette color, in the same order. The
+	// distance to each color is multiplied by its weight when finding the
+	// closest palette color, so colors with weights below 1 are chosen more
+	// often, and colors with weights above 1 are avoided. All weights must be
+	// above 0. The default is nil, which is the same as all weights being 1.
+	//
+	// This gives finer control over the output than changing the palette, for
+	// example to prefer skin tones. It works with Mapper and Matrix, but the
+	// faster searches used for grayscale and large palettes can't be used.
+	PaletteWeights []float32
+
+	// ExactColors maps input colors to palette colors that pixels of exactly
+	// that color are always set to, without dithering. With Matrix, those
+	// pixels don't diffuse any error, and error diffused to them is dropped.
+	// This keeps flat areas like logos and icons clean, even inside a photo.
+	//
+	// The keys are compared to the input pixels as color.RGBA64 values, so the
+	// color type doesn't matter. Every value must be a color in the palette,
+	// otherwise the Ditherer is invalid. The default is nil.
+	ExactColors map[color.Color]color.Color
+
+	// PaletteSelector restricts which palette colors can be used for each
+	// pixel. It returns the indexes of the allowed palette colors for the
+	// pixel at (x, y), for example to only use warm colors in one part of the
+	// image and cool colors in another. If it's nil or returns no indexes, the
+	// whole palette is allowed. The indexes must be valid for the palette, and
+	// the transparent palette color is never chosen. It may be called from
+	// many goroutines at once, and it shouldn't change the slice it returns
+	// after that.
+	//
+	// It's called for every pixel, and the faster searches used for grayscale
+	// and large palettes, as well as UseCache, can't be used for restricted
+	// pixels, so this can be much slower. With Matrix, error is diffused across
+	// the edges between areas with different colors, which may look odd: the
+	// error from one area can't be fixed by colors that aren't allowed in the
+	// other. PaletteSelector doesn't affect PreserveExtremes or ExactColors.
+	PaletteSelector func(x, y int) []int
+
+	// Quantizer replaces the built-in way of finding the closest palette color,
+	// for experimenting with other ways of matching colors. It's given linear
+	// RGB values, and returns the index of the palette color to use, which
+	// must be valid for the palette. Linearization, error diffusion, and
+	// everything else still works the same. It may be called from many
+	// goroutines at once. The default is nil.
+	//
+	// When it's set, LuminanceWeighting, PaletteWeights, and PaletteSelector
+	// aren't used.
+	Quantizer func(r, g, b uint16) int
+
 	// palette holds the colors the dithered image is allowed to use, in the
 	// sRGB color space. It is guaranteed to only hold colors of the type
 	// color.RGBA64.
 	palette []color.Color
 
 	// linearPalette holds all the palette colors, but in linear RGB space.
+	// It is created using TransferSRGB, see linearized.
 	linearPalette [][3]uint16
+
+	// oklabPalette holds all the palette colors in Oklab, converted from
+	// linearPalette.
+	oklabPalette [][3]float32
+
+	// transparent is the index of the fully transparent palette color, or -1
+	// if there isn't one. That color is never picked as the closest color,
+	// and is only used for transparent pixels.
+	transparent int
+
+	// transparents is true for each fully transparent palette color. None of
+	// them are ever picked as the closest color, but only the one at
+	// transparent is used for transparent pixels.
+	transparents []bool
+
+	// grayLevels holds the palette colors sorted by their linear gray value,
+	// if all the palette colors are gray. Otherwise it is nil.
+	grayLevels []grayLevel
+
+	// tree holds the palette colors for faster searching, if the palette
+	// is large enough and isn't all grays. Otherwise it is nil.
+	tree *kdTree
+
+	// inks holds the palette colors that were color.CMYK, as they were given
+	// to NewDitherer, for DitherCMYK. If more than one CMYK color has the same
+	// RGB value, the first one is used.
+	inks map[color.RGBA64]color.CMYK
+
+	// deep is true if any palette color needs more than 8 bits per channel.
+	// Then copies are made with 16 bits per channel, so those colors aren't
+	// truncated.
+	deep bool
+
+	// maxWorkers limits how many goroutines are used when dithering with a
+	// Mapper, if it's above 0. It's used by DitherAll, which already dithers
+	// images in parallel.
+	maxWorkers int
+}
+
+// grayLevel is a gray palette color, stored as its linear gray value and
+// its index in the palette.
+type grayLevel struct {
+	v uint16
+	i int
 }
 
 // NewDitherer creates a new Ditherer that uses a copy of the provided palette.
 // If the palette is empty or nil then nil will be returned.
-// All palette colors should be opaque.
+//
+// All palette colors should be opaque, except that the palette may have one
+// fully transparent color. That color will only be used for transparent pixels,
+// which is useful for DitherPaletted. If the palette has more than one
+// transparent color, the first one is used and the others are ignored. If the
+// palette only has transparent colors, nil will be returned.
 func NewDitherer(palette []color.Color) *Ditherer {
 	if len(palette) == 0 {
 		return nil
 	}
 
-	d := &Ditherer{}
+	d := &Ditherer{
+		transparent:        -1,
+		LinearRGB:          true,
+		ChannelStrength:    [3]float32{1, 1, 1},
+		Premultiply:        true,
+		LuminanceWeighting: true,
+	}
+	opaque := false
+	d.transparents = make([]bool, len(palette))
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a != 0 {
+			opaque = true
+			continue
+		}
+		d.transparents[i] = true
+		if d.transparent == -1 {
+			d.transparent = i
+		}
+	}
+	if !opaque {
+		return nil
+	}
 
 	// Palette is copied so the user can't modify it externally later
 	d.palette = copyPalette(palette)
+	for i, c := range palette {
+		if ink, ok := c.(color.CMYK); ok {
+			if d.inks == nil {
+				d.inks = make(map[color.RGBA64]color.CMYK)
+			}
+			if _, ok := d.inks[d.palette[i].(color.RGBA64)]; !ok {
+				d.inks[d.palette[i].(color.RGBA64)] = ink
+			}
+		}
+	}
 
-	// Create linear RGB version of the palette
+	for _, c := range d.palette {
+		c := c.(color.RGBA64)
+		for _, v := range [4]uint16{c.R, c.G, c.B, c.A} {
+			if v != (v>>8)*0x101 {
+				d.deep = true
+			}
+		}
+	}
+
+	d.setLinearPalette(TransferSRGB)
+	return d
+}
+
+// setLinearPalette creates the linear RGB version of the palette using the
+// transfer function, as well as the structures used to search it.
+func (d *Ditherer) setLinearPalette(tf TransferFunction) {
 	d.linearPalette = make([][3]uint16, len(d.palette))
 	for i := range d.linearPalette {
-		r, g, b := toLinearRGB(d.palette[i])
+		r, g, b := toLinearRGB(d.palette[i], tf)
 		d.linearPalette[i] = [3]uint16{r, g, b}
 	}
+	d.oklabPalette = make([][3]float32, len(d.palette))
+	for i, c := range d.linearPalette {
+		d.oklabPalette[i] = linearToOklab(c[0], c[1], c[2])
+	}
 
-	return d
+	d.grayLevels = grayLevels(d.palette, d.linearPalette)
+	d.tree = nil
+	if d.grayLevels == nil && len(d.linearPalette) >= kdTreeMinColors {
+		d.tree = newKDTree(d.palette, d.linearPalette)
+	}
+}
+
+// transfer returns the transfer function that should be used for colors,
+// taking LinearRGB into account.
+func (d *Ditherer) transfer() TransferFunction {
+	if !d.LinearRGB {
+		return TransferLinear
+	}
+	return d.Transfer
+}
+
+// linearized returns a Ditherer with a linear palette that matches
+// d.transfer(). If that's TransferSRGB then d is returned, otherwise it's a
+// copy of d with a new linear palette. This way d is never modified, and can
+// still be used concurrently.
+func (d *Ditherer) linearized() *Ditherer {
+	tf := d.transfer()
+	if tf == TransferSRGB {
+		return d
+	}
+	dd := *d
+	dd.setLinearPalette(tf)
+	return &dd
+}
+
+// grayLevels returns the palette colors sorted by gray value, for use by
+// closestGray. If any of the colors aren't gray, nil is returned. Transparent
+// colors are skipped.
+func grayLevels(palette []color.Color, linearPalette [][3]uint16) []grayLevel {
+	levels := make([]grayLevel, 0, len(linearPalette))
+	for i, c := range linearPalette {
+		if isTransparent(palette[i]) {
+			continue
+		}
+		if c[0] != c[1] || c[1] != c[2] {
+			return nil
+		}
+		levels = append(levels, grayLevel{c[0], i})
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if levels[i].v == levels[j].v {
+			return levels[i].i < levels[j].i
+		}
+		return levels[i].v < levels[j].v
+	})
+	return levels
+}
+
+// grayscale returns the linear RGB color as a gray with the same luminance, if
+// GrayscaleMatch is set and the palette only has grays. Otherwise it's
+// returned unchanged. The luminance is found with LinearLuminance.
+func (d *Ditherer) grayscale(r, g, b uint16) (uint16, uint16, uint16) {
+	if !d.GrayscaleMatch || d.grayLevels == nil {
+		return r, g, b
+	}
+	y := LinearLuminance(r, g, b)
+	return y, y, y
+}
+
+// preNoise adds the PreNoise noise to the pixel at (x, y).
+func (d *Ditherer) preNoise(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+	amount := 65535 * d.PreNoise
+	return d.round(float32(r) + amount*(2*pixelRand(0, x, y, 0)-1)),
+		d.round(float32(g) + amount*(2*pixelRand(0, x, y, 1)-1)),
+		d.round(float32(b) + amount*(2*pixelRand(0, x, y, 2)-1))
+}
+
+// Input values for PreserveExtremes, out of 255. Pixels with all channels at
+// or below extremeBlack are nearly black, and ones at or above extremeWhite are
+// nearly white.
+const (
+	extremeBlack = 8
+	extremeWhite = 247
+)
+
+// extremes returns a function for PreserveExtremes. It returns the index of the
+// darkest or lightest palette color if the linear RGB color is nearly black or
+// white, and -1 otherwise. The input image must use the transfer function tf.
+func (d *Ditherer) extremes(tf TransferFunction) func(r, g, b uint16) int {
+	if !d.PreserveExtremes {
+		return func(r, g, b uint16) int { return -1 }
+	}
+
+	// Find the palette colors with the lowest and highest luminance
+	darkest, lightest := -1, -1
+	var minY, maxY uint16
+	for i, c := range d.linearPalette {
+		if d.transparents[i] {
+			continue
+		}
+		y := LinearLuminance(c[0], c[1], c[2])
+		if darkest == -1 || y < minY {
+			darkest, minY = i, y
+		}
+		if lightest == -1 || y > maxY {
+			lightest, maxY = i, y
+		}
+	}
+
+	black := tf.linearize255to65535(extremeBlack)
+	white := tf.linearize255to65535(extremeWhite)
+	return func(r, g, b uint16) int {
+		if r <= black && g <= black && b <= black {
+			return darkest
+		}
+		if r >= white && g >= white && b >= white {
+			return lightest
+		}
+		return -1
+	}
+}
+
+// passResult is the result of dithering one pixel, in one of the passes set
+// by BidirectionalPasses.
+type passResult struct {
+	idx int32 // Palette index
+	a   uint16
+}
+
+// passTileSize is the width and height of the areas that selectPasses picks
+// a pass for.
+const passTileSize = 8
+
+// selectPasses picks the colors out of the results of each pass, and writes
+// them to the image with write.
+//
+// The image is split into square tiles, and each tile is taken from the pass
+// where the average color of the tile is closest to the input image, which is
+// orig. Ties go to the earlier pass. Picking single pixels instead would favor
+// leaving out the isolated dots in light and dark areas, changing the tone.
+func (d *Ditherer) selectPasses(b image.Rectangle, results [][]passResult, orig [][3]uint16, skip []bool, write func(x, y, idx int, a uint16)) {
+	offset := func(x, y int) int {
+		return (y-b.Min.Y)*b.Dx() + (x - b.Min.X)
+	}
+
+	for ty := b.Min.Y; ty < b.Max.Y; ty += passTileSize {
+		for tx := b.Min.X; tx < b.Max.X; tx += passTileSize {
+			tile := image.Rect(tx, ty, tx+passTileSize, ty+passTileSize).Intersect(b)
+
+			best := 0
+			bestScore := math.Inf(1)
+			for p, pass := range results {
+				// How far off the pass is from the input image in this tile
+				var sum [3]float64
+				for y := tile.Min.Y; y < tile.Max.Y; y++ {
+					for x := tile.Min.X; x < tile.Max.X; x++ {
+						i := offset(x, y)
+						if skip != nil && skip[i] {
+							continue
+						}
+						if pass[i].a == 0 && d.transparent >= 0 {
+							// No error for transparent pixels
+							continue
+						}
+						c := d.linearPalette[pass[i].idx]
+						for ch := range sum {
+							sum[ch] += float64(c[ch]) - float64(orig[i][ch])
+						}
+					}
+				}
+				if score := sum[0]*sum[0] + sum[1]*sum[1] + sum[2]*sum[2]; score < bestScore {
+					best = p
+					bestScore = score
+				}
+			}
+
+			for y := tile.Min.Y; y < tile.Max.Y; y++ {
+				for x := tile.Min.X; x < tile.Max.X; x++ {
+					i := offset(x, y)
+					if skip != nil && skip[i] {
+						continue
+					}
+					write(x, y, int(results[best][i].idx), results[best][i].a)
+				}
+			}
+		}
+	}
 }
 
 // invalid returns true when the current struct fields of the Ditherer make it
 // impossible to dither.
 func (d *Ditherer) invalid() bool {
-	// This basically XORs three bools that represent whether each value is
-	// unset or not. The if statement evaluates to true if one is set, but
-	// false if none or more than one are set. But then it's flipped with !()
-	// on the outside.
-	if !((d.Mapper != nil) != ((d.Matrix != nil) != (d.Special != 0))) {
+	// At most one way of dithering can be set, none means quantizing only
+	set := 0
+	for _, b := range []bool{d.Mapper != nil, d.StatefulMapper != nil, d.Matrix != nil, d.Special != 0} {
+		if b {
+			set++
+		}
+	}
+	if set > 1 {
 		return true
 	}
-	if d.Special != 0 {
-		// No special dithering supported right now
+	if d.Special < 0 || d.Special >= numSpecials {
 		return true
 	}
+	if d.Transfer < 0 || d.Transfer >= numTransfers {
+		return true
+	}
+	if d.ColorSpace < 0 || d.ColorSpace >= numColorSpaces {
+		return true
+	}
+	if d.Background != nil {
+		if _, _, _, a := d.Background.RGBA(); a != 0xffff {
+			return true
+		}
+	}
+	if d.GamutMapping < 0 || d.GamutMapping >= numGamutMappings {
+		return true
+	}
+	if d.Rounding < 0 || d.Rounding >= numRoundings {
+		return true
+	}
+	if d.ScanOrder < 0 || d.ScanOrder >= numScanOrders {
+		return true
+	}
+	if d.Matrix != nil {
+		if d.Matrix.shape() != nil {
+			return true
+		}
+		if d.NormalizeMatrix && !(d.Matrix.sum() > 0) {
+			return true
+		}
+	}
+	if d.EdgeEnhance < 0 || d.PreNoise < 0 || !(d.ErrorThreshold >= 0) {
+		return true
+	}
+	switch d.BidirectionalPasses {
+	case 0, 1, 2, 4:
+	default:
+		return true
+	}
+	if d.Matrix != nil && d.MatrixOrigin != nil {
+		k := ErrorDiffusionKernel{Matrix: d.Matrix, OriginX: d.MatrixOrigin.X, OriginY: d.MatrixOrigin.Y}
+		if k.Validate() != nil {
+			return true
+		}
+	}
+	if _, ok := d.exactColors(); !ok {
+		return true
+	}
+	if d.PaletteWeights != nil {
+		if len(d.PaletteWeights) != len(d.palette) {
+			return true
+		}
+		for _, w := range d.PaletteWeights {
+			// Also catches NaN
+			if !(w > 0) {
+				return true
+			}
+		}
+	}
 	return false
 }
 
+// exactColors returns ExactColors with the keys converted to color.RGBA64, and
+// the values converted to palette indexes. It returns false if a value isn't in
+// the palette. If ExactColors is empty, nil is returned.
+func (d *Ditherer) exactColors() (map[color.RGBA64]int, bool) {
+	if len(d.ExactColors) == 0 {
+		return nil, true
+	}
+	exact := make(map[color.RGBA64]int, len(d.ExactColors))
+	for k, v := range d.ExactColors {
+		i := -1
+		v = color.RGBA64Model.Convert(v)
+		for j, c := range d.palette {
+			if c == v {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			return nil, false
+		}
+		exact[color.RGBA64Model.Convert(k).(color.RGBA64)] = i
+	}
+	return exact, true
+}
+
+// Clone returns a copy of the Ditherer that can be changed and used without
+// affecting d. This is the recommended way to dither with slightly different
+// settings at the same time: configure one Ditherer, and then clone it for
+// each variation.
+//
+// The palette and all the public fields are copied, including the contents of
+// Matrix, MatrixOrigin, AlphaLevels, PaletteWeights, and ExactColors. Fields
+// that hold functions, interfaces, or images, like Mapper and StrengthMap,
+// are shared with d, since they can't be copied. Those are only read while
+// dithering, but they must be safe to use from many goroutines at once.
+func (d *Ditherer) Clone() *Ditherer {
+	dd := *d
+
+	if d.Matrix != nil {
+		dd.Matrix = make(ErrorDiffusionMatrix, len(d.Matrix))
+		for i, row := range d.Matrix {
+			dd.Matrix[i] = append([]float32(nil), row...)
+		}
+	}
+	if d.MatrixOrigin != nil {
+		origin := *d.MatrixOrigin
+		dd.MatrixOrigin = &origin
+	}
+	if d.AlphaLevels != nil {
+		dd.AlphaLevels = append([]uint8(nil), d.AlphaLevels...)
+	}
+	if d.PaletteWeights != nil {
+		dd.PaletteWeights = append([]float32(nil), d.PaletteWeights...)
+	}
+	if d.ExactColors != nil {
+		dd.ExactColors = make(map[color.Color]color.Color, len(d.ExactColors))
+		for k, v := range d.ExactColors {
+			dd.ExactColors[k] = v
+		}
+	}
+
+	dd.palette = append([]color.Color(nil), d.palette...)
+	dd.linearPalette = append([][3]uint16(nil), d.linearPalette...)
+	dd.oklabPalette = append([][3]float32(nil), d.oklabPalette...)
+	if d.grayLevels != nil {
+		dd.grayLevels = append([]grayLevel(nil), d.grayLevels...)
+	}
+	// The tree, inks and transparents are never changed after NewDitherer, so they can be
+	// shared
+	return &dd
+}
+
+// SetKernel sets Matrix and MatrixOrigin using the provided kernel.
+func (d *Ditherer) SetKernel(k ErrorDiffusionKernel) {
+	d.Matrix = k.Matrix
+	d.MatrixOrigin = &image.Point{k.OriginX, k.OriginY}
+}
+
 // GetPalette returns a copy of the current palette being used by the Ditherer.
 func (d *Ditherer) GetPalette() []color.Color {
 	// Palette is copied so the user can't modify it externally later
 	return copyPalette(d.palette)
 }
 
+// GetColorPalette is like GetPalette, but returns the copy as a color.Palette,
+// for use with its methods and with the many stdlib functions that take one.
+// Note that its Index and Convert methods find the closest color using
+// Euclidean distance in sRGB space, unlike the Ditherer.
+func (d *Ditherer) GetColorPalette() color.Palette {
+	return color.Palette(copyPalette(d.palette))
+}
+
 func sqDiff(v1 uint16, v2 uint16) uint32 {
 	// This optimization is copied from Go stdlib, see
 	// https://github.com/golang/go/blob/go1.15.7/src/image/color/color.go#L314
@@ -125,30 +891,89 @@ func sqDiff(v1 uint16, v2 uint16) uint32 {
 	return (d * d) >> 2
 }
 
+// colorDist returns the distance between two linear RGB colors.
+func colorDist(r, g, b uint16, c [3]uint16) uint32 {
+	// Euclidean distance, but the square root part is removed
+	// Weight by luminance value to approximate radiant power / luminance
+	// as humans perceive it.
+	//
+	// The weights are fractions to keep everything in integer math, see
+	// lumaR. Unfortunately this requires promoting them to uint64 to prevent
+	// overflow
+
+	return uint32(
+		lumaR*uint64(sqDiff(r, c[0]))/lumaTotal +
+			lumaG*uint64(sqDiff(g, c[1]))/lumaTotal +
+			lumaB*uint64(sqDiff(b, c[2]))/lumaTotal,
+	)
+}
+
+// isTransparent returns true if the color is fully transparent.
+func isTransparent(c color.Color) bool {
+	_, _, _, a := c.RGBA()
+	return a == 0
+}
+
 // closestColor returns the index of the color in the palette that's closest to
-// the provided one, using Euclidean distance in linear RGB space. The provided
-// RGB values must be linear RGB.
+// the provided one, using Euclidean distance in linear RGB space, or in Oklab
+// if ColorSpace says so. The provided RGB values must be linear RGB. If
+// Quantizer is set, it's used instead.
 func (d *Ditherer) closestColor(r, g, b uint16) int {
+	if d.Quantizer != nil {
+		i := d.Quantizer(r, g, b)
+		if i < 0 || i >= len(d.palette) {
+			panic("dither: Quantizer returned an invalid palette index")
+		}
+		return i
+	}
+	if d.ColorSpace == ColorSpaceOklab {
+		return d.closestOklab(linearToOklab(r, g, b))
+	}
+	if d.PaletteWeights != nil {
+		return d.closestColorWeighted(r, g, b)
+	}
+	if !d.LuminanceWeighting {
+		return d.closestColorUnweighted(r, g, b)
+	}
+	if d.grayLevels != nil {
+		return d.closestGray(r, g, b)
+	}
+	if d.tree != nil {
+		return d.tree.nearest(r, g, b)
+	}
+	return d.closestColorLinear(r, g, b)
+}
+
+// closestColorLinear is closestColor, implemented by checking every palette
+// color.
+func (d *Ditherer) closestColorLinear(r, g, b uint16) int {
 	// Go through each color and find the closest one
-	color, best := 0, uint32(math.MaxUint32)
+	color, best := -1, uint32(math.MaxUint32)
 	for i, c := range d.linearPalette {
+		if d.transparents[i] {
+			continue
+		}
+		dist := colorDist(r, g, b, c)
+
+		if dist < best {
+			if dist == 0 {
+				return i
+			}
+			color, best = i, dist
+		}
+	}
+	return color
+}
 
-		// Euclidean distance, but the square root part is removed
-		// Weight by luminance value to approximate radiant power / luminance
-		// as humans perceive it.
-		//
-		// These values were taken from Wikipedia:
-		// https://en.wikipedia.org/wiki/Grayscale#Colorimetric_(perceptual_luminance-preserving)_conversion_to_grayscale
-		// 0.2126, 0.7152, 0.0722
-		// The are changed to fractions here to keep everything in integer math:
-		//     1063/5000, 447/625, 361/5000
-		// Unfortunately this requires promoting them to uint64 to prevent overflow
-
-		dist := uint32(
-			1063*uint64(sqDiff(r, c[0]))/5000 +
-				447*uint64(sqDiff(g, c[1]))/625 +
-				361*uint64(sqDiff(b, c[2]))/5000,
-		)
+// closestColorUnweighted is closestColor for when LuminanceWeighting is false.
+// It uses Euclidean distance without weighting the channels.
+func (d *Ditherer) closestColorUnweighted(r, g, b uint16) int {
+	color, best := -1, uint32(math.MaxUint32)
+	for i, c := range d.linearPalette {
+		if d.transparents[i] {
+			continue
+		}
+		dist := sqDiff(r, c[0]) + sqDiff(g, c[1]) + sqDiff(b, c[2])
 
 		if dist < best {
 			if dist == 0 {
@@ -160,9 +985,199 @@ func (d *Ditherer) closestColor(r, g, b uint16) int {
 	return color
 }
 
+// closestColorAt is closestColor, but only uses the palette colors allowed
+// by PaletteSelector for the pixel at (x, y).
+func (d *Ditherer) closestColorAt(x, y int, r, g, b uint16) int {
+	if d.PaletteSelector != nil && d.Quantizer == nil {
+		if indexes := d.PaletteSelector(x, y); len(indexes) != 0 {
+			if i := d.closestColorIn(indexes, r, g, b); i >= 0 {
+				return i
+			}
+		}
+	}
+	return d.closestColor(r, g, b)
+}
+
+// closestColorIn is closestColor, but only checks the palette colors at the
+// given indexes. It returns -1 if none of them can be used.
+func (d *Ditherer) closestColorIn(indexes []int, r, g, b uint16) int {
+	lab := d.oklab(r, g, b)
+	color, best := -1, math.Inf(1)
+	for _, i := range indexes {
+		if d.transparents[i] {
+			continue
+		}
+		wd := d.paletteDist(i, r, g, b, lab)
+		if d.PaletteWeights != nil {
+			wd *= float64(d.PaletteWeights[i])
+		}
+
+		if wd < best {
+			if wd == 0 {
+				return i
+			}
+			color, best = i, wd
+		}
+	}
+	return color
+}
+
+// stableIndex returns the palette index of the pixel at (x, y) in prev, if its
+// color is no more than threshold further from the linear RGB color than the
+// palette color at i is. Otherwise i is returned. See DitherStable.
+func (d *Ditherer) stableIndex(prev *image.Paletted, threshold float32, x, y, i int, r, g, b uint16) int {
+	if prev == nil {
+		return i
+	}
+	j := int(prev.ColorIndexAt(x, y))
+	if j == i || j >= len(d.palette) || d.transparents[j] {
+		return i
+	}
+	// Distances in linear RGB are scaled to [0, 1], like Oklab lightness
+	scale := 65535.0
+	if d.ColorSpace == ColorSpaceOklab {
+		scale = 1
+	}
+	lab := d.oklab(r, g, b)
+	return d.stableIndexDist(prev, threshold, scale, x, y, i, func(i int) float64 {
+		return d.paletteDist(i, r, g, b, lab)
+	})
+}
+
+// stableIndexDist is stableIndex, but with the squared distance to each
+// palette color returned by dist, which is divided by scale squared to get
+// distances where black and white are 1 apart.
+func (d *Ditherer) stableIndexDist(prev *image.Paletted, threshold float32, scale float64, x, y, i int, dist func(i int) float64) int {
+	if prev == nil {
+		return i
+	}
+	j := int(prev.ColorIndexAt(x, y))
+	if j == i || j >= len(d.palette) || d.transparents[j] {
+		return i
+	}
+	worse := math.Sqrt(dist(j)) - math.Sqrt(dist(i))
+	if worse <= float64(threshold)*scale {
+		return j
+	}
+	return i
+}
+
+// closestColorWeighted is closestColor for when PaletteWeights is set. Each
+// distance is multiplied by the weight of the palette color.
+func (d *Ditherer) closestColorWeighted(r, g, b uint16) int {
+	color, best := -1, math.Inf(1)
+	for i, c := range d.linearPalette {
+		if d.transparents[i] {
+			continue
+		}
+		var dist uint32
+		if d.LuminanceWeighting {
+			dist = colorDist(r, g, b, c)
+		} else {
+			dist = sqDiff(r, c[0]) + sqDiff(g, c[1]) + sqDiff(b, c[2])
+		}
+		if dist == 0 {
+			return i
+		}
+
+		if wd := float64(dist) * float64(d.PaletteWeights[i]); wd < best {
+			color, best = i, wd
+		}
+	}
+	return color
+}
+
+// closestOklab is closestColor for when ColorSpace is ColorSpaceOklab. The
+// color is given in Oklab, and doesn't have to be in the RGB gamut.
+func (d *Ditherer) closestOklab(lab [3]float32) int {
+	color, best := -1, math.Inf(1)
+	for i, c := range d.oklabPalette {
+		if d.transparents[i] {
+			continue
+		}
+		dist := oklabDist(lab, c)
+		if dist == 0 {
+			return i
+		}
+		if d.PaletteWeights != nil {
+			dist *= float64(d.PaletteWeights[i])
+		}
+		if dist < best {
+			color, best = i, dist
+		}
+	}
+	return color
+}
+
+// paletteDist returns the distance between a linear RGB color and the palette
+// color at index i, measured the way ColorSpace and LuminanceWeighting say.
+// The lab value must be the color in Oklab, see oklab.
+func (d *Ditherer) paletteDist(i int, r, g, b uint16, lab [3]float32) float64 {
+	if d.ColorSpace == ColorSpaceOklab {
+		return oklabDist(lab, d.oklabPalette[i])
+	}
+	c := d.linearPalette[i]
+	if d.LuminanceWeighting {
+		return float64(colorDist(r, g, b, c))
+	}
+	return float64(sqDiff(r, c[0]) + sqDiff(g, c[1]) + sqDiff(b, c[2]))
+}
+
+// oklab returns the linear RGB color in Oklab, if ColorSpace is
+// ColorSpaceOklab. Otherwise it's not needed, and the zero value is returned.
+func (d *Ditherer) oklab(r, g, b uint16) [3]float32 {
+	if d.ColorSpace != ColorSpaceOklab {
+		return [3]float32{}
+	}
+	return linearToOklab(r, g, b)
+}
+
+// closestGray is closestColor for when the palette is all grays. It returns
+// the exact same result, but uses a binary search instead of checking every
+// palette color.
+func (d *Ditherer) closestGray(r, g, b uint16) int {
+	// The distance to a gray is smallest for the gray closest to the weighted
+	// mean of the channels. The weights are the same as colorDist.
+	y := (lumaR*float64(r) + lumaG*float64(g) + lumaB*float64(b)) / lumaTotal
+
+	// colorDist has some integer rounding, which can make it prefer a gray
+	// that's slightly further from y. The rounding is always less than 4, and
+	// so it can only happen for grays where (v-y)^2 <= (best-y)^2 + 16. So
+	// those are checked exactly.
+	//
+	// Ties are broken by palette index, like closestColorLinear does.
+
+	levels := d.grayLevels
+	start := sort.Search(len(levels), func(i int) bool {
+		return float64(levels[i].v) >= y
+	})
+
+	color, best := -1, uint32(math.MaxUint32)
+	bestSq := math.Inf(1)
+	check := func(j int) bool {
+		diff := float64(levels[j].v) - y
+		if diff*diff > bestSq+16 {
+			// This gray and all the ones further away can't be closer
+			return false
+		}
+		dist := colorDist(r, g, b, d.linearPalette[levels[j].i])
+		if dist < best || (dist == best && levels[j].i < color) {
+			color, best = levels[j].i, dist
+			bestSq = diff * diff
+		}
+		return true
+	}
+	for j := start; j < len(levels) && check(j); j++ {
+	}
+	for j := start - 1; j >= 0 && check(j); j-- {
+	}
+	return color
+}
+
 // unpremultAndLinearize unpremultiplies the provided color, and returns the
-// linearized RGB values, as well as the unchanged alpha value.
-func unpremultAndLinearize(c color.Color) (uint16, uint16, uint16, uint16) {
+// RGB values linearized with the transfer function, as well as the unchanged
+// alpha value.
+func unpremultAndLinearize(c color.Color, tf TransferFunction) (uint16, uint16, uint16, uint16) {
 	// alpha
 	var a uint16
 
@@ -170,10 +1185,12 @@ func unpremultAndLinearize(c color.Color) (uint16, uint16, uint16, uint16) {
 	// Opaque colors are fast-tracked
 	// Non-premultiplied colors aren't unpremulted, and all others are
 	switch v := c.(type) {
-	case color.Gray:
-		a = 0xffff
-	case color.Gray16:
+	case color.Gray, color.Gray16, color.YCbCr, color.CMYK:
 		a = 0xffff
+	case color.NYCbCrA:
+		// The YCbCr part isn't premultiplied
+		c = v.YCbCr
+		a = uint16(v.A) * 257
 	case color.NRGBA:
 		// (1/255)*65535 = 257
 		// This converts 8-bit color into 16-bit
@@ -186,19 +1203,52 @@ func unpremultAndLinearize(c color.Color) (uint16, uint16, uint16, uint16) {
 		a = uint16(x)
 	}
 
-	r, g, b := toLinearRGB(c)
+	r, g, b := toLinearRGB(c, tf)
 	return r, g, b, a
 }
 
-// premult takes the current position in the image and the dithered
-// color for that position, and returns a color that's corrected to
-// take into account the alpha value of the original image at that
-// position -- premultipling it.
-func (d *Ditherer) premult(c color.RGBA64, x, y int, img image.Image) color.RGBA64 {
+// flattened is an image composited over an opaque background color, see
+// Ditherer.Background. The colors it returns are all opaque.
+type flattened struct {
+	image.Image
+	bg    color.RGBA64
+	linBg [3]uint16
+	tf    TransferFunction
+}
+
+func newFlattened(img image.Image, bg color.Color, tf TransferFunction) flattened {
+	rgba := color.RGBA64Model.Convert(bg).(color.RGBA64)
+	r, g, b := toLinearRGB(rgba, tf)
+	return flattened{img, rgba, [3]uint16{r, g, b}, tf}
+}
+
+func (f flattened) At(x, y int) color.Color {
+	c := f.Image.At(x, y)
+	r, g, b, a := unpremultAndLinearize(c, f.tf)
+	switch a {
+	case 0xffff:
+		// Returned as it is, so it's not changed by rounding
+		return c
+	case 0:
+		return f.bg
+	}
+
+	fa := float64(a) / 65535
+	mix := func(v, bg uint16) uint16 {
+		l := (float64(v)*fa + float64(bg)*(1-fa)) / 65535
+		return uint16(math.RoundToEven(f.tf.delinearize1(l) * 65535))
+	}
+	return color.RGBA64{mix(r, f.linBg[0]), mix(g, f.linBg[1]), mix(b, f.linBg[2]), 0xffff}
+}
+
+// premult takes the dithered color for a position in the image, and the alpha
+// value for that position, and returns a color that's corrected to take into
+// account the alpha value -- premultipling it.
+func (d *Ditherer) premult(c color.RGBA64, alpha uint16) color.RGBA64 {
 	// Algorithm described in #8
 	// https://github.com/makeworld-the-better-one/dither/issues/8
 
-	_, _, _, a := img.At(x, y).RGBA()
+	a := uint32(alpha)
 	if a == 0 {
 		// Transparent, no color values are held
 		return color.RGBA64{0, 0, 0, 0}
@@ -227,6 +1277,61 @@ func (d *Ditherer) premult(c color.RGBA64, x, y int, img image.Image) color.RGBA
 	}
 }
 
+// withAlpha returns the palette color with the alpha value applied, either
+// premultiplied or not depending on d.Premultiply.
+//
+// If img is an *image.NRGBA, straight alpha colors are returned as color.NRGBA,
+// because that's the only type it can store without converting to
+// premultiplied and back.
+func (d *Ditherer) withAlpha(img image.Image, c color.RGBA64, alpha uint16) color.Color {
+	if d.Premultiply {
+		return d.premult(c, alpha)
+	}
+	if alpha == 0 {
+		return color.NRGBA64{0, 0, 0, 0}
+	}
+	if _, ok := img.(*image.NRGBA); ok {
+		return color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), uint8(alpha >> 8)}
+	}
+	return color.NRGBA64{c.R, c.G, c.B, alpha}
+}
+
+// strengthAt returns the strength from StrengthMap for the pixel, in the range
+// [0, 1].
+func (d *Ditherer) strengthAt(x, y int) float32 {
+	if d.StrengthMap == nil || !(image.Point{x, y}.In(d.StrengthMap.Bounds())) {
+		return 1
+	}
+	return float32(color.Gray16Model.Convert(d.StrengthMap.At(x, y)).(color.Gray16).Y) / 65535
+}
+
+// alphaLevels returns d.AlphaLevels as sorted 16-bit values, or nil if
+// the alpha channel shouldn't be dithered.
+func (d *Ditherer) alphaLevels() []uint16 {
+	if len(d.AlphaLevels) == 0 {
+		return nil
+	}
+	levels := make([]uint16, len(d.AlphaLevels))
+	for i, a := range d.AlphaLevels {
+		// (1/255)*65535 = 257
+		levels[i] = uint16(a) * 257
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+	return levels
+}
+
+// closestLevel returns the value in the sorted levels that's closest to v.
+func closestLevel(levels []uint16, v uint16) uint16 {
+	i := sort.Search(len(levels), func(i int) bool { return levels[i] >= v })
+	if i == len(levels) {
+		return levels[i-1]
+	}
+	if i > 0 && v-levels[i-1] < levels[i]-v {
+		return levels[i-1]
+	}
+	return levels[i]
+}
+
 // Dither dithers the provided image.
 //
 // It will always try to change the provided image and return it, but if that
@@ -240,144 +1345,781 @@ func (d *Ditherer) premult(c color.RGBA64, x, y int, img image.Image) color.RGBA
 // If the input image is *image.Paletted and the image's palette is different than
 // the Ditherer's, or if the image can't be casted to draw.Image.
 //
-// The returned image type when copied is *image.RGBA. But it may be different if
-// the image wasn't copied.
+// An *image.YCbCr or *image.NYCbCrA, like the ones decoded from JPEGs, can't be
+// changed either, and an *image.CMYK can't hold the palette colors exactly.
+// Those and *image.Paletted are read directly while dithering into the new
+// image, instead of being converted to RGBA first, which saves a pass over the
+// image and keeps the full precision of colors with alpha.
+//
+// The returned image type when copied is *image.RGBA, or *image.NRGBA if
+// Premultiply is false. If any palette color needs more than 8 bits per
+// channel, it's *image.RGBA64 or *image.NRGBA64 instead, so those colors
+// aren't truncated. But it may be different if the image wasn't copied.
 func (d *Ditherer) Dither(src image.Image) image.Image {
+	return d.DitherWithScratch(src, nil)
+}
+
+// DitherAll dithers every image in srcs like Dither does, and returns the
+// dithered images in the same order. Like Dither, the images are changed and
+// returned when possible, so the same image shouldn't be in srcs twice.
+//
+// Instead of splitting up each image between goroutines, whole images are
+// dithered at the same time, up to runtime.GOMAXPROCS(0) of them. That's
+// faster when there are many small images, and it works for Matrix too, which
+// is otherwise always done in a single thread. If SingleThreaded is set, the
+// images are dithered one after another.
+func (d *Ditherer) DitherAll(srcs []image.Image) []image.Image {
 	if d.invalid() {
 		panic("dither: invalid Ditherer")
 	}
 
-	var img draw.Image
+	dsts := make([]image.Image, len(srcs))
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(srcs) {
+		workers = len(srcs)
+	}
+	if d.SingleThreaded || workers <= 1 {
+		for i, src := range srcs {
+			dsts[i] = d.Dither(src)
+		}
+		return dsts
+	}
+
+	// Each image only gets one goroutine, since there's already one for each
+	// CPU
+	dd := *d
+	dd.maxWorkers = 1
+
+	next := int32(-1) // Index of the last image that was started
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt32(&next, 1))
+				if i >= len(srcs) {
+					return
+				}
+				dsts[i] = dd.Dither(srcs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return dsts
+}
+
+// DitherWithScratch is like Dither, but reuses the buffers in s instead of
+// allocating new ones, when dithering using Matrix or LumaDiffusion. This reduces memory
+// allocations when dithering many images of the same size, like video frames.
+// If s is nil, it works exactly like Dither.
+//
+// If s is already being used by another call when this one starts, new
+// buffers are allocated instead, so the output is still correct. But to get
+// the benefits, each goroutine should have its own Scratch.
+func (d *Ditherer) DitherWithScratch(src image.Image, s *Scratch) image.Image {
+	return d.dither(src, ditherOptions{s: s})
+}
+
+// DitherMasked is like Dither, but only dithers the pixels where the mask
+// isn't fully transparent. The other pixels are left unchanged. The mask uses
+// the same coordinates as src, and pixels outside the mask bounds count as
+// fully transparent.
+//
+// The mask is only used to decide which pixels are dithered, any alpha value
+// above zero counts the same. To blend the dithered image with the original,
+// use the mask with draw.DrawMask afterwards.
+//
+// When dithering with Matrix, masked out pixels are excluded entirely. They
+// don't receive any error from the dithered pixels around them, and they don't
+// diffuse any error either. This keeps the edges of the dithered area from
+// being affected by colors outside of it.
+func (d *Ditherer) DitherMasked(src image.Image, mask image.Image) image.Image {
+	return d.dither(src, ditherOptions{mask: mask})
+}
+
+// DitherErrorMap is like Dither, but also returns the quantization error of
+// each pixel, which shows where the dithering struggles. The error map has the
+// same bounds as src, and is computed while dithering.
+//
+// Each error is the distance between two colors in linear RGB, scaled so that
+// the distance between black and white is 65535. With Matrix, it's the
+// distance between the color of the pixel with the error diffused to it and
+// the palette color it was set to, which is the error that gets diffused. With
+// BidirectionalPasses, the errors are from the first pass. Otherwise, it's the
+// distance between the input pixel and the palette color. Pixels that weren't
+// dithered, like transparent ones, have no error.
+func (d *Ditherer) DitherErrorMap(src image.Image) (image.Image, *image.Gray16) {
+	errMap := image.NewGray16(src.Bounds())
+	return d.dither(src, ditherOptions{errMap: errMap}), errMap
+}
+
+// DitherRegion dithers only the part of img inside r, changing it in place. The
+// rest of the image is left unchanged. Unlike Draw, nothing is copied into img
+// first, so this is useful for dithering an area again after it was changed.
+//
+// When dithering with Matrix, the edges of r are treated like the edges of the
+// image, so no error is diffused to pixels outside of it.
+//
+// If img is an *image.Paletted, it must have the same palette as the Ditherer,
+// otherwise the function will panic.
+func (d *Ditherer) DitherRegion(img draw.Image, r image.Rectangle) {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+	if p, ok := img.(*image.Paletted); ok && !samePalette(d.palette, p.Palette) {
+		panic("dither: DitherRegion: img is an *image.Paletted that doesn't have the same palette")
+	}
+
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return
+	}
+	region := d.region(img, r)
+	d.ditherInto(region, region, false, ditherOptions{})
+}
+
+// DitherRegionCarry is like DitherRegion, but the error diffused past the edges
+// of r is stored in carry, and then added to the pixels it was meant for when
+// they're dithered later with the same carry. This only matters for Matrix
+// and LumaDiffusion.
+//
+// This makes it possible to dither a huge image in tiles, without seams between
+// them. The tiles should be dithered in order, left to right and top to bottom.
+// Error diffused into tiles that were already dithered is kept in carry but
+// never used, so once all the tiles are done carry should be thrown away. If
+// the tiles are as wide as the image, the result is exactly the same as
+// dithering the whole image at once.
+//
+// Alpha error from AlphaLevels isn't carried over. With BidirectionalPasses,
+// only the error from the first pass is carried over. carry must not be used
+// by more than one goroutine at once.
+func (d *Ditherer) DitherRegionCarry(img draw.Image, r image.Rectangle, carry *ErrorCarry) {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+	if p, ok := img.(*image.Paletted); ok && !samePalette(d.palette, p.Palette) {
+		panic("dither: DitherRegionCarry: img is an *image.Paletted that doesn't have the same palette")
+	}
+
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return
+	}
+	carry.bounds = img.Bounds()
+	region := d.region(img, r)
+	d.ditherInto(region, region, false, ditherOptions{carry: carry})
+}
+
+// ErrorCarry holds error diffused past the edges of regions dithered with
+// DitherRegionCarry, until the pixels it belongs to are dithered. The zero
+// value is ready to use.
+type ErrorCarry struct {
+	errs map[image.Point][][3]float32
+	// bounds are the bounds of the whole image. Error for pixels outside of
+	// them is dropped.
+	bounds image.Rectangle
+}
+
+// add adds the RGB error for the pixel at p.
+func (c *ErrorCarry) add(p image.Point, r, g, b float32) {
+	if !p.In(c.bounds) {
+		return
+	}
+	if c.errs == nil {
+		c.errs = make(map[image.Point][][3]float32)
+	}
+	c.errs[p] = append(c.errs[p], [3]float32{r, g, b})
+}
+
+// region returns the part of img inside r, which must be within its bounds.
+func (d *Ditherer) region(img draw.Image, r image.Rectangle) draw.Image {
+	if si, ok := img.(subImager); ok {
+		// Keeps the image type, which some fast paths depend on
+		return si.SubImage(r).(draw.Image)
+	}
+	return &regionImage{img, r}
+}
+
+// regionImage is the part of an image inside rect. It's used by DitherRegion
+// for images that don't have a SubImage method.
+type regionImage struct {
+	draw.Image
+	rect image.Rectangle
+}
+
+func (r *regionImage) Bounds() image.Rectangle { return r.rect }
+
+// ditherOptions holds the optional arguments of dither and ditherInto. The
+// zero value doesn't use any of them.
+type ditherOptions struct {
+	// s is the Scratch to use for the buffers
+	s *Scratch
+	// mask is the mask used by DitherMasked
+	mask image.Image
+	// carry is used by DitherRegionCarry. Error diffused to pixels outside of
+	// the image is stored in it, and error stored in it for pixels inside the
+	// image is added to them first.
+	carry *ErrorCarry
+	// errMap is set to the quantization error of each pixel, for
+	// DitherErrorMap. It must have the same bounds as the image.
+	errMap *image.Gray16
+	// prev is the previous frame for DitherStable, and stability is the
+	// threshold for keeping its palette indexes.
+	prev      *image.Paletted
+	stability float32
+}
+
+// errorMagnitude returns the size of the error between two linear RGB colors,
+// given the difference in each channel. The largest possible error, between
+// black and white, is 65535.
+func errorMagnitude(er, eg, eb float32) color.Gray16 {
+	m := math.Sqrt(float64(er*er+eg*eg+eb*eb) / 3)
+	return color.Gray16{uint16(math.Min(math.Round(m), 65535))}
+}
+
+// dither implements Dither and the other methods like it.
+func (d *Ditherer) dither(src image.Image, opts ditherOptions) image.Image {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+
+	var img draw.Image
+	// in is where the input pixels are read from. It's the same as img, unless
+	// img started out blank.
+	var in image.Image
+	blank := false
+
+	// Whether src has to be read from, and dithered into a new image
+	readOnly := false
+	switch src := src.(type) {
+	case *image.Paletted:
+		// Setting colors would change them to the closest ones in the image's
+		// palette, unless it's the same one
+		readOnly = !samePalette(d.palette, src.Palette)
+	case *image.YCbCr, *image.NYCbCrA, *image.CMYK:
+		// Usually from JPEGs. They can't be changed, or can't hold the palette
+		// colors exactly.
+		readOnly = true
+	}
+
+	if readOnly {
+		// Instead of converting the whole thing to RGBA first, read the pixels
+		// straight from it and write the dithered ones to a new image. This
+		// also keeps the full precision of colors with alpha, which an 8-bit
+		// premultiplied copy would lose.
+		img = d.newImage(src.Bounds())
+		in = src
+		blank = true
+	} else if dst, ok := src.(draw.Image); ok {
+		img = dst
+	} else {
+		// Can't be changed
+		// Instead make a copy and dither and return that
+		img = d.copyOfImage(src)
+	}
+	if in == nil {
+		in = img
+	}
+	return d.ditherInto(img, in, blank, opts)
+}
+
+// ditherInto dithers the pixels of in, and sets them in img. They can be the
+// same image. If they're not, blank must be true, and img must have the same
+// bounds as in. Then the pixels that aren't dithered because of the mask are
+// copied over.
+func (d *Ditherer) ditherInto(img draw.Image, in image.Image, blank bool, opts ditherOptions) image.Image {
+	s, mask, carry, errMap := opts.s, opts.mask, opts.carry, opts.errMap
+	prev, stability := opts.prev, opts.stability
+	alphaLevels := d.alphaLevels()
+	d = d.linearized()
+	tf := d.transfer()
+	if d.Background != nil {
+		in = newFlattened(in, d.Background, tf)
+	}
 
-	if pi, ok := src.(*image.Paletted); ok {
-		if !samePalette(d.palette, pi.Palette) {
-			// Can't use this because it will change image colors
-			// Instead make a copy, and return that later
-			img = copyOfImage(src)
+	// masked returns true for pixels that shouldn't be dithered
+	masked := func(x, y int) bool { return false }
+	if mask != nil {
+		masked = func(x, y int) bool {
+			_, _, _, a := mask.At(x, y).RGBA()
+			return a == 0
 		}
-	} else if img, ok = src.(draw.Image); !ok {
-		// Can't be changed
-		// Instead make a copy and dither and return that
-		img = copyOfImage(src)
 	}
 
-	if d.Mapper != nil {
+	extreme := d.extremes(tf)
+	exact, _ := d.exactColors()
+
+	if d.Special == LumaDiffusion {
+		d.lumaDiffusion(img, in, masked, opts)
+		return img
+	}
+
+	// Quantizing only and SoftNearest are done like a Mapper that doesn't
+	// change the colors
+	if d.Matrix == nil {
 		workers := 1
 		if !d.SingleThreaded {
 			workers = runtime.GOMAXPROCS(0)
 		}
-		parallel(workers, img.(draw.Image), img, func(x, y int, c color.Color) color.Color {
-			r, g, b, a := unpremultAndLinearize(c)
+		if d.maxWorkers > 0 && workers > d.maxWorkers {
+			workers = d.maxWorkers
+		}
+
+		var newState func() interface{}
+		mapper := func(state interface{}, x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+			return r, g, b
+		}
+		if d.Mapper != nil {
+			mapper = func(state interface{}, x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+				return d.Mapper(x, y, r, g, b)
+			}
+		}
+		if d.StatefulMapper != nil {
+			newState = d.StatefulMapper.NewState
+			mapper = d.StatefulMapper.Map
+		}
+		colorMapper := mapper
+		if d.StrengthMap != nil {
+			colorMapper = func(state interface{}, x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+				nr, ng, nb := mapper(state, x, y, r, g, b)
+				st := d.strengthAt(x, y)
+				return d.round(float32(r) + st*(float32(nr)-float32(r))),
+					d.round(float32(g) + st*(float32(ng)-float32(g))),
+					d.round(float32(b) + st*(float32(nb)-float32(b)))
+			}
+		}
+
+		sc := d.scanner(img.Bounds())
+		parallel(workers, sc.serpentine && sc.horizontal() && d.SingleThreaded, img, in, newState, func(state interface{}, x, y int, c color.Color) color.Color {
+			if masked(x, y) {
+				return c
+			}
+
+			r, g, b, a := unpremultAndLinearize(c, tf)
+			r, g, b = d.grayscale(r, g, b)
 
 			if a == 0 {
 				// Pixel is transparent, don't dither it
+				if d.transparent >= 0 {
+					return d.palette[d.transparent]
+				}
 				return c
 			}
-
-			return d.premult(
-				// Use PixelMapper -> find closest palette color -> get that color
-				// -> cast to color.RGBA64
-				// Comes from d.palette so this cast will always work
-				d.palette[d.closestColor(d.Mapper(x, y, r, g, b))].(color.RGBA64),
-				x, y, img,
-			)
+			if alphaLevels != nil {
+				// Apply the PixelMapper to alpha as if it was a gray color
+				a, _, _ = mapper(state, x, y, a, a, a)
+				a = closestLevel(alphaLevels, a)
+			}
+			i, ok := exact[color.RGBA64Model.Convert(c).(color.RGBA64)]
+			if !ok {
+				i = extreme(r, g, b)
+			}
+			if i < 0 {
+				// Use PixelMapper -> find closest palette color
+				mr, mg, mb := colorMapper(state, x, y, r, g, b)
+				if d.Special == SoftNearest {
+					i = d.softNearest(x, y, mr, mg, mb)
+				} else {
+					i = d.closestColorAt(x, y, mr, mg, mb)
+				}
+				i = d.stableIndex(prev, stability, x, y, i, mr, mg, mb)
+			}
+			if errMap != nil {
+				// Compared to the input color, not the mapped one
+				p := d.linearPalette[i]
+				errMap.SetGray16(x, y, errorMagnitude(
+					float32(int32(r)-int32(p[0])),
+					float32(int32(g)-int32(p[1])),
+					float32(int32(b)-int32(p[2])),
+				))
+			}
+			// Comes from d.palette so this cast will always work
+			return d.withAlpha(img, d.palette[i].(color.RGBA64), a)
 		})
 		return img
 	}
 
 	// Matrix needs to be applied instead
 
+	matrix := d.Matrix
+	if d.NormalizeMatrix {
+		matrix = matrix.normalized()
+	}
+
 	b := img.Bounds()
-	curPx := d.Matrix.CurrentPixel()
+	origin := image.Point{matrix.CurrentPixel(), 0}
+	if d.MatrixOrigin != nil {
+		origin = *d.MatrixOrigin
+	}
+
+	if s == nil || !s.acquire() {
+		// Use a new one just for this call
+		s = &Scratch{}
+	} else {
+		defer s.release()
+	}
 
 	// Store linear values here instead of converting back and forth and storing
 	// sRGB values inside the image.
-	lins := make([][][3]uint16, b.Dy())
-	for i := 0; i < len(lins); i++ {
-		lins[i] = make([][3]uint16, b.Dx())
-	}
+	lins := s.linearBuffer(b.Dx() * b.Dy())
 
 	// Setters and getters for that linear storage
+	// The buffer starts at the top left of the image, not at (0, 0)
+	offset := func(x, y int) int {
+		return (y-b.Min.Y)*b.Dx() + (x - b.Min.X)
+	}
 	linearSet := func(x, y int, r, g, b uint16) {
-		lins[y][x] = [3]uint16{r, g, b}
+		lins[offset(x, y)] = [3]uint16{r, g, b}
 	}
 	linearAt := func(x, y int) (uint16, uint16, uint16) {
-		c := lins[y][x]
+		c := lins[offset(x, y)]
 		return c[0], c[1], c[2]
 	}
 
-	// Pre-fill that 2D-array with the linearized image pixels
+	// With ColorSpaceOklab, the pixels are also stored in Oklab, and error is
+	// diffused there. Those values can be outside the RGB gamut, so that no
+	// error is lost when converting them back. The linear values are kept in
+	// sync, but are mapped into the gamut.
+	var labs [][3]float32
+	setLabs := func() {
+		for i, c := range lins {
+			labs[i] = linearToOklab(c[0], c[1], c[2])
+		}
+	}
+
+	// addError adds diffused error to the pixel at (x, y)
+	addError := func(x, y int, er, eg, eb float32) {
+		if labs != nil {
+			c := &labs[offset(x, y)]
+			*c = clampOklab([3]float32{c[0] + er, c[1] + eg, c[2] + eb})
+			r, g, b := oklabToLinear(*c, d.GamutMapping)
+			linearSet(x, y, r, g, b)
+			return
+		}
+		r, g, b := linearAt(x, y)
+		linearSet(x, y, d.round(float32(r)+er), d.round(float32(g)+eg), d.round(float32(b)+eb))
+	}
+
+	// The mask is checked for every pixel the error is diffused to, so store
+	// it instead of calling masked each time
+	var skip []bool
+	if mask != nil {
+		skip = make([]bool, b.Dx()*b.Dy())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				skip[offset(x, y)] = masked(x, y)
+			}
+		}
+	}
+
+	// Alpha values are only stored if they're being dithered
+	var alphas []uint16
+	if alphaLevels != nil {
+		alphas = s.alphaBuffer(b.Dx() * b.Dy())
+	}
+
+	// Pre-fill that buffer with the linearized image pixels
 	for y := b.Min.Y; y < b.Max.Y; y++ {
 		for x := b.Min.X; x < b.Max.X; x++ {
-			r, g, b, _ := unpremultAndLinearize(img.At(x, y))
+			c := in.At(x, y)
+			r, g, b, a := unpremultAndLinearize(c, tf)
+			r, g, b = d.grayscale(r, g, b)
 			linearSet(x, y, r, g, b)
+			if alphas != nil {
+				alphas[offset(x, y)] = a
+			}
+			if blank && skip != nil && skip[offset(x, y)] {
+				// Masked out pixels won't be set later
+				img.Set(x, y, c)
+			}
+		}
+	}
+	if d.ColorSpace == ColorSpaceOklab {
+		labs = make([][3]float32, len(lins))
+		setLabs()
+	}
+	if carry != nil {
+		// Add the error carried over from regions dithered before
+		for p, e := range carry.errs {
+			if !p.In(b) {
+				continue
+			}
+			// Added one at a time, in the order they were diffused, so it's
+			// rounded and clamped just like error diffused within the image
+			for _, e := range e {
+				addError(p.X, p.Y, e[0], e[1], e[2])
+			}
+			delete(carry.errs, p)
+		}
+	}
+
+	passes := d.BidirectionalPasses
+	if passes == 0 {
+		passes = 1
+	}
+
+	// Edge enhancement and extra passes need the input pixels, before any
+	// error is diffused
+	var orig [][3]uint16
+	var origAlphas []uint16
+	if d.EdgeEnhance != 0 || d.PreserveExtremes || passes > 1 {
+		orig = make([][3]uint16, len(lins))
+		copy(orig, lins)
+	}
+	if alphas != nil && passes > 1 {
+		origAlphas = make([]uint16, len(alphas))
+		copy(origAlphas, alphas)
+	}
+	// enhance returns the pixel at (x, y) with its edges enhanced, using the
+	// input image
+	enhance := func(x, y int, cr, cg, cb uint16) (uint16, uint16, uint16) {
+		var sum [3]float32
+		n := float32(0)
+		for _, p := range [4]image.Point{{x - 1, y}, {x + 1, y}, {x, y - 1}, {x, y + 1}} {
+			if !p.In(b) {
+				continue
+			}
+			c := orig[offset(p.X, p.Y)]
+			sum[0] += float32(c[0])
+			sum[1] += float32(c[1])
+			sum[2] += float32(c[2])
+			n++
+		}
+		if n == 0 {
+			return cr, cg, cb
+		}
+		c := orig[offset(x, y)]
+		return d.round(float32(cr) + d.EdgeEnhance*(float32(c[0])-sum[0]/n)),
+			d.round(float32(cg) + d.EdgeEnhance*(float32(c[1])-sum[1]/n)),
+			d.round(float32(cb) + d.EdgeEnhance*(float32(c[2])-sum[2]/n))
+	}
+
+	closestColor := d.closestColor
+	if d.UseCache {
+		if cache := newColorCache(d); cache != nil {
+			closestColor = cache.closest
+		}
+	}
+
+	// write sets the dithered pixel at (x, y) to the palette color at idx,
+	// with the alpha value a
+	write := func(x, y, idx int, a uint16) {
+		if a == 0 && d.transparent >= 0 {
+			img.Set(x, y, d.palette[d.transparent])
+			return
 		}
+		img.Set(x, y, d.withAlpha(img, d.palette[idx].(color.RGBA64), a))
 	}
+	set := write
+
+	// With more than one pass, the results of each pass are stored, and the
+	// image is only set at the end
+	var results [][]passResult
+	if passes > 1 {
+		results = make([][]passResult, passes)
+	}
+
+	// Lines are rows for the default ScanOrder, but can be columns or
+	// anti-diagonals too
+	sc := d.scanner(b)
 
 	// Now do the actual dithering
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
+	for pass := 0; pass < passes; pass++ {
+		// Pass 1 goes bottom-to-top, pass 2 goes right-to-left, and pass 3
+		// does both. With other ScanOrders, the directions are along and
+		// across its lines instead.
+		flipLines := pass&1 != 0
+		flipPos := pass&2 != 0
+		if pass > 0 {
+			copy(lins, orig)
+			copy(alphas, origAlphas)
+			if labs != nil {
+				setLabs()
+			}
+		}
+		if results != nil {
+			results[pass] = make([]passResult, len(lins))
+			results := results[pass]
+			set = func(x, y, idx int, a uint16) {
+				results[offset(x, y)] = passResult{int32(idx), a}
+			}
+		}
+
+		// Quantization error of the current pixel, including alpha
+		var er, eg, eb float32
+		var ea int32
+
+		quantize := func(x, y int) bool {
+			if skip != nil && skip[offset(x, y)] {
+				return false
+			}
 
-			oldX := x
-			if d.Serpentine && y%2 == 0 {
-				// Reverse direction
-				x = b.Max.X - 1 - x
+			var a uint16
+			ea = 0
+			if alphas != nil {
+				if oldA := alphas[offset(x, y)]; oldA != 0 {
+					a = closestLevel(alphaLevels, oldA)
+					ea = int32(oldA) - int32(a)
+				}
+			} else {
+				_, _, _, a32 := in.At(x, y).RGBA()
+				a = uint16(a32)
+			}
+			if a == 0 && d.transparent >= 0 {
+				// The transparent palette color can be used, so there's no
+				// error at all
+				set(x, y, d.transparent, 0)
+				return false
+			}
+			if exact != nil {
+				// The pixel hasn't been set yet, so this is still the input
+				// color
+				if i, ok := exact[color.RGBA64Model.Convert(in.At(x, y)).(color.RGBA64)]; ok {
+					// No error is diffused from this pixel
+					set(x, y, i, a)
+					if errMap != nil && pass == 0 {
+						r, g, b := linearAt(x, y)
+						p := d.linearPalette[i]
+						errMap.SetGray16(x, y, errorMagnitude(
+							float32(int32(r)-int32(p[0])),
+							float32(int32(g)-int32(p[1])),
+							float32(int32(b)-int32(p[2])),
+						))
+					}
+					return false
+				}
 			}
 
 			// Quantize current pixel
 			oldR, oldG, oldB := linearAt(x, y)
-			newColorIdx := d.closestColor(oldR, oldG, oldB)
-			img.Set(x, y, d.premult(d.palette[newColorIdx].(color.RGBA64), x, y, img))
+			qR, qG, qB := oldR, oldG, oldB // What actually gets quantized
+			if d.EdgeEnhance != 0 {
+				qR, qG, qB = enhance(x, y, qR, qG, qB)
+			}
+			if d.PreNoise != 0 {
+				qR, qG, qB = d.preNoise(x, y, qR, qG, qB)
+			}
+			if d.ThresholdModulation != nil {
+				qR, qG, qB = d.ThresholdModulation(x, y, qR, qG, qB)
+			}
+			newColorIdx := -1
+			if d.PreserveExtremes {
+				c := orig[offset(x, y)]
+				newColorIdx = extreme(c[0], c[1], c[2])
+			}
+			isExtreme := newColorIdx >= 0
+			if !isExtreme {
+				switch {
+				case d.PaletteSelector != nil:
+					newColorIdx = d.closestColorAt(x, y, qR, qG, qB)
+				case labs != nil && d.Quantizer == nil && qR == oldR && qG == oldG && qB == oldB:
+					// Use the Oklab value, which may be outside the gamut.
+					// The error is still measured from it, even if it's
+					// mapped here, so that none is lost.
+					newColorIdx = d.closestOklab(d.GamutMapping.mapOklab(labs[offset(x, y)]))
+				default:
+					newColorIdx = closestColor(qR, qG, qB)
+				}
+				newColorIdx = d.stableIndex(prev, stability, x, y, newColorIdx, qR, qG, qB)
+			}
+			set(x, y, newColorIdx, a)
 
 			new := d.linearPalette[newColorIdx]
 			// Quant errors in each channel
-			er, eg, eb := int32(oldR)-int32(new[0]), int32(oldG)-int32(new[1]), int32(oldB)-int32(new[2])
-
-			// Diffuse error in two dimensions
-			for yy := range d.Matrix {
-				for xx := range d.Matrix[yy] {
-					if d.Matrix[yy][xx] == 0 {
-						// Skip, because it won't affect anything
-						continue
-					}
-
-					// Get the coords of the pixel the error is being applied to
-					deltaX, deltaY := d.Matrix.Offset(xx, yy, curPx)
-					if d.Serpentine && y%2 == 0 {
-						// Reflect the matrix horizontally because we're going right-to-left
-						// Otherwise the matrix would change pixels that have already been set
-						deltaX *= -1
-					}
-					pxX := x + deltaX
-					pxY := y + deltaY
-
-					if !(image.Point{pxX, pxY}.In(b)) {
-						// This is outside the image, so don't bother doing any further calculations
-						continue
-					}
+			er = float32(int32(oldR) - int32(new[0]))
+			eg = float32(int32(oldG) - int32(new[1]))
+			eb = float32(int32(oldB) - int32(new[2]))
+			if errMap != nil && pass == 0 {
+				errMap.SetGray16(x, y, errorMagnitude(er, eg, eb))
+			}
+			// Near-exact matches don't diffuse any error, see ErrorThreshold
+			t := d.ErrorThreshold * 65535
+			dropError := isExtreme || (t > 0 && abs32(er) < t && abs32(eg) < t && abs32(eb) < t)
+			if labs != nil {
+				old := labs[offset(x, y)]
+				new := d.oklabPalette[newColorIdx]
+				er, eg, eb = old[0]-new[0], old[1]-new[1], old[2]-new[2]
+			}
+			er *= d.ChannelStrength[0]
+			eg *= d.ChannelStrength[1]
+			eb *= d.ChannelStrength[2]
+			if d.StrengthMap != nil {
+				st := d.strengthAt(x, y)
+				er, eg, eb = er*st, eg*st, eb*st
+			}
+			if dropError {
+				er, eg, eb = 0, 0, 0
+			}
+			return true
+		}
 
-					r, g, b := linearAt(pxX, pxY)
-					linearSet(pxX, pxY,
-						RoundClamp(float32(r)+float32(er)*d.Matrix[yy][xx]),
-						RoundClamp(float32(g)+float32(eg)*d.Matrix[yy][xx]),
-						RoundClamp(float32(b)+float32(eb)*d.Matrix[yy][xx]),
-					)
+		diffuse := func(p image.Point, w float32) {
+			if !p.In(b) {
+				if carry != nil && pass == 0 {
+					carry.add(p, er*w, eg*w, eb*w)
 				}
+				return
+			}
+			if skip != nil && skip[offset(p.X, p.Y)] {
+				// Masked out pixels don't receive error
+				return
 			}
 
-			// Reset the x value to not mess up the for loop
-			// The x value is only changed when (d.Serpentine && y%2 == 0)
-			// But it's reset every time to avoid another if statement
-			x = oldX
+			addError(p.X, p.Y, er*w, eg*w, eb*w)
+			if ea != 0 && alphas[offset(p.X, p.Y)] != 0 {
+				// Transparent pixels stay that way, so they don't receive any
+				// error. And other pixels can't become zero, so they can
+				// still be told apart.
+				a := d.round(float32(alphas[offset(p.X, p.Y)]) + float32(ea)*w)
+				if a == 0 {
+					a = 1
+				}
+				alphas[offset(p.X, p.Y)] = a
+			}
 		}
+
+		errorDiffusion(sc, flipLines, flipPos, matrix, origin, quantize, diffuse)
+	}
+
+	if results != nil {
+		d.selectPasses(b, results, orig, skip, write)
 	}
 	return img
 }
 
-// GetColorModel returns a copy of the Ditherer's palette as a color.Model that finds the
-// closest color using Euclidean distance in sRGB space.
+// GetColorModel returns a color.Model that converts colors to the closest
+// palette color, the same way the Ditherer finds it. So a color that's
+// quantized by the Ditherer without dithering, like in quantize-only mode,
+// will be converted to the same palette color by the model. Fully transparent
+// colors are converted to the transparent palette color if there is one.
+//
+// The model uses a copy of the Ditherer's current settings, so changing the
+// Ditherer later doesn't affect it. It can be used from many goroutines at
+// once, as long as the settings, like Quantizer, allow that.
+//
+// The function will panic if the Ditherer is invalid. Use GetColorPalette to
+// get a color.Palette instead, which finds the closest color using Euclidean
+// distance in sRGB space.
 func (d *Ditherer) GetColorModel() color.Model {
-	return color.Palette(copyPalette(d.palette))
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+	dd := *d.linearized()
+	return ditherModel{&dd}
+}
+
+// ditherModel is the color.Model returned by GetColorModel.
+type ditherModel struct {
+	d *Ditherer
+}
+
+func (m ditherModel) Convert(c color.Color) color.Color {
+	r, g, b, a := unpremultAndLinearize(c, m.d.transfer())
+	if a == 0 && m.d.transparent >= 0 {
+		return m.d.palette[m.d.transparent]
+	}
+	return m.d.palette[m.d.closestColor(m.d.grayscale(r, g, b))]
 }
 
 // DitherConfig is like Dither, but returns an image.Config as well.
@@ -391,6 +2133,10 @@ func (d *Ditherer) DitherConfig(src draw.Image) (image.Image, image.Config) {
 
 // DitherCopy dithers a copy of the src image and returns it. The src image remains
 // unchanged. If you don't need to keep the original image, use Dither.
+//
+// The returned image has 8 bits per channel, so palette colors that need more
+// than that are truncated. Use DitherCopy16 for those palettes, or
+// DitherGray16 for 16-bit grayscale images.
 func (d *Ditherer) DitherCopy(src image.Image) *image.RGBA {
 	if d.invalid() {
 		panic("dither: invalid Ditherer")
@@ -398,7 +2144,7 @@ func (d *Ditherer) DitherCopy(src image.Image) *image.RGBA {
 
 	dst := copyOfImage(src)
 	// Can be safely cast because dst is *image.RGBA and .Dither will never need
-	// to copy it. And even if it did, it would return this type too.
+	// to copy it.
 	return d.Dither(dst).(*image.RGBA)
 }
 
@@ -411,6 +2157,21 @@ func (d *Ditherer) DitherCopyConfig(src image.Image) (*image.RGBA, image.Config)
 	}
 }
 
+// DitherCopy16 is like DitherCopy, but returns an *image.RGBA64. The src image
+// remains unchanged. DitherCopy uses 8 bits per channel, so palette colors with
+// 16 bits per channel lose precision, but with DitherCopy16 they're kept as
+// they are. The src image is also copied at full precision before dithering.
+func (d *Ditherer) DitherCopy16(src image.Image) *image.RGBA64 {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+
+	dst := image.NewRGBA64(src.Bounds())
+	copyImage(dst, src)
+	// Can be safely cast for the same reason as in DitherCopy
+	return d.Dither(dst).(*image.RGBA64)
+}
+
 // DitherPaletted dithers a copy of the src image and returns it as an
 // *image.Paletted. The src image remains unchanged. If you don't need an
 // *image.Paletted, using Dither or DitherCopy should be preferred.
@@ -421,7 +2182,11 @@ func (d *Ditherer) DitherCopyConfig(src image.Image) (*image.RGBA, image.Config)
 // If the Ditherer's palette has over 256 colors then the function will panic,
 // because *image.Paletted does not allow for that.
 //
-// DitherPaletted can't handle images with transparency.
+// DitherPaletted can only handle images with transparency if the palette has a
+// transparent color. Then fully transparent pixels will use that color, and
+// all other pixels are dithered like normal. Partially transparent pixels are
+// still not supported, unless AlphaLevels is set to 0 and 255, which makes
+// every pixel either fully transparent or fully opaque.
 func (d *Ditherer) DitherPaletted(src image.Image) *image.Paletted {
 	if len(d.palette) > 256 {
 		panic("dither: DitherPaletted: palette has over 256 colors which *image.Paletted doesn't support")
@@ -434,16 +2199,206 @@ func (d *Ditherer) DitherPaletted(src image.Image) *image.Paletted {
 }
 
 // DitherPalettedConfig is like DitherPaletted, but returns an image.Config as well.
+// Unlike the other Config methods, the color model is a color.Palette, like
+// the one from GetColorPalette, because that's what packages like image/gif
+// expect for paletted images.
 //
-// DitherPalettedConfig can't handle images with transparency.
+// DitherPalettedConfig handles transparency the same way as DitherPaletted.
 func (d *Ditherer) DitherPalettedConfig(src image.Image) (*image.Paletted, image.Config) {
 	return d.DitherPaletted(src), image.Config{
-		ColorModel: d.GetColorModel(),
+		ColorModel: d.GetColorPalette(),
 		Width:      src.Bounds().Dx(),
 		Height:     src.Bounds().Dy(),
 	}
 }
 
+// DitherPalettedCount is like DitherPaletted, but also returns the number of
+// pixels that use each palette color, in the same order as the palette. This
+// makes it easy to find colors that were never used, so they can be dropped
+// from the palette of a GIF for example.
+//
+// DitherPalettedCount handles transparency the same way as DitherPaletted.
+func (d *Ditherer) DitherPalettedCount(src image.Image) (*image.Paletted, []int) {
+	p := d.DitherPaletted(src)
+	counts := make([]int, len(p.Palette))
+	w := p.Rect.Dx()
+	for y := 0; y < p.Rect.Dy(); y++ {
+		for _, i := range p.Pix[y*p.Stride : y*p.Stride+w] {
+			counts[i]++
+		}
+	}
+	return p, counts
+}
+
+// DitherDiff is like DitherPaletted, but also returns the pixels whose palette
+// index is different from the one in prev, in order from left to right and
+// top to bottom. This is useful for displays that support partial refreshes,
+// like e-ink displays, where only the changed pixels need to be updated.
+//
+// prev should be the previous frame returned by DitherDiff or DitherPaletted
+// with the same palette, since only the indexes are compared. If prev is nil,
+// every pixel is returned. If prev doesn't have the same bounds as src, the
+// function will panic.
+//
+// DitherDiff handles transparency the same way as DitherPaletted.
+func (d *Ditherer) DitherDiff(prev *image.Paletted, src image.Image) (*image.Paletted, []image.Point) {
+	if prev != nil && !prev.Rect.Eq(src.Bounds()) {
+		panic("dither: DitherDiff: prev and src have different bounds")
+	}
+
+	p := d.DitherPaletted(src)
+	var changed []image.Point
+	b := p.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if prev == nil || prev.ColorIndexAt(x, y) != p.ColorIndexAt(x, y) {
+				changed = append(changed, image.Point{x, y})
+			}
+		}
+	}
+	return p, changed
+}
+
+// DitherStable is like DitherPaletted, but reduces flicker when dithering
+// successive frames that are nearly the same, like on e-ink displays. Small
+// changes in the input can change the dithered pattern across a large area,
+// especially with Matrix. To prevent that, each pixel keeps its palette index
+// from prev, unless the new closest palette color is closer to the pixel's
+// color by more than threshold.
+//
+// This trades some accuracy for stability over time. Larger thresholds flicker
+// less, but the output drifts further from the input, and gradual changes may
+// only show up once they're large enough. The distances are Euclidean, in the
+// color space used for finding the closest color. In linear RGB, they're scaled
+// so the distance between black and white is 1, and in Oklab that's already
+// the case. A threshold around 0.05 is a good start.
+//
+// prev should be the previous frame returned by DitherStable or DitherPaletted
+// with the same palette. If prev is nil, this is the same as DitherPaletted.
+// If prev doesn't have the same bounds as src, or the threshold is negative,
+// the function will panic.
+//
+// DitherStable handles transparency the same way as DitherPaletted.
+func (d *Ditherer) DitherStable(prev *image.Paletted, src image.Image, threshold float32) *image.Paletted {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+	if len(d.palette) > 256 {
+		panic("dither: DitherStable: palette has over 256 colors which *image.Paletted doesn't support")
+	}
+	if prev != nil && !prev.Rect.Eq(src.Bounds()) {
+		panic("dither: DitherStable: prev and src have different bounds")
+	}
+	if !(threshold >= 0) {
+		panic("dither: DitherStable: threshold is negative")
+	}
+
+	rgba := copyOfImage(src)
+	d.dither(rgba, ditherOptions{prev: prev, stability: threshold})
+	p := image.NewPaletted(rgba.Bounds(), copyPalette(d.palette))
+	copyImage(p, rgba)
+	return p
+}
+
+// DitherPalettedLarge is like DitherPaletted, but returns a *PalettedLarge,
+// which supports palettes with up to 65536 colors instead of 256.
+//
+// If the Ditherer's palette has over 65536 colors then the function will panic.
+//
+// DitherPalettedLarge handles transparency the same way as DitherPaletted.
+func (d *Ditherer) DitherPalettedLarge(src image.Image) *PalettedLarge {
+	if len(d.palette) > 1<<16 {
+		panic("dither: DitherPalettedLarge: palette has over 65536 colors which *PalettedLarge doesn't support")
+	}
+
+	rgba := d.DitherCopy(src)
+	p := NewPalettedLarge(rgba.Bounds(), copyPalette(d.palette))
+
+	// Palette.Index checks every color, which is slow for large palettes.
+	// But almost all pixels are exactly a palette color, so look those up
+	// directly.
+	indexes := make(map[color.RGBA]uint16, len(d.palette))
+	for i := len(d.palette) - 1; i >= 0; i-- {
+		// Iterate backwards so the first matching color is used, like
+		// Palette.Index does
+		indexes[color.RGBAModel.Convert(d.palette[i]).(color.RGBA)] = uint16(i)
+	}
+
+	b := rgba.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := rgba.RGBAAt(x, y)
+			if i, ok := indexes[c]; ok {
+				p.SetColorIndex(x, y, i)
+			} else {
+				p.Set(x, y, c)
+			}
+		}
+	}
+	return p
+}
+
+// DitherBinary dithers a copy of the src image into a *Bitmap, which stores each
+// pixel as a single bit. This is useful for e-ink displays and thermal
+// printers. The Ditherer's palette must have exactly two colors, otherwise it
+// will panic. The first palette color becomes 0 bits, and the second becomes 1
+// bits, so for devices where 1 means black, the palette should be
+// {color.White, color.Black}.
+//
+// DitherBinary handles transparency the same way as DitherPaletted.
+func (d *Ditherer) DitherBinary(src image.Image) *Bitmap {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+	if len(d.palette) != 2 {
+		panic("dither: DitherBinary: palette must have two colors")
+	}
+	dst := NewBitmap(src.Bounds(), copyPalette(d.palette))
+	d.ditherInto(dst, src, true, ditherOptions{})
+	return dst
+}
+
+// DitherGray dithers a copy of the src image into an *image.Gray, which uses a
+// quarter of the memory of the *image.RGBA that DitherCopy returns. The
+// Ditherer's palette must only have gray colors, otherwise it will panic.
+//
+// *image.Gray has no alpha channel, so src should be opaque. Pixels that aren't
+// come out as if they were drawn on top of black.
+func (d *Ditherer) DitherGray(src image.Image) *image.Gray {
+	d.checkGray("DitherGray")
+	dst := image.NewGray(src.Bounds())
+	d.ditherInto(dst, src, true, ditherOptions{})
+	return dst
+}
+
+// DitherGray16 is like DitherGray, but returns an *image.Gray16. Nothing is
+// reduced to 8 bits along the way: src is read at full precision, the
+// dithering uses 16-bit values, and the palette colors are set exactly. That
+// makes it the one to use for high bit depth data like height maps, where
+// 8-bit banding isn't acceptable.
+//
+// The dithering happens in linear RGB, which has less precision than the
+// input for very dark sRGB values, so nearly equal dark values can't always be
+// told apart. Data that isn't an sRGB image, like height maps, should use
+// TransferLinear, which keeps every value as it is.
+func (d *Ditherer) DitherGray16(src image.Image) *image.Gray16 {
+	d.checkGray("DitherGray16")
+	dst := image.NewGray16(src.Bounds())
+	d.ditherInto(dst, src, true, ditherOptions{})
+	return dst
+}
+
+// checkGray panics if the Ditherer can't be used by the function called name,
+// because it's invalid or the palette isn't grayscale.
+func (d *Ditherer) checkGray(name string) {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+	if d.grayLevels == nil {
+		panic("dither: " + name + ": palette has colors that aren't gray")
+	}
+}
+
 // RoundClamp clamps the number and rounds it, rounding ties to the nearest even number.
 // This should be used if you're writing your own PixelMapper.
 func RoundClamp(i float32) uint16 {
@@ -456,6 +2411,151 @@ func RoundClamp(i float32) uint16 {
 	return uint16(math.RoundToEven(float64(i)))
 }
 
+// Rounding is a way of rounding numbers to integers. It's used by
+// Ditherer.Rounding and RoundClampMode.
+type Rounding int
+
+const (
+	// RoundToEven rounds to the nearest integer, rounding ties to the nearest
+	// even number. This is what RoundClamp does.
+	RoundToEven Rounding = iota
+
+	// RoundHalfUp rounds to the nearest integer, rounding ties up.
+	RoundHalfUp
+
+	// Floor rounds down, which truncates the fractional part.
+	Floor
+
+	numRoundings
+)
+
+// RoundClampMode is like RoundClamp, but rounds the number using mode. It can
+// be used in your own PixelMapper to match the Ditherer's Rounding. The
+// function will panic if mode isn't valid.
+func RoundClampMode(i float32, mode Rounding) uint16 {
+	if i < 0 {
+		return 0
+	}
+	if i > 65535 {
+		return 65535
+	}
+	switch mode {
+	case RoundToEven:
+		return uint16(math.RoundToEven(float64(i)))
+	case RoundHalfUp:
+		return uint16(math.Floor(float64(i) + 0.5))
+	case Floor:
+		// It's not negative, so converting truncates it
+		return uint16(i)
+	}
+	panic("dither: RoundClampMode: invalid Rounding")
+}
+
+// scanner maps the pixels of an image to lines, and positions along each line,
+// for the Ditherer's ScanOrder. Error diffusion is done as if the lines were
+// rows, so the same matrix works for every order.
+type scanner struct {
+	b          image.Rectangle
+	vertical   bool // Lines are columns, and positions are rows
+	diagonal   bool // Lines are anti-diagonals, and positions are columns
+	serpentine bool // Every other line is processed backwards
+}
+
+// scanner returns the scanner for an image with bounds b, taking ScanOrder and
+// Serpentine into account.
+func (d *Ditherer) scanner(b image.Rectangle) scanner {
+	return newScanner(b, d.ScanOrder, d.Serpentine)
+}
+
+// newScanner returns the scanner for an image with bounds b and the given
+// order. If serpentine is true, the order is made serpentine.
+func newScanner(b image.Rectangle, order ScanOrder, serpentine bool) scanner {
+	return scanner{
+		b:          b,
+		vertical:   order == RasterVertical || order == SerpentineVertical,
+		diagonal:   order == Diagonal,
+		serpentine: serpentine || order == SerpentineHorizontal || order == SerpentineVertical,
+	}
+}
+
+// horizontal returns whether lines are rows.
+func (s scanner) horizontal() bool {
+	return !s.vertical && !s.diagonal
+}
+
+// lines returns the range of lines, with max being exclusive.
+func (s scanner) lines() (min, max int) {
+	switch {
+	case s.vertical:
+		return s.b.Min.X, s.b.Max.X
+	case s.diagonal:
+		return s.b.Min.X + s.b.Min.Y, s.b.Max.X + s.b.Max.Y - 1
+	}
+	return s.b.Min.Y, s.b.Max.Y
+}
+
+// span returns the range of positions over all lines, with max being
+// exclusive.
+func (s scanner) span() (min, max int) {
+	if s.vertical {
+		return s.b.Min.Y, s.b.Max.Y
+	}
+	return s.b.Min.X, s.b.Max.X
+}
+
+// positions returns the range of positions along the given line, with max
+// being exclusive.
+func (s scanner) positions(line int) (min, max int) {
+	min, max = s.span()
+	if s.diagonal {
+		// Only the part of the anti-diagonal that's inside the image
+		if m := line - s.b.Max.Y + 1; m > min {
+			min = m
+		}
+		if m := line - s.b.Min.Y + 1; m < max {
+			max = m
+		}
+	}
+	return min, max
+}
+
+// point returns the coordinates of the pixel at pos along line.
+func (s scanner) point(line, pos int) (x, y int) {
+	switch {
+	case s.vertical:
+		return line, pos
+	case s.diagonal:
+		return pos, line - pos
+	}
+	return pos, line
+}
+
+// delta converts an offset in lines and positions to one in pixels.
+func (s scanner) delta(dLine, dPos int) (dx, dy int) {
+	switch {
+	case s.vertical:
+		// Going down the column is like going right along the row
+		return dLine, dPos
+	case s.diagonal:
+		// The next line is the next anti-diagonal, so the matrix is sheared
+		return dPos, dLine - dPos
+	}
+	return dPos, dLine
+}
+
+// round is RoundClampMode using the Ditherer's Rounding.
+func (d *Ditherer) round(i float32) uint16 {
+	return RoundClampMode(i, d.Rounding)
+}
+
+// abs32 returns the absolute value of v.
+func abs32(v float32) float32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
 // copyImage copies src's pixels into dst.
 // They must be the same size.
 func copyImage(dst draw.Image, src image.Image) {
@@ -468,8 +2568,31 @@ func copyOfImage(img image.Image) *image.RGBA {
 	return dst
 }
 
+// copyOfImage returns a copy of the image that stores colors the way
+// d.Premultiply says.
+func (d *Ditherer) copyOfImage(img image.Image) draw.Image {
+	dst := d.newImage(img.Bounds())
+	copyImage(dst, img)
+	return dst
+}
+
+// newImage returns a new blank image that stores colors the way
+// d.Premultiply says, with 16 bits per channel if the palette needs it.
+func (d *Ditherer) newImage(r image.Rectangle) draw.Image {
+	switch {
+	case d.Premultiply && d.deep:
+		return image.NewRGBA64(r)
+	case d.Premultiply:
+		return image.NewRGBA(r)
+	case d.deep:
+		return image.NewNRGBA64(r)
+	}
+	return image.NewNRGBA(r)
+}
+
 // samePalette returns true if both palettes contain the same colors,
-// regardless of order.
+// regardless of order. Colors are compared by value, so color.Gray16{0}
+// and color.RGBA64{0, 0, 0, 0xffff} are the same.
 func samePalette(p1 []color.Color, p2 []color.Color) bool {
 	if len(p1) != len(p2) {
 		return false
@@ -480,9 +2603,10 @@ func samePalette(p1 []color.Color, p2 []color.Color) bool {
 	diff := make(map[color.Color]int, len(p1))
 	for _, x := range p1 {
 		// 0 value for int is 0, so just increment a counter for the string
-		diff[x]++
+		diff[color.RGBA64Model.Convert(x)]++
 	}
 	for _, y := range p2 {
+		y = color.RGBA64Model.Convert(y)
 		// If _y is not in diff bail out early
 		if _, ok := diff[y]; !ok {
 			return false
@@ -1,16 +1,27 @@
 package dither
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"image"
 	"image/color"
-	_ "image/jpeg"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
+	"io"
+	"math"
 	"math/rand"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/webp"
 )
 
 var (
@@ -34,6 +45,20 @@ const (
 	dice     = "images/input/dice.png"
 )
 
+func loadImage(path string, t *testing.T) image.Image {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
 func ditherAndCompareImage(input string, expected string, d *Ditherer, t *testing.T) {
 	expected = "images/output/" + expected
 
@@ -100,6 +125,15 @@ func TestRandomNoiseGrayscale(t *testing.T) {
 	ditherAndCompareImage(gradient, "random_noise_grayscale.png", d, t)
 }
 
+func TestRandomNoiseSerpentine(t *testing.T) {
+	rand.Seed(1)
+	d := NewDitherer(blackWhite)
+	d.Mapper = RandomNoiseGrayscale(-0.5, 0.5)
+	d.SingleThreaded = true
+	d.Serpentine = true
+	ditherAndCompareImage(gradient, "random_noise_grayscale_serpentine.png", d, t)
+}
+
 func TestRandomNoiseRGB(t *testing.T) {
 	rand.Seed(1)
 	noise := RandomNoiseRGB(-0.5, 0.5, -0.5, 0.5, -0.5, 0.5)
@@ -115,6 +149,16 @@ func TestRandomNoiseRGB(t *testing.T) {
 	ditherAndCompareImage(peppers, "random_noise_rgb_red-green-yellow-black.png", d, t)
 }
 
+func TestThreshold(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Mapper = ThresholdGrayscale(0.5)
+	ditherAndCompareImage(gradient, "threshold_grayscale.png", d, t)
+
+	d = NewDitherer(redGreenYellowBlack)
+	d.Mapper = Threshold(0.5)
+	ditherAndCompareImage(peppers, "threshold_red-green-yellow-black.png", d, t)
+}
+
 func TestBayerMatrix(t *testing.T) {
 	// Source for test cases is the same place as the original algorithm code
 	// https://bisqwit.iki.fi/story/howto/dither/jy/#Appendix%202ThresholdMatrix
@@ -144,6 +188,24 @@ func TestBayerMatrix(t *testing.T) {
 	assert.Equal(t, t4x4, bayerMatrix(4, 4))
 	assert.Equal(t, t4x2, bayerMatrix(4, 2))
 	assert.Equal(t, t2x4, bayerMatrix(2, 4))
+
+	assert.Equal(t, OrderedDitherMatrix{Matrix: t4x2, Max: 8}, BayerMatrix(4, 2))
+	assert.Equal(t, uint(9), BayerMatrix(3, 3).Max)
+	assert.Panics(t, func() { BayerMatrix(6, 6) })
+
+	_, err := BayerErr(6, 6, 1.0)
+	assert.Error(t, err)
+	_, err = BayerErr(0, 4, 1.0)
+	assert.Error(t, err)
+	_, err = BayerErr(4, 4, 1.0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, BayerMatrix(8, 4), BayerMatrixAnySize(8, 4))
+	assert.Equal(t, [][]uint{
+		{0, 4, 2},
+		{3, 5, 1},
+	}, BayerMatrixAnySize(3, 2).Matrix)
+	assert.Equal(t, uint(6), BayerMatrixAnySize(3, 2).Max)
 }
 
 func TestBayerGrayscale(t *testing.T) {
@@ -166,6 +228,29 @@ func TestBayerGrayscale(t *testing.T) {
 	ditherAndCompareImage(gradient, "bayer_16x8_gradient.png", d, t)
 }
 
+func TestBayerStrengthFunc(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Mapper = BayerStrengthFunc(4, 4, func(lum float32) float32 { return 1 })
+	ditherAndCompareImage(gradient, "bayer_4x4_gradient.png", d, t)
+
+	// No dithering in the shadows
+	dark := func(lum float32) float32 {
+		if lum < 0.1 {
+			return 0
+		}
+		return 1
+	}
+	mapper := PixelMapperFromMatrixStrengthFunc(BayerMatrix(4, 4), dark)
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			r, g, b := mapper(x, y, 1000, 2000, 3000)
+			assert.Equal(t, [3]uint16{1000, 2000, 3000}, [3]uint16{r, g, b})
+		}
+	}
+	r, _, _ := mapper(3, 3, 30000, 30000, 30000)
+	assert.NotEqual(t, uint16(30000), r)
+}
+
 func TestBayerColor(t *testing.T) {
 	bayer16 := Bayer(16, 16, 1.0)
 
@@ -183,6 +268,99 @@ func TestErrorDiffusionMatrix(t *testing.T) {
 	assert.Equal(t, 2, JarvisJudiceNinke.CurrentPixel())
 }
 
+func TestAllErrorDiffusionMatrices(t *testing.T) {
+	for name, edm := range AllErrorDiffusionMatrices() {
+		curPx := edm.CurrentPixel()
+		if curPx < 0 || curPx >= len(edm[0]) {
+			t.Errorf("%s: current pixel %d is out of range", name, curPx)
+			continue
+		}
+		if edm[0][curPx] != 0 {
+			t.Errorf("%s: current pixel %d is not zero", name, curPx)
+		}
+		for i := 0; i < curPx; i++ {
+			if edm[0][i] != 0 {
+				t.Errorf("%s: non-zero value before the current pixel", name)
+			}
+		}
+	}
+}
+
+func TestMatrixByName(t *testing.T) {
+	edm, ok := ErrorDiffusionMatrixByName("floyd-steinberg")
+	assert.True(t, ok)
+	assert.Equal(t, FloydSteinberg, edm)
+	edm, ok = ErrorDiffusionMatrixByName("Sierra2-4A")
+	assert.True(t, ok)
+	assert.Equal(t, SierraLite, edm)
+	_, ok = ErrorDiffusionMatrixByName("floyd steinberg")
+	assert.False(t, ok)
+
+	odm, ok := OrderedDitherMatrixByName("clustered-dot-diagonal-8x8")
+	assert.True(t, ok)
+	assert.Equal(t, ClusteredDotDiagonal8x8, odm)
+	_, ok = OrderedDitherMatrixByName("bayer")
+	assert.False(t, ok)
+}
+
+func TestErrorDiffusionKernelJSON(t *testing.T) {
+	k := ErrorDiffusionKernel{Matrix: FloydSteinberg, OriginX: 1}
+	data, err := json.Marshal(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var k2 ErrorDiffusionKernel
+	assert.NoError(t, json.Unmarshal(data, &k2))
+	assert.Equal(t, k, k2)
+
+	// Origin is detected when missing
+	assert.NoError(t, json.Unmarshal([]byte(`{"matrix": [[0, 0, 0.5], [0.25, 0.25, 0]]}`), &k2))
+	assert.Equal(t, 1, k2.OriginX)
+	assert.Equal(t, 0, k2.OriginY)
+
+	for _, bad := range []string{
+		`{"matrix": []}`,
+		`{"matrix": [[0, 0.5], [0.25]]}`,
+		`{"matrix": [[0.5, 0.5]]}`,
+		`{"matrix": [[0, 0, 0], [0.5, 0.5, 0]]}`,
+		`{"matrix": [[0, 0.5]], "origin_x": 1}`,
+		`{"matrix": [[0, 0.5]], "origin_x": 0, "origin_y": 1}`,
+	} {
+		assert.Error(t, json.Unmarshal([]byte(bad), &k2), bad)
+	}
+}
+
+func TestNewErrorDiffusionKernel(t *testing.T) {
+	rows := [][]float32{
+		{0, 0, 7.0 / 16},
+		{3.0 / 16, 5.0 / 16, 1.0 / 16},
+	}
+	k, err := NewErrorDiffusionKernel(rows, 1)
+	assert.NoError(t, err)
+	// Rows are copied
+	rows[0][2] = 1
+	d := NewDitherer(blackWhite)
+	d.SetKernel(k)
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg.png", d, t)
+
+	// CurrentPixel would get this wrong, because of the zero after the origin
+	k, err = NewErrorDiffusionKernel([][]float32{{0, 0, 0, 0.5}, {0.25, 0.25, 0, 0}}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, k.Matrix.CurrentPixel())
+	assert.Equal(t, 1, k.OriginX)
+
+	for _, bad := range [][][]float32{
+		{},
+		{{0, 0.5}, {0.25}},
+		{{0.5, 0.5}},
+	} {
+		_, err = NewErrorDiffusionKernel(bad, 0)
+		assert.Error(t, err)
+	}
+	_, err = NewErrorDiffusionKernel([][]float32{{0, 0.5}}, 2)
+	assert.Error(t, err)
+}
+
 func TestErrorDiffusionGrayscale(t *testing.T) {
 	d := NewDitherer(blackWhite)
 
@@ -210,6 +388,176 @@ func TestSerpentine(t *testing.T) {
 	ditherAndCompareImage(gradient, "edm_floyd-steinberg_serpentine.png", d, t)
 }
 
+// transpose returns a copy of img with its rows and columns swapped.
+func transpose(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	t := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			t.Set(y-b.Min.Y, x-b.Min.X, img.At(x, y))
+		}
+	}
+	return t
+}
+
+func TestScanOrder(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	d.ScanOrder = SerpentineHorizontal
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg_serpentine.png", d, t)
+
+	// Scanning vertically is the same as scanning the transposed image
+	// horizontally
+	img := loadImage(peppers, t)
+	for _, special := range []SpecialDither{0, LumaDiffusion} {
+		for _, order := range []ScanOrder{RasterVertical, SerpentineVertical} {
+			for _, passes := range []int{1, 2} {
+				d := NewDitherer(redGreenYellowBlack)
+				if special == 0 {
+					d.Matrix = FloydSteinberg
+					d.BidirectionalPasses = passes
+				} else {
+					d.Special = special
+				}
+				d.ScanOrder = order
+				vertical := d.DitherCopy(img)
+
+				d.ScanOrder = order - RasterVertical
+				horizontal := d.DitherCopy(transpose(img))
+				assert.Equal(t, transpose(horizontal).Pix, vertical.Pix, "%d %d %d", special, order, passes)
+			}
+		}
+	}
+
+	// Serpentine makes a vertical order serpentine
+	d = NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	d.ScanOrder = SerpentineVertical
+	want := d.DitherCopy(img)
+	d.ScanOrder = RasterVertical
+	d.Serpentine = true
+	assert.Equal(t, want, d.DitherCopy(img))
+
+	d.ScanOrder = Diagonal + 1
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestDiagonalScanOrder(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	d.ScanOrder = Diagonal
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg_diagonal.png", d, t)
+	d.Serpentine = true
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg_diagonal_serpentine.png", d, t)
+
+	// The gradient keeps its brightness, like it does with rows
+	img := loadImage(gradient, t)
+	raster := NewDitherer(blackWhite)
+	raster.Matrix = FloydSteinberg
+	mean := func(img *image.RGBA) float64 {
+		var sum float64
+		for i := 0; i < len(img.Pix); i += 4 {
+			sum += float64(img.Pix[i])
+		}
+		return sum / float64(len(img.Pix)/4)
+	}
+	assert.InDelta(t, mean(raster.DitherCopy(img)), mean(d.DitherCopy(img)), 1)
+
+	// Every pixel is dithered exactly once, for every pass and shape of image
+	src := loadImage(peppers, t)
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 1, 1),
+		image.Rect(3, 5, 4, 40),
+		image.Rect(3, 5, 40, 6),
+		image.Rect(7, 2, 50, 19),
+		image.Rect(11, 13, 19, 61),
+	} {
+		for _, special := range []SpecialDither{0, LumaDiffusion} {
+			d := NewDitherer(redGreenYellowBlack)
+			d.ScanOrder = Diagonal
+			if special == 0 {
+				d.Matrix = FloydSteinberg
+				d.BidirectionalPasses = 4
+			} else {
+				d.Special = special
+			}
+			sub := src.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(r)
+			dst := d.DitherCopy(sub)
+			assert.Equal(t, r, dst.Bounds())
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					// Pixels that are skipped stay transparent
+					if dst.RGBAAt(x, y).A != 255 {
+						t.Fatalf("pixel (%d, %d) of %v wasn't dithered, special %d", x, y, r, special)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestMatrixOrigin(t *testing.T) {
+	d := NewDitherer(blackWhite)
+
+	// Same as the detected origin
+	d.SetKernel(ErrorDiffusionKernel{Matrix: FloydSteinberg, OriginX: 1})
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg.png", d, t)
+
+	// Same matrix, but with a padding row on top that would break detection
+	d.SetKernel(ErrorDiffusionKernel{
+		Matrix: ErrorDiffusionMatrix{
+			{0, 0, 0},
+			{0, 0, 7.0 / 16},
+			{3.0 / 16, 5.0 / 16, 1.0 / 16},
+		},
+		OriginX: 1,
+		OriginY: 1,
+	})
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg.png", d, t)
+
+	d.MatrixOrigin = &image.Point{3, 0}
+	assert.Panics(t, func() { d.Dither(image.NewGray(image.Rect(0, 0, 1, 1))) })
+
+	// Symmetric kernel that diffuses upward and to the left
+	symmetric := ErrorDiffusionKernel{
+		Matrix: ErrorDiffusionMatrix{
+			{0, 0.125, 0},
+			{0.125, 0, 0.125},
+			{0, 0.125, 0},
+		},
+		OriginX: 1,
+		OriginY: 1,
+	}
+	assert.Error(t, symmetric.Validate())
+	d.SetKernel(symmetric)
+	assert.Panics(t, func() { d.Dither(image.NewGray(image.Rect(0, 0, 1, 1))) })
+
+	// Diffusing to the left of the current pixel is also a problem
+	symmetric.Matrix[0][1] = 0
+	assert.Error(t, symmetric.Validate())
+	symmetric.Matrix[1][0] = 0
+	assert.NoError(t, symmetric.Validate())
+
+	// Empty and ragged matrices are invalid, not a crash while dithering
+	for _, m := range []ErrorDiffusionMatrix{
+		{},
+		{{}},
+		{{0, 0, 7.0 / 16}, {3.0 / 16, 5.0 / 16}},
+		{{0, 7.0 / 16}, {3.0 / 16, 5.0 / 16, 1.0 / 16}},
+	} {
+		for _, origin := range []*image.Point{nil, {X: 0, Y: 0}} {
+			d := NewDitherer(blackWhite)
+			d.Matrix = m
+			d.MatrixOrigin = origin
+			assert.PanicsWithValue(t, "dither: invalid Ditherer", func() {
+				d.Dither(image.NewGray(image.Rect(0, 0, 4, 4)))
+			}, "%v %v", m, origin)
+		}
+	}
+}
+
 func TestErrorDiffusionStrength(t *testing.T) {
 	d := NewDitherer(blackWhite)
 	d.Matrix = ErrorDiffusionStrength(FloydSteinberg, 0.5)
@@ -246,6 +594,83 @@ func TestErrorDiffusionColor(t *testing.T) {
 	ditherAndCompareImage(peppers, "edm_peppers_atkinson_red-green-yellow-black.png", d, t)
 }
 
+func TestUseCache(t *testing.T) {
+	d := NewDitherer(redGreenYellowBlack)
+	d.UseCache = true
+	d.Matrix = FloydSteinberg
+	ditherAndCompareImage(peppers, "edm_peppers_floyd-steinberg_red-green-yellow-black.png", d, t)
+
+	rand.Seed(1)
+	img := loadImage(peppers, t)
+	for _, n := range []int{16, 64, 256} {
+		// Duplicates, and a transparent color, that the cache has to skip
+		palette := randomPalette(n)
+		palette[n/2] = palette[n/3]
+		palette[n-1] = color.Transparent
+		for _, weighting := range []bool{true, false} {
+			d := NewDitherer(palette)
+			d.LuminanceWeighting = weighting
+			c := newColorCache(d.linearized())
+			if !assert.NotNil(t, c) {
+				continue
+			}
+			for i := 0; i < 100000; i++ {
+				r, g, b := uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16))
+				if want, got := d.closestColor(r, g, b), c.closest(r, g, b); want != got {
+					t.Fatalf("%d colors: closest color to %d, %d, %d is %d, not %d", n, r, g, b, want, got)
+				}
+			}
+			// Most cells only have one color, otherwise it's not doing much
+			single, checked := 0, 0
+			for _, v := range c.cells {
+				if v != 0 {
+					checked++
+				}
+				if v > 0 {
+					single++
+				}
+			}
+			assert.Greater(t, single, checked/2, "%d colors", n)
+
+			d.Matrix = FloydSteinberg
+			expected := d.DitherCopy(img)
+			d.UseCache = true
+			assert.Equal(t, expected, d.DitherCopy(img), "%d colors", n)
+		}
+	}
+
+	// Not used when it can't help
+	d = NewDitherer(randomPalette(cacheMinColors - 1))
+	assert.Nil(t, newColorCache(d.linearized()))
+	d = NewDitherer(randomPalette(64))
+	d.ColorSpace = ColorSpaceOklab
+	assert.Nil(t, newColorCache(d.linearized()))
+}
+
+func BenchmarkUseCache(b *testing.B) {
+	f, err := os.Open(peppers)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rand.Seed(1)
+	d := NewDitherer(randomPalette(256))
+	d.Matrix = FloydSteinberg
+	for _, useCache := range []bool{false, true} {
+		d.UseCache = useCache
+		b.Run(fmt.Sprintf("UseCache=%t", useCache), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d.DitherCopy(img)
+			}
+		})
+	}
+}
+
 func BenchmarkErrorDiffusionColor(b *testing.B) {
 	f, err := os.Open(peppers)
 	if err != nil {
@@ -274,6 +699,164 @@ func BenchmarkErrorDiffusionColor(b *testing.B) {
 	}
 }
 
+func TestClosestGray(t *testing.T) {
+	rand.Seed(1)
+
+	gray256 := make([]color.Color, 256)
+	for i := range gray256 {
+		gray256[i] = color.Gray{uint8(i)}
+	}
+	// Random grays, with some duplicates and close values
+	grayRandom := make([]color.Color, 50)
+	for i := range grayRandom {
+		grayRandom[i] = color.Gray16{uint16(rand.Intn(1 << 16))}
+	}
+	grayRandom = append(grayRandom, grayRandom[3], color.Gray16{grayRandom[7].(color.Gray16).Y + 1})
+
+	for _, p := range [][]color.Color{blackWhite, gray256, grayRandom} {
+		d := NewDitherer(p)
+		if d.grayLevels == nil {
+			t.Fatal("palette not detected as gray")
+		}
+		for i := 0; i < 100000; i++ {
+			r, g, b := uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16))
+			if i%2 == 0 {
+				g, b = r, r
+			}
+			if d.closestGray(r, g, b) != d.closestColorLinear(r, g, b) {
+				t.Fatalf("closestGray(%d, %d, %d) = %d, closestColorLinear = %d",
+					r, g, b, d.closestGray(r, g, b), d.closestColorLinear(r, g, b))
+			}
+		}
+	}
+
+	if NewDitherer(redGreenBlack).grayLevels != nil {
+		t.Error("color palette detected as gray")
+	}
+}
+
+// randomPalette returns a palette of n random opaque colors.
+func randomPalette(n int) []color.Color {
+	p := make([]color.Color, n)
+	for i := range p {
+		p[i] = color.RGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), 255}
+	}
+	return p
+}
+
+func TestKDTree(t *testing.T) {
+	rand.Seed(1)
+	for _, n := range []int{1, 2, 16, 17, 256} {
+		p := randomPalette(n)
+		// Duplicate colors
+		p = append(p, p[0], p[n/2])
+		d := NewDitherer(p)
+		tree := newKDTree(d.palette, d.linearPalette)
+		for i := 0; i < 100000; i++ {
+			r, g, b := uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16))
+			if tree.nearest(r, g, b) != d.closestColorLinear(r, g, b) {
+				t.Fatalf("%d colors: tree.nearest(%d, %d, %d) = %d, closestColorLinear = %d",
+					n, r, g, b, tree.nearest(r, g, b), d.closestColorLinear(r, g, b))
+			}
+		}
+	}
+}
+
+func BenchmarkClosestColor(b *testing.B) {
+	rand.Seed(1)
+	for _, n := range []int{2, 16, 256} {
+		d := NewDitherer(randomPalette(n))
+		tree := newKDTree(d.palette, d.linearPalette)
+		colors := make([][3]uint16, 1024)
+		for i := range colors {
+			colors[i] = [3]uint16{uint16(rand.Intn(1 << 16)), uint16(rand.Intn(1 << 16)), uint16(rand.Intn(1 << 16))}
+		}
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c := colors[i%len(colors)]
+				d.closestColorLinear(c[0], c[1], c[2])
+			}
+		})
+		b.Run(fmt.Sprintf("tree/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c := colors[i%len(colors)]
+				tree.nearest(c[0], c[1], c[2])
+			}
+		})
+	}
+}
+
+func BenchmarkClosestColor256(b *testing.B) {
+	rand.Seed(1)
+	d := NewDitherer(randomPalette(256))
+	colors := make([][3]uint16, 1024)
+	for i := range colors {
+		colors[i] = [3]uint16{uint16(rand.Intn(1 << 16)), uint16(rand.Intn(1 << 16)), uint16(rand.Intn(1 << 16))}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := colors[i%len(colors)]
+		d.closestColor(c[0], c[1], c[2])
+	}
+}
+
+// benchSizes are the image sizes used by benchmarkDither.
+var benchSizes = []int{64, 256, 1024}
+
+// syntheticImage returns a size x size image with a color gradient and some
+// noise, so benchmarks don't depend on the files in images/input.
+func syntheticImage(size int) *image.NRGBA {
+	r := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{
+				uint8(x * 255 / size),
+				uint8(y * 255 / size),
+				uint8(r.Intn(256)),
+				255,
+			})
+		}
+	}
+	return img
+}
+
+// benchmarkDither runs a sub-benchmark of d.Dither for each of the sizes, using
+// synthetic images. Only the dithering is timed, not resetting the image
+// between runs. It can be used to compare Ditherer settings, or the same
+// settings before and after a change, with benchstat.
+func benchmarkDither(b *testing.B, d *Ditherer, sizes ...int) {
+	for _, size := range sizes {
+		src := syntheticImage(size)
+		img := image.NewNRGBA(src.Bounds())
+
+		b.Run(fmt.Sprintf("%dx%d", size, size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(src.Pix)))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				copy(img.Pix, src.Pix)
+				b.StartTimer()
+				d.Dither(img)
+			}
+		})
+	}
+}
+
+func BenchmarkDitherFloydSteinberg(b *testing.B) {
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	benchmarkDither(b, d, benchSizes...)
+}
+
+func BenchmarkDitherBayer(b *testing.B) {
+	d := NewDitherer(redGreenYellowBlack)
+	d.Mapper = Bayer(4, 4, 1.0)
+	benchmarkDither(b, d, benchSizes...)
+}
+
 func TestSubset(t *testing.T) {
 	assert.Equal(t, true, subset([]color.Color{color.Black}, blackWhite))
 	assert.Equal(t, false, subset(blackWhite, []color.Color{color.Black}))
@@ -301,6 +884,190 @@ func sameImage(img1 image.Image, img2 image.Image) bool {
 	return true
 }
 
+func TestClone(t *testing.T) {
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = ErrorDiffusionStrength(FloydSteinberg, 1)
+	d.MatrixOrigin = &image.Point{1, 0}
+	d.AlphaLevels = []uint8{0, 255}
+	d.PaletteWeights = []float32{1, 1, 1, 1}
+	d.ExactColors = map[color.Color]color.Color{color.White: color.Black}
+	d.Serpentine = true
+
+	c := d.Clone()
+	assert.Equal(t, d, c)
+	assert.False(t, d == c)
+
+	// Changing the clone doesn't change the original
+	c.Matrix[0][2] = 0
+	c.MatrixOrigin.X = 0
+	c.AlphaLevels[0] = 128
+	c.PaletteWeights[0] = 2
+	c.ExactColors[color.Black] = color.Black
+	c.palette[0] = color.White
+	c.linearPalette[0] = [3]uint16{}
+	c.Serpentine = false
+	assert.Equal(t, float32(7.0/16), d.Matrix[0][2])
+	assert.Equal(t, image.Point{1, 0}, *d.MatrixOrigin)
+	assert.Equal(t, []uint8{0, 255}, d.AlphaLevels)
+	assert.Equal(t, []float32{1, 1, 1, 1}, d.PaletteWeights)
+	assert.Len(t, d.ExactColors, 1)
+	assert.Equal(t, redGreenYellowBlack[0], color.Color(color.RGBAModel.Convert(d.GetPalette()[0])))
+	assert.True(t, d.Serpentine)
+
+	// Clones dither the same way, and can be used concurrently
+	img := loadImage(peppers, t)
+	d = NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	expected := d.DitherCopy(img)
+	var wg sync.WaitGroup
+	results := make([]*image.RGBA, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int, d *Ditherer) {
+			defer wg.Done()
+			if i%2 == 1 {
+				d.Serpentine = true
+			}
+			results[i] = d.DitherCopy(img)
+		}(i, d.Clone())
+	}
+	wg.Wait()
+	assert.Equal(t, expected, results[0])
+	assert.Equal(t, results[1], results[3])
+	assert.NotEqual(t, expected, results[1])
+}
+
+func TestGetColorPalette(t *testing.T) {
+	d := NewDitherer(redGreenBlack)
+	p := d.GetColorPalette()
+	assert.Equal(t, color.Palette(d.GetPalette()), p)
+	assert.Equal(t, 2, p.Index(color.Gray{10}))
+
+	// It's a copy
+	p[0] = color.White
+	assert.True(t, sameColor(redGreenBlack[0], d.GetColorPalette()[0]))
+}
+
+func TestGetColorModel(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	// Closer to white in sRGB, but closer to black in linear RGB
+	gray := color.Gray{128}
+	assert.True(t, sameColor(color.White, d.GetColorPalette().Convert(gray)))
+	assert.True(t, sameColor(color.Black, d.GetColorModel().Convert(gray)))
+
+	// Same as quantizing
+	rand.Seed(1)
+	d = NewDitherer(append(randomPalette(16), color.Transparent))
+	m := d.GetColorModel()
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256))
+		img.Pix[i+3] = 255
+	}
+	img.Pix[3] = 0
+	out := d.DitherCopy(img)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !sameColor(out.At(x, y), m.Convert(img.At(x, y))) {
+				t.Fatalf("model and Ditherer disagree at (%d, %d)", x, y)
+			}
+		}
+	}
+
+	// Changing the Ditherer doesn't affect the model
+	d = NewDitherer(blackWhite)
+	m = d.GetColorModel()
+	d.Quantizer = func(r, g, b uint16) int { return 0 }
+	assert.True(t, sameColor(color.White, m.Convert(color.White)))
+	assert.True(t, sameColor(color.Black, d.GetColorModel().Convert(color.White)))
+}
+
+func TestDitherImageTypes(t *testing.T) {
+	rand.Seed(1)
+	r := image.Rect(0, 0, 64, 64)
+	randAlpha := func() uint8 {
+		switch rand.Intn(4) {
+		case 0:
+			return 0
+		case 1:
+			return 255
+		}
+		return uint8(rand.Intn(256))
+	}
+
+	nycc := image.NewNYCbCrA(r, image.YCbCrSubsampleRatio444)
+	for i := range nycc.Y {
+		nycc.Y[i], nycc.Cb[i], nycc.Cr[i] = uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256))
+		nycc.A[i] = randAlpha()
+	}
+	cmyk := image.NewCMYK(r)
+	rand.Read(cmyk.Pix)
+	// Palette with straight and premultiplied colors with alpha
+	pal := color.Palette{color.Transparent}
+	for i := 0; i < 31; i++ {
+		c := color.NRGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), randAlpha()}
+		if i%2 == 0 {
+			pal = append(pal, c)
+		} else {
+			pal = append(pal, color.RGBAModel.Convert(c))
+		}
+	}
+	paletted := image.NewPaletted(r, pal)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(rand.Intn(len(pal)))
+	}
+
+	// straight returns the color with straight alpha, without losing any
+	// precision
+	straight := func(c color.Color) color.NRGBA64 {
+		switch v := c.(type) {
+		case color.NRGBA:
+			return color.NRGBA64{uint16(v.R) * 257, uint16(v.G) * 257, uint16(v.B) * 257, uint16(v.A) * 257}
+		case color.NYCbCrA:
+			r, g, b, _ := v.YCbCr.RGBA()
+			return color.NRGBA64{uint16(r), uint16(g), uint16(b), uint16(v.A) * 257}
+		}
+		return color.NRGBA64Model.Convert(c).(color.NRGBA64)
+	}
+
+	d := NewDitherer(append(randomPalette(8), color.Transparent))
+	d.Premultiply = false
+	for _, src := range []image.Image{nycc, cmyk, paletted} {
+		for _, m := range []ErrorDiffusionMatrix{nil, FloydSteinberg} {
+			d.Matrix = m
+			d.Mapper = nil
+			if m == nil {
+				d.Mapper = Bayer(4, 4, 0.5)
+			}
+
+			ref := image.NewNRGBA64(r)
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					ref.SetNRGBA64(x, y, straight(src.At(x, y)))
+				}
+			}
+			d.Dither(ref)
+			out := d.Dither(src).(*image.NRGBA)
+
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					c1, c2 := out.NRGBAAt(x, y), ref.NRGBA64At(x, y)
+					if c1 != (color.NRGBA{uint8(c2.R >> 8), uint8(c2.G >> 8), uint8(c2.B >> 8), uint8(c2.A >> 8)}) {
+						t.Fatalf("%T, matrix %v: got %v at (%d, %d), expected %v", src, m != nil, c1, x, y, c2)
+					}
+				}
+			}
+		}
+	}
+
+	// Paletted images with the same palette are changed
+	d = NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	p := image.NewPaletted(r, blackWhite)
+	assert.True(t, d.Dither(p) == image.Image(p))
+}
+
 func TestDitherPaletted(t *testing.T) {
 	// Test that the paletted image returned matches the image that would be
 	// returned by Dither.
@@ -327,6 +1094,29 @@ func TestDitherPaletted(t *testing.T) {
 	}
 }
 
+func TestDrawPalettedDifferentPalette(t *testing.T) {
+	src := loadImage(peppers, t)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	expected := d.DitherCopy(src)
+
+	// Superset of the Ditherer palette, in a different order
+	dst := image.NewPaletted(src.Bounds(), color.Palette{
+		color.White,
+		redGreenYellowBlack[3],
+		redGreenYellowBlack[2],
+		color.RGBA{0, 0, 255, 255},
+		redGreenYellowBlack[1],
+		redGreenYellowBlack[0],
+	})
+	d.Draw(dst, dst.Bounds(), src, src.Bounds().Min)
+	assert.True(t, sameImage(expected, dst))
+
+	// Yellow isn't in this palette, and gets approximated
+	dst = image.NewPaletted(src.Bounds(), redGreenBlack)
+	assert.NotPanics(t, func() { d.Draw(dst, dst.Bounds(), src, src.Bounds().Min) })
+}
+
 func TestPixelMapperFromMatrix(t *testing.T) {
 	d := NewDitherer(blackWhite)
 
@@ -362,61 +1152,2732 @@ func TestPixelMapperFromMatrix(t *testing.T) {
 	ditherAndCompareImage(gradient, "ClusteredDotDiagonal8x8_3.png", d, t)
 }
 
-func TestAlpha(t *testing.T) {
-	d := NewDitherer([]color.Color{
-		color.Black,
-		color.White,
-		color.RGBA{255, 0, 0, 255},
-		color.RGBA{0, 255, 0, 255},
-		color.RGBA{0, 0, 255, 255},
-	})
-	d.Mapper = Bayer(4, 4, 1)
-
-	ditherAndCompareImage(dice, "alpha_bayer.png", d, t)
-
-	d.Mapper = nil
-	d.Matrix = FloydSteinberg
-
-	ditherAndCompareImage(dice, "alpha_floyd-steinberg.png", d, t)
+func TestOrderedDitherMatrixTransforms(t *testing.T) {
+	odm := OrderedDitherMatrix{
+		Matrix: [][]uint{
+			{0, 1, 2},
+			{3, 4, 5},
+		},
+		Max: 6,
+	}
+	assert.Equal(t, OrderedDitherMatrix{Matrix: [][]uint{{2, 1, 0}, {5, 4, 3}}, Max: 6}, FlipH(odm))
+	assert.Equal(t, OrderedDitherMatrix{Matrix: [][]uint{{3, 4, 5}, {0, 1, 2}}, Max: 6}, FlipV(odm))
+	assert.Equal(t, OrderedDitherMatrix{Matrix: [][]uint{{3, 0}, {4, 1}, {5, 2}}, Max: 6}, Rotate90(odm))
+	assert.Equal(t, OrderedDitherMatrix{Matrix: [][]uint{{0, 3}, {1, 4}, {2, 5}}, Max: 6}, Transpose(odm))
+
+	// Copies are returned
+	FlipH(odm).Matrix[0][0] = 100
+	assert.Equal(t, uint(0), odm.Matrix[0][0])
+
+	assert.Equal(t, Horizontal3x5, Transpose(Vertical5x3))
+	assert.Equal(t, ClusteredDotVerticalLine, Transpose(ClusteredDotHorizontalLine))
+	assert.Equal(t, odm, Rotate90(Rotate90(Rotate90(Rotate90(odm)))))
+	assert.Equal(t, FlipH(FlipV(odm)), Rotate90(Rotate90(odm)))
+
+	assert.Equal(t, OrderedDitherMatrix{
+		Matrix: [][]uint{
+			{0, 0, 1, 1, 2, 2},
+			{0, 0, 1, 1, 2, 2},
+			{3, 3, 4, 4, 5, 5},
+			{3, 3, 4, 4, 5, 5},
+		},
+		Max: 6,
+	}, Scale(odm, 2))
+	assert.Equal(t, odm, Scale(odm, 1))
+	assert.Panics(t, func() { Scale(odm, 0) })
 }
 
-// func TestDrawer(t *testing.T) {
-// 	palette := []color.Color{
-// 		color.Gray{Y: 255},
-// 		color.Gray{Y: 160},
-// 		color.Gray{Y: 70},
-// 		color.Gray{Y: 35},
-// 		color.Gray{Y: 0},
-// 	}
-// 	d := NewDitherer(palette)
-// 	d.Matrix = FloydSteinberg
-
-// 	// Modified from Go stdlib:
-// 	// https://github.com/golang/go/blob/go1.15.7/src/image/draw/example_test.go
-// 	const width = 130
-// 	const height = 50
-
-// 	im := image.NewGray(image.Rectangle{Max: image.Point{X: width, Y: height}})
-// 	for x := 0; x < width; x++ {
-// 		for y := 0; y < height; y++ {
-// 			dist := math.Sqrt(math.Pow(float64(x-width/2), 2)/3+math.Pow(float64(y-height/2), 2)) / (height / 1.5) * 255
-// 			var gray uint8
-// 			if dist > 255 {
-// 				gray = 255
-// 			} else {
-// 				gray = uint8(dist)
-// 			}
-// 			im.SetGray(x, y, color.Gray{Y: 255 - gray})
-// 		}
-// 	}
-// 	pi := image.NewPaletted(im.Bounds(), palette)
-
-// 	d.Draw(pi, im.Bounds(), im, image.ZP)
-// 	shade := []string{" ", "░", "▒", "▓", "█"}
-// 	for i, p := range pi.Pix {
-// 		fmt.Print(shade[p])
-// 		if (i+1)%width == 0 {
-// 			fmt.Print("\n")
-// 		}
-// 	}
-// }
+func TestPixelMapperOffset(t *testing.T) {
+	plain := Bayer(4, 8, 1)
+	shifted := BayerOffset(4, 8, 1, 1, 10)
+	wrapped := BayerOffset(4, 8, 1, -3, -6)
+	for y := -10; y < 10; y++ {
+		for x := -10; x < 10; x++ {
+			r, g, b := plain(x+1, y+10, 30000, 30000, 30000)
+			r2, g2, b2 := shifted(x, y, 30000, 30000, 30000)
+			assert.Equal(t, [3]uint16{r, g, b}, [3]uint16{r2, g2, b2})
+			r2, g2, b2 = wrapped(x, y, 30000, 30000, 30000)
+			assert.Equal(t, [3]uint16{r, g, b}, [3]uint16{r2, g2, b2})
+		}
+	}
+
+	// Offset by the whole matrix size is the same as no offset
+	d := NewDitherer(blackWhite)
+	d.Mapper = PixelMapperFromMatrixOffset(BayerMatrix(8, 8), 1, 8, -16)
+	ditherAndCompareImage(gradient, "bayer_8x8_gradient.png", d, t)
+}
+
+func TestPixelMapperTiling(t *testing.T) {
+	// Not a power of two, and doesn't divide the image evenly
+	odm := OrderedDitherMatrix{
+		Matrix: [][]uint{
+			{0, 7, 3, 10, 5},
+			{11, 2, 13, 1, 8},
+			{4, 9, 6, 14, 12},
+		},
+		Max: 15,
+	}
+	pm := PixelMapperFromMatrix(odm, 1)
+	for y := -7; y < 7; y++ {
+		for x := -11; x < 11; x++ {
+			r, _, _ := pm(x, y, 30000, 30000, 30000)
+			r2, _, _ := pm(x+5, y+3, 30000, 30000, 30000)
+			assert.Equal(t, r, r2, "(%d, %d)", x, y)
+		}
+	}
+
+	// Random offsets are the same as the offset picked from the rng
+	rng := rand.New(rand.NewSource(5))
+	phaseX, phaseY := rng.Intn(5), rng.Intn(3)
+	random := PixelMapperFromMatrixRandomOffset(odm, 1, rand.New(rand.NewSource(5)))
+	offset := PixelMapperFromMatrixOffset(odm, 1, phaseX, phaseY)
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 5; x++ {
+			r, _, _ := random(x, y, 30000, 30000, 30000)
+			r2, _, _ := offset(x, y, 30000, 30000, 30000)
+			assert.Equal(t, r, r2)
+		}
+	}
+}
+
+func TestBayerScaled(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Mapper = BayerScaled(4, 4, 1, 1)
+	ditherAndCompareImage(gradient, "bayer_4x4_gradient.png", d, t)
+	d.Mapper = BayerScaled(4, 4, 1, 2)
+	ditherAndCompareImage(gradient, "bayer_4x4_scaled2_gradient.png", d, t)
+	d.Mapper = BayerScaled(4, 4, 1, 3)
+	ditherAndCompareImage(gradient, "bayer_4x4_scaled3_gradient.png", d, t)
+}
+
+func TestPatternMapper(t *testing.T) {
+	checkers := [][]bool{
+		{true, false},
+		{false, true},
+	}
+	pm := PatternMapper(checkers, 0.25, -0.25)
+	for _, p := range []image.Point{{0, 0}, {1, 1}, {-2, 4}, {-1, -1}} {
+		r, g, b := pm(p.X, p.Y, 30000, 30000, 30000)
+		assert.Equal(t, [3]uint16{46384, 46384, 46384}, [3]uint16{r, g, b}, "%v", p)
+	}
+	for _, p := range []image.Point{{1, 0}, {0, 1}, {-1, 4}, {-2, -1}} {
+		r, g, b := pm(p.X, p.Y, 30000, 30000, 30000)
+		assert.Equal(t, [3]uint16{13616, 13616, 13616}, [3]uint16{r, g, b}, "%v", p)
+	}
+
+	d := NewDitherer(blackWhite)
+	d.Mapper = pm
+	ditherAndCompareImage(gradient, "pattern_checkers_gradient.png", d, t)
+
+	assert.Panics(t, func() { PatternMapper(nil, 0.25, -0.25) })
+	assert.Panics(t, func() { PatternMapper([][]bool{{true}, {true, false}}, 0.25, -0.25) })
+}
+
+func TestBayerAnimated(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Mapper = BayerAnimated(8, 8, 1, 0)
+	ditherAndCompareImage(gradient, "bayer_8x8_gradient.png", d, t)
+
+	// pattern returns the values the PixelMapper adds to a gray across the
+	// matrix
+	pattern := func(pm PixelMapper) [8][8]uint16 {
+		var p [8][8]uint16
+		for y := range p {
+			for x := range p[y] {
+				p[y][x], _, _ = pm(x, y, 30000, 30000, 30000)
+			}
+		}
+		return p
+	}
+	seen := make(map[[8][8]uint16]bool)
+	for frame := 0; frame < 64; frame++ {
+		p := pattern(BayerAnimated(8, 8, 1, frame))
+		assert.False(t, seen[p], "frame %d repeats a pattern", frame)
+		seen[p] = true
+		assert.Equal(t, p, pattern(BayerAnimated(8, 8, 1, frame+64)))
+		assert.Equal(t, p, pattern(BayerAnimated(8, 8, 1, frame-64)))
+	}
+
+	for frame := 0; frame < 15; frame++ {
+		assert.NotPanics(t, func() { BayerAnimated(3, 5, 1, frame) })
+	}
+}
+
+func TestHalftone(t *testing.T) {
+	for _, tc := range []struct {
+		size  int
+		angle float64
+		dim   int
+	}{
+		{4, 0, 4},
+		{4, 90, 4},
+		{4, 45, 6},
+		{8, -45, 12},
+		{5, 15, 26},
+	} {
+		odm := Halftone(tc.size, tc.angle)
+		assert.Equal(t, tc.dim, len(odm.Matrix))
+		assert.Equal(t, uint(tc.dim*tc.dim), odm.Max)
+
+		// All values are used exactly once
+		seen := make(map[uint]bool)
+		for _, row := range odm.Matrix {
+			assert.Equal(t, tc.dim, len(row))
+			for _, v := range row {
+				seen[v] = true
+			}
+		}
+		assert.Equal(t, int(odm.Max), len(seen))
+	}
+
+	d := NewDitherer(blackWhite)
+	d.Mapper = PixelMapperFromMatrix(Halftone(6, 45), 1.0)
+	ditherAndCompareImage(gradient, "halftone_6_45.png", d, t)
+}
+
+// clusters returns the number of separate groups of matrix values below k,
+// counting values that are next to each other horizontally or vertically as
+// one group.
+func clusters(odm OrderedDitherMatrix, k uint) int {
+	h, w := len(odm.Matrix), len(odm.Matrix[0])
+	seen := make([][]bool, h)
+	for y := range seen {
+		seen[y] = make([]bool, w)
+	}
+	var fill func(x, y int)
+	fill = func(x, y int) {
+		if x < 0 || y < 0 || x >= w || y >= h || seen[y][x] || odm.Matrix[y][x] >= k {
+			return
+		}
+		seen[y][x] = true
+		fill(x-1, y)
+		fill(x+1, y)
+		fill(x, y-1)
+		fill(x, y+1)
+	}
+	n := 0
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if !seen[y][x] && odm.Matrix[y][x] < k {
+				n++
+				fill(x, y)
+			}
+		}
+	}
+	return n
+}
+
+func TestGenerateClusteredDot(t *testing.T) {
+	assert.Equal(t, ClusteredDot4x4, GenerateClusteredDot(4, false))
+	assert.Equal(t, ClusteredDotDiagonal8x8, GenerateClusteredDot(8, true))
+	assert.Equal(t, OrderedDitherMatrix{Matrix: [][]uint{{0, 3}, {2, 1}}, Max: 4}, GenerateClusteredDot(2, true))
+
+	for _, tc := range []struct {
+		size     int
+		diagonal bool
+	}{
+		{1, false}, {5, false}, {6, false}, {9, false}, {4, true}, {8, true}, {10, true},
+	} {
+		odm := GenerateClusteredDot(tc.size, tc.diagonal)
+		assert.Equal(t, tc.size, len(odm.Matrix))
+		assert.Equal(t, uint(tc.size*tc.size), odm.Max)
+
+		// All values are used exactly once
+		seen := make(map[uint]bool)
+		for _, row := range odm.Matrix {
+			assert.Equal(t, tc.size, len(row))
+			for _, v := range row {
+				seen[v] = true
+			}
+		}
+		assert.Equal(t, int(odm.Max), len(seen))
+	}
+
+	// Like ClusteredDot6x6, the dark pixels form a single dot at every level
+	for _, odm := range []OrderedDitherMatrix{ClusteredDot6x6, GenerateClusteredDot(6, false)} {
+		for k := uint(1); k <= odm.Max; k++ {
+			assert.Equal(t, 1, clusters(odm, k), "%v at %d", odm, k)
+		}
+	}
+
+	// Like ClusteredDotDiagonal8x8, there are two dark dots until 50% gray,
+	// when they fill the top left and bottom right squares
+	for _, odm := range []OrderedDitherMatrix{ClusteredDotDiagonal8x8, GenerateClusteredDot(8, true)} {
+		for k := uint(2); k <= odm.Max/2; k++ {
+			assert.Equal(t, 2, clusters(odm, k), "%v at %d", odm, k)
+		}
+		for y, row := range odm.Matrix {
+			for x, v := range row {
+				assert.Equal(t, (x < 4) == (y < 4), v < odm.Max/2, "%v at (%d, %d)", odm, x, y)
+			}
+		}
+	}
+
+	d := NewDitherer(blackWhite)
+	d.Mapper = PixelMapperFromMatrix(GenerateClusteredDot(6, false), 1.0)
+	ditherAndCompareImage(gradient, "clustered_dot_generated_6.png", d, t)
+	d.Mapper = PixelMapperFromMatrix(GenerateClusteredDot(12, true), 1.0)
+	ditherAndCompareImage(gradient, "clustered_dot_generated_diagonal_12.png", d, t)
+
+	assert.Panics(t, func() { GenerateClusteredDot(0, false) })
+	assert.Panics(t, func() { GenerateClusteredDot(5, true) })
+}
+
+func TestAlpha(t *testing.T) {
+	d := NewDitherer([]color.Color{
+		color.Black,
+		color.White,
+		color.RGBA{255, 0, 0, 255},
+		color.RGBA{0, 255, 0, 255},
+		color.RGBA{0, 0, 255, 255},
+	})
+	d.Mapper = Bayer(4, 4, 1)
+
+	ditherAndCompareImage(dice, "alpha_bayer.png", d, t)
+
+	d.Mapper = nil
+	d.Matrix = FloydSteinberg
+
+	ditherAndCompareImage(dice, "alpha_floyd-steinberg.png", d, t)
+}
+
+func TestAlphaLevels(t *testing.T) {
+	d := NewDitherer([]color.Color{
+		color.Black,
+		color.White,
+		color.RGBA{255, 0, 0, 255},
+		color.RGBA{0, 255, 0, 255},
+		color.RGBA{0, 0, 255, 255},
+	})
+	d.AlphaLevels = []uint8{255, 0}
+
+	checkAlpha := func(img image.Image) {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				_, _, _, a := img.At(x, y).RGBA()
+				if a != 0 && a != 0xffff {
+					t.Fatalf("pixel at (%d, %d) has alpha %d", x, y, a)
+				}
+			}
+		}
+	}
+
+	d.Mapper = Bayer(4, 4, 1)
+	ditherAndCompareImage(dice, "alpha_levels_bayer.png", d, t)
+	checkAlpha(d.DitherCopy(loadImage(dice, t)))
+
+	d.Mapper = nil
+	d.Matrix = FloydSteinberg
+	ditherAndCompareImage(dice, "alpha_levels_floyd-steinberg.png", d, t)
+	checkAlpha(d.DitherCopy(loadImage(dice, t)))
+}
+
+func TestBackground(t *testing.T) {
+	// sRGB 188 is about 50% gray in linear RGB
+	gray := color.Gray{188}
+	d := NewDitherer([]color.Color{color.Black, color.White, gray})
+	d.Background = color.White
+
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0, 0, 0, 0})
+	// Half transparent black over white is 50% gray, but only when it's
+	// composited in linear RGB
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 0, 128})
+	img.SetNRGBA(2, 0, color.NRGBA{0, 0, 0, 255})
+
+	out := d.DitherCopy(img)
+	assert.True(t, sameColor(color.White, out.At(0, 0)))
+	assert.True(t, sameColor(gray, out.At(1, 0)))
+	assert.True(t, sameColor(color.Black, out.At(2, 0)))
+
+	// Same with Matrix, and the transparent palette color isn't used
+	d = NewDitherer([]color.Color{color.Transparent, color.Black, color.White, gray})
+	d.Background = color.White
+	d.Matrix = FloydSteinberg
+	out = d.DitherCopy(img)
+	assert.True(t, sameColor(color.White, out.At(0, 0)))
+	assert.True(t, sameColor(gray, out.At(1, 0)))
+
+	d.Background = color.Transparent
+	assert.Panics(t, func() { d.Dither(img) })
+}
+
+func TestDitherPalettedTransparent(t *testing.T) {
+	src := loadImage(dice, t)
+	palette := []color.Color{
+		color.Black,
+		color.Transparent,
+		color.White,
+		color.RGBA{255, 0, 0, 255},
+		color.RGBA{0, 255, 0, 255},
+		color.RGBA{0, 0, 255, 255},
+	}
+	d := NewDitherer(palette)
+	d.AlphaLevels = []uint8{0, 255}
+
+	for _, setup := range []func(){
+		func() { d.Mapper, d.Matrix = Bayer(4, 4, 1), nil },
+		func() { d.Mapper, d.Matrix = nil, FloydSteinberg },
+	} {
+		setup()
+		pi := d.DitherPaletted(src)
+		b := src.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				_, _, _, a := src.At(x, y).RGBA()
+				if a == 0 && pi.ColorIndexAt(x, y) != 1 {
+					t.Fatalf("transparent pixel at (%d, %d) has index %d", x, y, pi.ColorIndexAt(x, y))
+				}
+				if a == 0xffff && pi.ColorIndexAt(x, y) == 1 {
+					t.Fatalf("opaque pixel at (%d, %d) is transparent", x, y)
+				}
+			}
+		}
+	}
+
+	assert.Nil(t, NewDitherer([]color.Color{color.Transparent}))
+}
+
+func TestDitherPalettedTransparentExtra(t *testing.T) {
+	// Opaque near-black pixel
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 10
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+
+	// The second transparent color is ignored, and isn't treated as black
+	palette := []color.Color{
+		color.Transparent,
+		color.White,
+		color.RGBA{255, 0, 0, 255},
+		color.RGBA{0, 0, 0, 0},
+	}
+	rand.Seed(1)
+	for _, p := range [][]color.Color{palette, append(append([]color.Color(nil), palette...), randomPalette(28)...)} {
+		for _, setup := range []func(d *Ditherer){
+			func(d *Ditherer) {},
+			func(d *Ditherer) { d.LuminanceWeighting = false },
+			func(d *Ditherer) {
+				d.PaletteWeights = make([]float32, len(p))
+				for i := range d.PaletteWeights {
+					d.PaletteWeights[i] = 1
+				}
+			},
+			func(d *Ditherer) { d.ColorSpace = ColorSpaceOklab },
+			func(d *Ditherer) { d.PreserveExtremes = true },
+			func(d *Ditherer) { d.UseCache = true },
+			func(d *Ditherer) { d.Special = SoftNearest },
+			func(d *Ditherer) { d.Matrix = FloydSteinberg },
+			func(d *Ditherer) { d.PaletteSelector = func(x, y int) []int { return []int{1, 3} } },
+		} {
+			d := NewDitherer(p)
+			d.Mapper = Bayer(2, 2, 0)
+			setup(d)
+			if d.Special != 0 || d.Matrix != nil {
+				d.Mapper = nil
+			}
+			pi := d.DitherPaletted(img)
+			for i, ci := range pi.Pix {
+				if ci == 0 || ci == 3 {
+					t.Fatalf("palette of %d colors: opaque pixel %d uses transparent color %d", len(p), i, ci)
+				}
+			}
+		}
+	}
+}
+
+func TestMedianCut(t *testing.T) {
+	img := loadImage(peppers, t)
+	for _, n := range []int{1, 2, 5, 16, 256} {
+		p := MedianCut(img, n)
+		if len(p) == 0 || len(p) > n {
+			t.Errorf("MedianCut with n=%d returned %d colors", n, len(p))
+		}
+	}
+
+	// Fewer colors than requested
+	img2 := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img2.Set(0, 0, color.White)
+	img2.Set(1, 0, color.Black)
+	img2.Set(2, 0, color.NRGBA{255, 0, 0, 0}) // Transparent, so ignored
+	p := MedianCut(img2, 16)
+	assert.Equal(t, 2, len(p))
+
+	assert.Nil(t, MedianCut(image.NewNRGBA(image.Rect(0, 0, 4, 4)), 16))
+	assert.Nil(t, MedianCut(img, 0))
+}
+
+func TestKMeansPalette(t *testing.T) {
+	img := loadImage(peppers, t)
+	p := KMeansPalette(img, 8, 10, 1)
+	assert.Equal(t, 8, len(p))
+	// Deterministic
+	assert.Equal(t, p, KMeansPalette(img, 8, 10, 1))
+
+	img2 := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img2.Set(0, 0, color.White)
+	img2.Set(1, 0, color.Black)
+	img2.Set(2, 0, color.NRGBA{255, 0, 0, 0}) // Transparent, so ignored
+	assert.Equal(t, 2, len(KMeansPalette(img2, 16, 10, 1)))
+
+	assert.Nil(t, KMeansPalette(image.NewNRGBA(image.Rect(0, 0, 4, 4)), 16, 10, 1))
+	assert.Nil(t, KMeansPalette(img, 0, 10, 1))
+}
+
+func TestDedupePalette(t *testing.T) {
+	p := []color.Color{
+		color.Black,
+		color.RGBA{255, 0, 0, 255},
+		color.Gray16{0},            // Same as black
+		color.RGBA{254, 0, 0, 255}, // Close to red
+		color.Transparent,
+		color.NRGBA{255, 255, 255, 0}, // Also transparent
+		color.White,
+	}
+	assert.Equal(t, []color.Color{
+		color.Black,
+		color.RGBA{255, 0, 0, 255},
+		color.RGBA{254, 0, 0, 255},
+		color.Transparent,
+		color.White,
+	}, DedupePalette(p, 0))
+	assert.Equal(t, []color.Color{
+		color.Black,
+		color.RGBA{255, 0, 0, 255},
+		color.Transparent,
+		color.White,
+	}, DedupePalette(p, 1000*1000/4))
+
+	// Everything is within the tolerance of black
+	assert.Equal(t, []color.Color{color.Black, color.Transparent}, DedupePalette(p, math.MaxUint32))
+
+	assert.Empty(t, DedupePalette(nil, 0))
+}
+
+func TestSortPaletteByLuminance(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	p := []color.Color{color.White, green, color.Transparent, blue, color.Black, red}
+	assert.Equal(t,
+		[]color.Color{color.Transparent, color.Black, blue, red, green, color.White},
+		SortPaletteByLuminance(p),
+	)
+	// Not changed
+	assert.Equal(t, color.White, p[0])
+	assert.Empty(t, SortPaletteByLuminance(nil))
+}
+
+func TestSortPaletteByHue(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	yellow := color.RGBA{255, 255, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	gray := color.Gray{128}
+	p := []color.Color{blue, color.White, green, red, color.Transparent, yellow, color.Black, gray}
+	assert.Equal(t,
+		[]color.Color{color.Transparent, color.Black, gray, color.White, red, yellow, green, blue},
+		SortPaletteByHue(p),
+	)
+	assert.Empty(t, SortPaletteByHue(nil))
+}
+
+func TestGrayPalette(t *testing.T) {
+	p := GrayPalette(5)
+	assert.Equal(t, 5, len(p))
+	assert.Equal(t, color.Gray16{0}, p[0])
+	assert.Equal(t, color.Gray16{65535}, p[4])
+	// Evenly spaced in linear light
+	for i, c := range p {
+		r, _, _ := SRGBToLinear(c)
+		assert.InDelta(t, i*65535/4, int(r), 2)
+	}
+	assert.Equal(t, []color.Color{color.Gray16{0}, color.Gray16{65535}}, GrayPalette(2))
+	assert.Panics(t, func() { GrayPalette(1) })
+
+	// The palette is gray, so the fast search is used
+	assert.NotNil(t, NewDitherer(GrayPalette(16)).grayLevels)
+}
+
+func TestPopularityPalette(t *testing.T) {
+	img := loadImage(peppers, t)
+	assert.Equal(t, 16, len(PopularityPalette(img, 16, 5)))
+
+	img2 := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			img2.Set(x, y, color.White)
+		}
+	}
+	img2.Set(0, 0, color.Black)
+	img2.Set(1, 0, color.Black)
+	img2.Set(2, 0, color.RGBA{254, 0, 0, 255})
+	img2.Set(3, 0, color.RGBA{255, 1, 0, 255}) // Same bucket as the above
+	img2.Set(0, 1, color.NRGBA{0, 0, 255, 0})  // Transparent, so ignored
+	p := PopularityPalette(img2, 16, 5)
+	assert.Equal(t, 3, len(p))
+	assert.Equal(t, color.RGBA{255, 255, 255, 255}, p[0])
+	assert.Equal(t, color.RGBA{0, 0, 0, 255}, p[1])
+	// Average of the two reds
+	assert.Equal(t, color.RGBA{255, 1, 0, 255}, p[2])
+	assert.Equal(t, p[:2], PopularityPalette(img2, 2, 5))
+
+	assert.Nil(t, PopularityPalette(image.NewNRGBA(image.Rect(0, 0, 4, 4)), 16, 5))
+	assert.Nil(t, PopularityPalette(img, 0, 5))
+	assert.Panics(t, func() { PopularityPalette(img, 16, 0) })
+	assert.Panics(t, func() { PopularityPalette(img, 16, 9) })
+}
+
+func TestEncode(t *testing.T) {
+	img := loadImage(gradient, t)
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+
+	var buf bytes.Buffer
+	if err := d.Encode(&buf, img, "PNG"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := out.(*image.Paletted); !ok {
+		t.Errorf("PNG wasn't paletted, got %T", out)
+	}
+	assert.Equal(t, d.DitherPaletted(img).Pix, out.(*image.Paletted).Pix)
+
+	buf.Reset()
+	if err := d.Encode(&buf, img, "gif"); err != nil {
+		t.Fatal(err)
+	}
+	out, err = gif.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, d.DitherPaletted(img).Pix, out.(*image.Paletted).Pix)
+
+	buf.Reset()
+	if err := d.Encode(&buf, img, "jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jpeg.Decode(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, d.Encode(&buf, img, "bmp"))
+	d = NewDitherer(randomPalette(300))
+	d.Matrix = FloydSteinberg
+	assert.Error(t, d.Encode(&buf, img, "gif"))
+}
+
+func TestDitherFrames(t *testing.T) {
+	img := copyOfImage(loadImage(peppers, t))
+	frames := []image.Image{
+		img.SubImage(image.Rect(0, 0, 100, 100)),
+		img.SubImage(image.Rect(50, 50, 150, 120)),
+		loadImage(gradient, t),
+	}
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+
+	g := d.DitherFrames(frames, []int{10, 20, 30})
+	assert.Equal(t, []int{10, 20, 30}, g.Delay)
+	assert.Equal(t, color.Palette(d.GetPalette()), g.Config.ColorModel)
+	// Big enough for all the frames
+	assert.Equal(t, frames[2].Bounds().Dx(), g.Config.Width)
+	assert.Equal(t, 120, g.Config.Height)
+	for i := range frames {
+		assert.Equal(t, d.DitherPaletted(frames[i]).Pix, g.Image[i].Pix)
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, gif.EncodeAll(&buf, g))
+	g2, err := gif.DecodeAll(&buf)
+	assert.NoError(t, err)
+	assert.Len(t, g2.Image, 3)
+	assert.Len(t, g2.Config.ColorModel, 4)
+
+	assert.Equal(t, []int{0, 0, 0}, d.DitherFrames(frames, nil).Delay)
+	assert.Panics(t, func() { d.DitherFrames(frames, []int{1}) })
+}
+
+func TestEncodeWebP(t *testing.T) {
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	img := d.DitherPaletted(loadImage(peppers, t))
+
+	var buf bytes.Buffer
+	if err := EncodeWebP(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	assert.Equal(t, "RIFF", string(b[0:4]))
+	assert.Equal(t, uint32(len(b)-8), binary.LittleEndian.Uint32(b[4:]))
+	assert.Equal(t, "WEBPVP8L", string(b[8:16]))
+	assert.Equal(t, byte(0x2f), b[20])
+	// Width and height minus one, in 14 bits each
+	dims := binary.LittleEndian.Uint32(b[21:])
+	assert.Equal(t, uint32(img.Bounds().Dx()-1), dims&(1<<14-1))
+	assert.Equal(t, uint32(img.Bounds().Dy()-1), (dims>>14)&(1<<14-1))
+
+	var buf2 bytes.Buffer
+	if err := d.Encode(&buf2, loadImage(peppers, t), "webp"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, b, buf2.Bytes())
+
+	assert.Error(t, EncodeWebP(&buf, image.NewPaletted(image.Rect(0, 0, 0, 0), blackWhite)))
+	assert.Error(t, EncodeWebP(&buf, image.NewPaletted(image.Rect(0, 0, 4, 4), nil)))
+}
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 3, 16, 17, 256} {
+		pal := make(color.Palette, n)
+		for i := range pal {
+			c := color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255}
+			if i%5 == 1 {
+				c.A = uint8(rng.Intn(256))
+			}
+			pal[i] = c
+		}
+		for _, w := range []int{1, 3, 7, 13, 33, 100} {
+			for _, skewed := range []bool{false, true} {
+				img := image.NewPaletted(image.Rect(0, 0, w+5, 11), pal)
+				for i := range img.Pix {
+					if skewed {
+						// Very uneven counts, for long prefix codes
+						j := 0
+						for j < n-1 && rng.Intn(3) != 0 {
+							j++
+						}
+						img.Pix[i] = uint8(j)
+					} else {
+						img.Pix[i] = uint8(rng.Intn(n))
+					}
+				}
+				// Bounds that don't start at zero, and a stride that isn't
+				// the width
+				sub := img.SubImage(image.Rect(3, 2, 3+w, 11)).(*image.Paletted)
+
+				var buf bytes.Buffer
+				if err := EncodeWebP(&buf, sub); err != nil {
+					t.Fatal(err)
+				}
+				webpRoundTrip(t, &buf, sub)
+			}
+		}
+	}
+
+	// Fibonacci counts make the optimal prefix code deeper than the 15 bits
+	// WebP allows, so the lengths have to be limited
+	pal := make(color.Palette, 256)
+	for i := range pal {
+		pal[i] = color.Gray{uint8(i)}
+	}
+	var pix []uint8
+	a, b := 1, 1
+	for i := 0; i < 24; i++ {
+		for j := 0; j < a; j++ {
+			pix = append(pix, uint8(i))
+		}
+		a, b = b, a+b
+	}
+	rng.Shuffle(len(pix), func(i, j int) { pix[i], pix[j] = pix[j], pix[i] })
+	img := image.NewPaletted(image.Rect(0, 0, 401, len(pix)/401), pal)
+	copy(img.Pix, pix)
+	var buf bytes.Buffer
+	if err := EncodeWebP(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	webpRoundTrip(t, &buf, img)
+}
+
+// webpRoundTrip decodes the WebP image in r, and checks that it's the same as
+// img.
+func webpRoundTrip(t *testing.T, r io.Reader, img *image.Paletted) {
+	t.Helper()
+	desc := fmt.Sprintf("%d colors, bounds %v", len(img.Palette), img.Bounds())
+	dec, err := webp.Decode(r)
+	if err != nil {
+		t.Fatalf("%s: %v", desc, err)
+	}
+	b, db := img.Bounds(), dec.Bounds()
+	if db.Dx() != b.Dx() || db.Dy() != b.Dy() {
+		t.Fatalf("%s: decoded bounds are %v", desc, db)
+	}
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			want := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y))
+			got := color.NRGBAModel.Convert(dec.At(db.Min.X+x, db.Min.Y+y))
+			if want != got {
+				t.Fatalf("%s: pixel (%d, %d) is %v, not %v", desc, x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	d.Transfer = TransferGamma22
+	ditherAndCompareImage(gradient, "transfer_gamma22_floyd-steinberg.png", d, t)
+
+	// The Ditherer isn't changed
+	assert.Equal(t, NewDitherer(blackWhite).linearPalette, d.linearPalette)
+
+	// Linear input isn't darkened, so it has more white pixels
+	countWhite := func(img image.Image) int {
+		n := 0
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if r, _, _, _ := img.At(x, y).RGBA(); r == 0xffff {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	img := loadImage(gradient, t)
+	d.Transfer = TransferSRGB
+	srgb := countWhite(d.DitherCopy(img))
+	d.Transfer = TransferLinear
+	linear := countWhite(d.DitherCopy(img))
+	if linear <= srgb {
+		t.Errorf("TransferLinear has %d white pixels, TransferSRGB has %d", linear, srgb)
+	}
+
+	d.Transfer = numTransfers
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestLinearRGB(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	assert.True(t, d.LinearRGB)
+	d.Matrix = FloydSteinberg
+	d.LinearRGB = false
+	d.Transfer = TransferRec709 // Ignored
+	ditherAndCompareImage(gradient, "floyd-steinberg_non-linear.png", d, t)
+
+	img := loadImage(gradient, t)
+	d2 := NewDitherer(blackWhite)
+	d2.Matrix = FloydSteinberg
+	d2.Transfer = TransferLinear
+	assert.Equal(t, d2.DitherCopy(img), d.DitherCopy(img))
+}
+
+func TestDitherPalettedLarge(t *testing.T) {
+	img := loadImage(peppers, t)
+
+	d := NewDitherer(randomPalette(1000))
+	d.Matrix = FloydSteinberg
+	p := d.DitherPalettedLarge(img)
+	rgba := d.DitherCopy(img)
+	assert.Equal(t, rgba.Bounds(), p.Bounds())
+	b := p.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if color.RGBAModel.Convert(p.At(x, y)) != rgba.At(x, y) {
+				t.Fatalf("pixel at (%d, %d) is %v, expected %v", x, y, p.At(x, y), rgba.At(x, y))
+			}
+		}
+	}
+
+	// Same indexes as DitherPaletted
+	d = NewDitherer(redGreenYellowBlack)
+	d.Mapper = Bayer(4, 4, 1)
+	p = d.DitherPalettedLarge(img)
+	for i, idx := range d.DitherPaletted(img).Pix {
+		if uint16(idx) != p.Pix[i] {
+			t.Fatalf("index %d is %d, expected %d", i, p.Pix[i], idx)
+		}
+	}
+
+	sub := p.SubImage(image.Rect(10, 20, 30, 40)).(*PalettedLarge)
+	assert.Equal(t, p.ColorIndexAt(10, 20), sub.ColorIndexAt(10, 20))
+	sub.SetColorIndex(10, 20, 3)
+	assert.Equal(t, uint16(3), p.ColorIndexAt(10, 20))
+	assert.Equal(t, color.Gray{0}, color.GrayModel.Convert(p.At(10, 20)))
+}
+
+func TestChannelStrength(t *testing.T) {
+	d := NewDitherer(redGreenYellowBlack)
+	assert.Equal(t, [3]float32{1, 1, 1}, d.ChannelStrength)
+	d.Matrix = FloydSteinberg
+	d.ChannelStrength = [3]float32{1, 0.5, 1}
+	ditherAndCompareImage(peppers, "floyd-steinberg_channel_strength_red-green-yellow-black.png", d, t)
+}
+
+func TestNormalizeMatrix(t *testing.T) {
+	img := loadImage(gradient, t)
+
+	d := NewDitherer(blackWhite)
+	d.Matrix = ErrorDiffusionMatrix{
+		{0, 1},
+		{1, 1},
+	}
+	d.NormalizeMatrix = true
+	d2 := NewDitherer(blackWhite)
+	d2.Matrix = ErrorDiffusionMatrix{
+		{0, 1.0 / 3},
+		{1.0 / 3, 1.0 / 3},
+	}
+	assert.Equal(t, d2.DitherCopy(img), d.DitherCopy(img))
+
+	// Already normalized matrices aren't changed
+	d.Matrix = FloydSteinberg
+	d2.Matrix = FloydSteinberg
+	assert.Equal(t, d2.DitherCopy(img), d.DitherCopy(img))
+
+	d.Matrix = ErrorDiffusionMatrix{
+		{0, 1},
+		{-1, 0},
+	}
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestRandomNoiseSeeded(t *testing.T) {
+	img := loadImage(peppers, t)
+
+	d := NewDitherer(blackWhite)
+	d.SingleThreaded = true
+	d.Mapper = RandomNoiseGrayscaleSeeded(-0.5, 0.5, rand.New(rand.NewSource(1)))
+	out := d.DitherCopy(img)
+	d.Mapper = RandomNoiseGrayscaleSeeded(-0.5, 0.5, rand.New(rand.NewSource(1)))
+	assert.Equal(t, out, d.DitherCopy(img))
+
+	d = NewDitherer(redGreenYellowBlack)
+	d.SingleThreaded = true
+	d.Mapper = RandomNoiseRGBSeeded(-0.5, 0.5, -0.5, 0.5, -0.5, 0.5, rand.New(rand.NewSource(1)))
+	out = d.DitherCopy(img)
+	d.Mapper = RandomNoiseRGBSeeded(-0.5, 0.5, -0.5, 0.5, -0.5, 0.5, rand.New(rand.NewSource(1)))
+	assert.Equal(t, out, d.DitherCopy(img))
+
+	// Safe to use concurrently
+	d.SingleThreaded = false
+	d.DitherCopy(img)
+}
+
+func TestRandomNoiseParallel(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Mapper = RandomNoiseGrayscaleParallel(-0.5, 0.5, 1)
+	ditherAndCompareImage(gradient, "random_noise_grayscale_parallel.png", d, t)
+
+	// Same output with a different number of workers
+	img := loadImage(peppers, t)
+	d = NewDitherer(redGreenYellowBlack)
+	d.Mapper = RandomNoiseRGBParallel(-0.5, 0.5, -0.5, 0.5, -0.5, 0.5, 1)
+	out := d.DitherCopy(img)
+	d.SingleThreaded = true
+	d.Serpentine = true
+	assert.Equal(t, out, d.DitherCopy(img))
+
+	// The noise is evenly distributed
+	var sum float64
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			n := pixelRand(1, x, y, 0)
+			if n < 0 || n >= 1 {
+				t.Fatalf("pixelRand out of range: %f", n)
+			}
+			sum += float64(n)
+		}
+	}
+	if mean := sum / (256 * 256); mean < 0.49 || mean > 0.51 {
+		t.Errorf("pixelRand mean is %f", mean)
+	}
+}
+
+// countingMapper is a StatefulPixelMapper that thresholds colors, and counts
+// how many pixels each state mapped.
+type countingMapper struct {
+	mu     sync.Mutex
+	counts []*int
+}
+
+func (m *countingMapper) NewState() interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := new(int)
+	m.counts = append(m.counts, n)
+	return n
+}
+
+func (m *countingMapper) Map(state interface{}, x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+	*state.(*int)++
+	return Threshold(0.5)(x, y, r, g, b)
+}
+
+func TestStatefulMapper(t *testing.T) {
+	img := loadImage(peppers, t)
+
+	d := NewDitherer(redGreenYellowBlack)
+	d.Mapper = Threshold(0.5)
+	expected := d.DitherCopy(img)
+
+	for _, single := range []bool{true, false} {
+		m := &countingMapper{}
+		d.Mapper = nil
+		d.StatefulMapper = m
+		d.SingleThreaded = single
+		assert.Equal(t, expected, d.DitherCopy(img))
+
+		total := 0
+		for _, n := range m.counts {
+			total += *n
+		}
+		assert.Equal(t, img.Bounds().Dx()*img.Bounds().Dy(), total)
+		if single {
+			assert.Equal(t, 1, len(m.counts))
+		}
+	}
+
+	// Can't be set with Mapper
+	d.Mapper = Threshold(0.5)
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestDitherWithScratch(t *testing.T) {
+	img := loadImage(dice, t)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	d.AlphaLevels = []uint8{0, 255}
+	expected := d.DitherCopy(img)
+
+	var s Scratch
+	assert.Equal(t, expected, d.DitherWithScratch(copyOfImage(img), &s))
+	// Smaller image, and the buffers are still there
+	small := copyOfImage(img).SubImage(image.Rect(10, 10, 50, 50))
+	d.DitherWithScratch(small, &s)
+	assert.NotNil(t, s.lins)
+	assert.Equal(t, expected, d.DitherWithScratch(copyOfImage(img), &s))
+
+	// Reusing the buffers means fewer allocations
+	src := copyOfImage(img)
+	withScratch := testing.AllocsPerRun(3, func() { d.DitherWithScratch(src, &s) })
+	without := testing.AllocsPerRun(3, func() { d.Dither(src) })
+	if withScratch >= without {
+		t.Errorf("%f allocations with Scratch, %f without", withScratch, without)
+	}
+
+	// Concurrent use still works
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(t, expected, d.DitherWithScratch(copyOfImage(img), &s))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestScratchPool(t *testing.T) {
+	img := loadImage(peppers, t)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	expected := d.DitherCopy(img)
+
+	var p ScratchPool
+	s := p.Get()
+	assert.NotNil(t, s)
+	p.Put(s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				assert.Equal(t, expected, p.Dither(d, copyOfImage(img)))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDitherRegion(t *testing.T) {
+	img := loadImage(peppers, t)
+	r := image.Rect(100, 150, 300, 250)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+
+	expected := copyOfImage(img)
+	d.Dither(expected.SubImage(r).(draw.Image))
+
+	dst := copyOfImage(img)
+	d.DitherRegion(dst, r)
+	assert.Equal(t, expected, dst)
+
+	// Images without SubImage
+	dst = copyOfImage(img)
+	d.DitherRegion(struct{ draw.Image }{dst}, r)
+	assert.Equal(t, expected, dst)
+
+	// Outside of the image
+	dst = copyOfImage(img)
+	d.DitherRegion(dst, image.Rect(1000, 1000, 1100, 1100))
+	assert.Equal(t, copyOfImage(img), dst)
+
+	assert.Panics(t, func() {
+		d.DitherRegion(image.NewPaletted(r, blackWhite), r)
+	})
+}
+
+func TestDitherRegionCarry(t *testing.T) {
+	img := loadImage(peppers, t)
+	b := img.Bounds()
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+
+	// Strips as wide as the image give the same result as the whole image
+	expected := d.Dither(copyOfImage(img))
+	dst := copyOfImage(img)
+	var carry ErrorCarry
+	for y := b.Min.Y; y < b.Max.Y; y += 50 {
+		d.DitherRegionCarry(dst, image.Rect(b.Min.X, y, b.Max.X, y+50), &carry)
+	}
+	assert.Equal(t, expected, dst)
+	assert.Empty(t, carry.errs)
+
+	// Error is carried between tiles, unlike with DitherRegion
+	tiled := func(carry *ErrorCarry) draw.Image {
+		dst := copyOfImage(img)
+		for y := b.Min.Y; y < b.Max.Y; y += 64 {
+			for x := b.Min.X; x < b.Max.X; x += 64 {
+				r := image.Rect(x, y, x+64, y+64)
+				if carry == nil {
+					d.DitherRegion(dst, r)
+				} else {
+					d.DitherRegionCarry(dst, r, carry)
+				}
+			}
+		}
+		return dst
+	}
+	assert.NotEqual(t, tiled(nil), tiled(&ErrorCarry{}))
+}
+
+func TestApplyErrorDiffusion(t *testing.T) {
+	img := loadImage(peppers, t)
+	b := img.Bounds()
+	// Floyd-Steinberg with a padding row on top
+	padded := ErrorDiffusionKernel{
+		Matrix: ErrorDiffusionMatrix{
+			{0, 0, 0},
+			{0, 0, 7.0 / 16},
+			{3.0 / 16, 5.0 / 16, 1.0 / 16},
+		},
+		OriginX: 1,
+		OriginY: 1,
+	}
+	jjn := ErrorDiffusionKernel{Matrix: JarvisJudiceNinke, OriginX: JarvisJudiceNinke.CurrentPixel()}
+	for _, tt := range []struct {
+		k     ErrorDiffusionKernel
+		order ScanOrder
+	}{
+		{jjn, RasterHorizontal},
+		{jjn, SerpentineHorizontal},
+		{padded, RasterHorizontal},
+		{padded, RasterVertical},
+		{padded, SerpentineVertical},
+		{jjn, SerpentineVertical},
+		{jjn, Diagonal},
+	} {
+		d := NewDitherer(redGreenYellowBlack)
+		d.SetKernel(tt.k)
+		d.ScanOrder = tt.order
+		expected := d.DitherCopy(img)
+
+		pix := make([][3]uint16, b.Dx()*b.Dy())
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl := toLinearRGB(img.At(x, y), TransferSRGB)
+				pix[(y-b.Min.Y)*b.Dx()+(x-b.Min.X)] = [3]uint16{r, g, bl}
+			}
+		}
+		err := ApplyErrorDiffusion(pix, b.Dx(), tt.k, tt.order, func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+			c := d.linearPalette[d.closestColor(r, g, b)]
+			return c[0], c[1], c[2]
+		})
+		assert.NoError(t, err)
+
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := pix[(y-b.Min.Y)*b.Dx()+(x-b.Min.X)]
+				r, g, bl := toLinearRGB(expected.At(x, y), TransferSRGB)
+				if c != [3]uint16{r, g, bl} {
+					t.Fatalf("order %d, origin %d, %d: pixel (%d, %d) is %v, not %v",
+						tt.order, tt.k.OriginX, tt.k.OriginY, x, y, c, [3]uint16{r, g, bl})
+				}
+			}
+		}
+	}
+
+	quantize := func(x, y int, r, g, b uint16) (uint16, uint16, uint16) { return r, g, b }
+	k := ErrorDiffusionKernel{Matrix: FloydSteinberg, OriginX: 1}
+	assert.Error(t, ApplyErrorDiffusion(make([][3]uint16, 10), 3, k, RasterHorizontal, quantize))
+	assert.Error(t, ApplyErrorDiffusion(make([][3]uint16, 10), 0, k, RasterHorizontal, quantize))
+	assert.Error(t, ApplyErrorDiffusion(make([][3]uint16, 10), 5, k, Diagonal+1, quantize))
+	k.OriginX = 2
+	assert.Error(t, ApplyErrorDiffusion(make([][3]uint16, 10), 5, k, RasterHorizontal, quantize))
+}
+
+func TestDitherWithStats(t *testing.T) {
+	img := loadImage(peppers, t)
+	orig := copyOfImage(img)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+
+	dst, stats := d.DitherWithStats(img)
+	assert.Equal(t, orig, img)
+	assert.Equal(t, d.DitherCopy(img), dst)
+
+	b := img.Bounds()
+	assert.Equal(t, b.Dx()*b.Dy(), stats.Pixels)
+	total := 0
+	for _, n := range stats.ColorCounts {
+		assert.NotZero(t, n)
+		total += n
+	}
+	assert.Equal(t, stats.Pixels, total)
+
+	assert.InDelta(t, stats.SquaredError/float64(stats.Pixels*3), stats.MeanSquaredError, 1e-12)
+	assert.InDelta(t, stats.LinearSquaredError/float64(stats.Pixels*3), stats.LinearMeanSquaredError, 1e-12)
+	assert.InDelta(t, -10*math.Log10(stats.MeanSquaredError), stats.PSNR, 1e-9)
+	assert.Greater(t, stats.PSNR, 0.0)
+
+	// Dithering an image that's already dithered changes nothing
+	_, stats = d.DitherWithStats(dst)
+	assert.Zero(t, stats.SquaredError)
+	assert.Zero(t, stats.LinearSquaredError)
+	assert.True(t, math.IsInf(stats.PSNR, 1))
+}
+
+func TestPreview(t *testing.T) {
+	img := loadImage(peppers, t)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+
+	quantized := NewDitherer(redGreenYellowBlack)
+	expected, stats := quantized.DitherWithStats(img)
+	dst, score := d.Preview(img)
+	assert.Equal(t, expected, dst)
+	assert.InDelta(t, math.Sqrt(stats.MeanSquaredError), score, 1e-12)
+	assert.NotNil(t, d.Matrix)
+
+	// A palette with more colors fits better
+	d = NewDitherer(append(redGreenYellowBlack, color.White, color.RGBA{0, 0, 255, 255}))
+	_, better := d.Preview(img)
+	assert.Less(t, better, score)
+
+	// Already quantized
+	_, score = d.Preview(dst)
+	assert.Zero(t, score)
+}
+
+func TestDitherPalettedCount(t *testing.T) {
+	img := loadImage(peppers, t)
+	d := NewDitherer(append(redGreenYellowBlack, color.RGBA{0, 0, 255, 255}))
+	d.Matrix = FloydSteinberg
+
+	p, counts := d.DitherPalettedCount(img)
+	assert.Equal(t, d.DitherPaletted(img), p)
+	assert.Len(t, counts, 5)
+
+	expected := make([]int, 5)
+	b := p.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			expected[p.ColorIndexAt(x, y)]++
+		}
+	}
+	assert.Equal(t, expected, counts)
+}
+
+func TestDitherDiff(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	img := image.NewGray(image.Rect(10, 10, 42, 42))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{100}), image.Point{}, draw.Src)
+
+	// Everything changes without a previous frame
+	p, changed := d.DitherDiff(nil, img)
+	assert.Equal(t, d.DitherPaletted(img), p)
+	assert.Len(t, changed, 32*32)
+	assert.Equal(t, image.Point{10, 10}, changed[0])
+
+	// Nothing changes for the same frame
+	_, changed = d.DitherDiff(p, img)
+	assert.Empty(t, changed)
+
+	// Only the pixels in the changed area
+	img2 := image.NewGray(img.Bounds())
+	copy(img2.Pix, img.Pix)
+	area := image.Rect(20, 20, 30, 30)
+	draw.Draw(img2, area, image.NewUniform(color.White), image.Point{}, draw.Src)
+	p2, changed := d.DitherDiff(p, img2)
+	assert.NotEmpty(t, changed)
+	n := 0
+	b := p2.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if p.ColorIndexAt(x, y) != p2.ColorIndexAt(x, y) {
+				assert.Equal(t, image.Point{x, y}, changed[n])
+				n++
+			}
+		}
+	}
+	assert.Len(t, changed, n)
+
+	assert.Panics(t, func() { d.DitherDiff(p, image.NewGray(image.Rect(0, 0, 32, 32))) })
+}
+
+func TestDitherStable(t *testing.T) {
+	palette := []color.Color{color.Black, color.Gray{85}, color.Gray{170}, color.White}
+	frame := func(shift uint8) *image.Gray {
+		img := image.NewGray(image.Rect(0, 0, 64, 64))
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				img.SetGray(x, y, color.Gray{uint8(x*3) + shift})
+			}
+		}
+		return img
+	}
+	countChanged := func(p1, p2 *image.Paletted) int {
+		n := 0
+		for i := range p1.Pix {
+			if p1.Pix[i] != p2.Pix[i] {
+				n++
+			}
+		}
+		return n
+	}
+
+	for _, matrix := range []ErrorDiffusionMatrix{nil, FloydSteinberg} {
+		d := NewDitherer(palette)
+		d.Matrix = matrix
+		if matrix == nil {
+			d.Mapper = Bayer(4, 4, 1)
+		}
+		img := frame(0)
+		p := d.DitherPaletted(img)
+
+		assert.Equal(t, p, d.DitherStable(nil, img, 0.05))
+		assert.Equal(t, p, d.DitherStable(p, img, 0.05))
+
+		// A slightly brighter frame changes fewer pixels
+		img2 := frame(2)
+		changed := countChanged(p, d.DitherPaletted(img2))
+		stableChanged := countChanged(p, d.DitherStable(p, img2, 0.05))
+		assert.NotZero(t, changed)
+		assert.Less(t, stableChanged, changed)
+
+		assert.Panics(t, func() { d.DitherStable(p, img2, -1) })
+		assert.Panics(t, func() { d.DitherStable(p, image.NewGray(image.Rect(0, 0, 32, 32)), 0.05) })
+	}
+}
+
+func TestPaletteWeights(t *testing.T) {
+	img := loadImage(peppers, t)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	_, counts := d.DitherPalettedCount(img)
+
+	// Same as no weights
+	d.PaletteWeights = []float32{1, 1, 1, 1}
+	_, same := d.DitherPalettedCount(img)
+	assert.Equal(t, counts, same)
+
+	// Yellow is preferred
+	d.PaletteWeights = []float32{1, 1, 0.5, 1}
+	_, more := d.DitherPalettedCount(img)
+	assert.Greater(t, more[2], counts[2])
+
+	// Yellow is avoided
+	d.PaletteWeights = []float32{1, 1, 2, 1}
+	_, less := d.DitherPalettedCount(img)
+	assert.Less(t, less[2], counts[2])
+
+	// Mapper too
+	d.Matrix = nil
+	d.Mapper = Bayer(4, 4, 1.0)
+	d.PaletteWeights = nil
+	_, counts = d.DitherPalettedCount(img)
+	d.PaletteWeights = []float32{1, 1, 0.5, 1}
+	_, more = d.DitherPalettedCount(img)
+	assert.Greater(t, more[2], counts[2])
+
+	for _, w := range [][]float32{
+		{1, 1, 1},
+		{1, 1, 0, 1},
+		{1, 1, -1, 1},
+		{1, 1, float32(math.NaN()), 1},
+	} {
+		d.PaletteWeights = w
+		assert.Panics(t, func() { d.Dither(copyOfImage(img)) })
+	}
+}
+
+func TestExactColors(t *testing.T) {
+	img := copyOfImage(loadImage(peppers, t))
+	logo := image.Rect(100, 100, 200, 150)
+	brand := color.RGBA{200, 30, 30, 255}
+	draw.Draw(img, logo, image.NewUniform(brand), image.Point{}, draw.Src)
+
+	for _, mapper := range []bool{false, true} {
+		d := NewDitherer(redGreenYellowBlack)
+		if mapper {
+			d.Mapper = Bayer(4, 4, 1.0)
+		} else {
+			d.Matrix = FloydSteinberg
+		}
+		d.ExactColors = map[color.Color]color.Color{
+			// Color types don't matter
+			color.NRGBA{200, 30, 30, 255}: color.RGBA{255, 0, 0, 255},
+		}
+		dst := d.DitherCopy(img)
+
+		red := color.RGBA{255, 0, 0, 255}
+		for y := logo.Min.Y; y < logo.Max.Y; y++ {
+			for x := logo.Min.X; x < logo.Max.X; x++ {
+				if dst.RGBAAt(x, y) != red {
+					t.Fatalf("mapper %v: pixel at (%d, %d) is %v", mapper, x, y, dst.RGBAAt(x, y))
+				}
+			}
+		}
+
+		// Without it the flat area is dithered
+		d.ExactColors = nil
+		assert.NotEqual(t, dst, d.DitherCopy(img))
+	}
+
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	d.ExactColors = map[color.Color]color.Color{brand: color.White}
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestDitherCopy16(t *testing.T) {
+	palette := []color.Color{
+		color.RGBA64{0x0101, 0x0202, 0x0303, 0xffff},
+		color.RGBA64{0x7ffe, 0x8001, 0x7f7f, 0xffff},
+		color.RGBA64{0xfedc, 0xfffe, 0xfeff, 0xffff},
+	}
+	src := image.NewRGBA64(image.Rect(0, 0, 256, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			v := uint16(x*256 + y*16)
+			src.SetRGBA64(x, y, color.RGBA64{v, v, v, 0xffff})
+		}
+	}
+	orig := image.NewRGBA64(src.Bounds())
+	copy(orig.Pix, src.Pix)
+
+	d := NewDitherer(palette)
+	d.Matrix = FloydSteinberg
+	dst := d.DitherCopy16(src)
+	assert.Equal(t, orig, src)
+	assert.Equal(t, d.Dither(orig), dst)
+
+	// Every pixel is exactly a palette color
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			assert.Contains(t, palette, dst.RGBA64At(x, y))
+		}
+	}
+}
+
+func TestDitherDeepPalette(t *testing.T) {
+	palette := []color.Color{
+		color.RGBA64{0x0101, 0x0202, 0x0303, 0xffff},
+		color.RGBA64{0xfedc, 0xfffe, 0xfeff, 0xffff},
+	}
+	// Not a draw.Image, so it has to be copied
+	src := struct{ image.Image }{loadImage(peppers, t)}
+
+	d := NewDitherer(palette)
+	d.Matrix = FloydSteinberg
+	dst, ok := d.Dither(src).(*image.RGBA64)
+	if !ok {
+		t.Fatal("image isn't *image.RGBA64")
+	}
+	b := dst.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if c := dst.RGBA64At(x, y); c != palette[0] && c != palette[1] {
+				t.Fatalf("pixel at (%d, %d) is %v", x, y, c)
+			}
+		}
+	}
+
+	d.Premultiply = false
+	assert.IsType(t, &image.NRGBA64{}, d.Dither(src))
+
+	// 8-bit palettes still use 8-bit images
+	d = NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	assert.IsType(t, &image.RGBA{}, d.Dither(src))
+}
+
+func TestPaletteSelector(t *testing.T) {
+	img := loadImage(peppers, t)
+	b := img.Bounds()
+	mid := (b.Min.X + b.Max.X) / 2
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	black := color.RGBA{0, 0, 0, 255}
+
+	for _, mapper := range []bool{false, true} {
+		d := NewDitherer(redGreenYellowBlack)
+		if mapper {
+			d.Mapper = Bayer(4, 4, 1.0)
+		} else {
+			d.Matrix = FloydSteinberg
+		}
+		expected := d.DitherCopy(img)
+
+		// Allowing everything is the same as no selector
+		d.PaletteSelector = func(x, y int) []int { return nil }
+		assert.Equal(t, expected, d.DitherCopy(img))
+
+		// Red and black on the left, green and black on the right
+		d.PaletteSelector = func(x, y int) []int {
+			if x < mid {
+				return []int{0, 3}
+			}
+			return []int{1, 3}
+		}
+		dst := d.DitherCopy(img)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := dst.RGBAAt(x, y)
+				if c != black && (x < mid && c != red || x >= mid && c != green) {
+					t.Fatalf("mapper %v: pixel at (%d, %d) is %v", mapper, x, y, c)
+				}
+			}
+		}
+	}
+}
+
+func TestQuantizeOnly(t *testing.T) {
+	img := loadImage(peppers, t)
+	d := NewDitherer(redGreenYellowBlack)
+	dst := d.DitherCopy(img)
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			expected := d.palette[d.closestColor(SRGBToLinear(img.At(x, y)))]
+			if c := color.RGBA64Model.Convert(dst.At(x, y)); c != expected {
+				t.Fatalf("pixel at (%d, %d) is %v, expected %v", x, y, c, expected)
+			}
+		}
+	}
+
+	// Same as a Mapper that doesn't change anything
+	d.Mapper = func(x, y int, r, g, b uint16) (uint16, uint16, uint16) { return r, g, b }
+	assert.Equal(t, dst, d.DitherCopy(img))
+
+	d.Matrix = FloydSteinberg
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestQuantizer(t *testing.T) {
+	img := loadImage(peppers, t)
+	for _, mapper := range []bool{false, true} {
+		d := NewDitherer(redGreenYellowBlack)
+		if mapper {
+			d.Mapper = Bayer(4, 4, 1.0)
+		} else {
+			d.Matrix = FloydSteinberg
+		}
+		d.LuminanceWeighting = false
+		expected := d.DitherCopy(img)
+
+		// The same matching as the built-in one
+		d.LuminanceWeighting = true
+		d.Quantizer = NewDitherer(redGreenYellowBlack).closestColorUnweighted
+		assert.Equal(t, expected, d.DitherCopy(img))
+
+		d.Quantizer = func(r, g, b uint16) int { return 2 }
+		dst, stats := d.DitherWithStats(img)
+		assert.Equal(t, redGreenYellowBlack[2], dst.At(10, 10))
+		assert.Equal(t, []int{0, 0, stats.Pixels, 0}, stats.ColorCounts)
+
+		d.Quantizer = func(r, g, b uint16) int { return 4 }
+		assert.Panics(t, func() { d.DitherCopy(img) })
+	}
+}
+
+func TestDitherResize(t *testing.T) {
+	// Black and white average to middle gray in linear RGB, which is much
+	// lighter than 50% sRGB
+	bw := image.NewGray(image.Rect(10, 10, 12, 11))
+	bw.SetGray(11, 10, color.Gray{255})
+	r := newResizedImage(bw, 1, 1, TransferSRGB)
+	c := r.At(0, 0).(color.NRGBA64)
+	assert.Equal(t, uint16(0xffff), c.A)
+	assert.InDelta(t, delinearize1(0.5)*65535, float64(c.R), 1)
+
+	// Transparent pixels don't darken the average
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	nrgba.SetNRGBA(0, 0, color.NRGBA{255, 255, 255, 255})
+	r = newResizedImage(nrgba, 1, 1, TransferSRGB)
+	assert.Equal(t, color.NRGBA64{0xffff, 0xffff, 0xffff, 0x8000}, r.At(0, 0))
+
+	img := loadImage(peppers, t)
+	orig := copyOfImage(img)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	dst := d.DitherResize(img, 100, 75)
+	assert.Equal(t, orig, img)
+	assert.Equal(t, image.Rect(0, 0, 100, 75), dst.Bounds())
+
+	// Same as resizing first
+	resized := image.NewNRGBA64(image.Rect(0, 0, 100, 75))
+	draw.Draw(resized, resized.Bounds(), newResizedImage(img, 100, 75, TransferSRGB), image.Point{}, draw.Src)
+	assert.Equal(t, copyOfImage(d.Dither(resized)), dst)
+
+	assert.Panics(t, func() { d.DitherResize(img, 0, 10) })
+}
+
+func TestResizeLinear(t *testing.T) {
+	// Fine black and white stripes
+	src := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x += 2 {
+			src.SetGray(x, y, color.Gray{255})
+		}
+	}
+	dst := ResizeLinear(src, 16, 16)
+	assert.Equal(t, image.Rect(0, 0, 16, 16), dst.Bounds())
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			// Linear middle gray, not 128
+			assert.Equal(t, color.RGBA{188, 188, 188, 255}, dst.RGBAAt(x, y))
+		}
+	}
+
+	assert.Panics(t, func() { ResizeLinear(src, 16, -1) })
+}
+
+func TestEncodePalettedPNG(t *testing.T) {
+	src := loadImage(dice, t)
+	d := NewDitherer([]color.Color{
+		color.Black,
+		color.White,
+		color.RGBA{255, 0, 0, 255},
+		color.Transparent,
+	})
+	d.Matrix = FloydSteinberg
+	d.AlphaLevels = []uint8{0, 255}
+	p := d.DitherPaletted(src)
+	pix := append([]uint8(nil), p.Pix...)
+
+	var buf bytes.Buffer
+	if err := EncodePalettedPNG(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, pix, p.Pix)
+	assert.Contains(t, buf.String(), "tRNS")
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatalf("decoded PNG is %T", img)
+	}
+	// The transparent color was moved to the start
+	_, _, _, a := decoded.Palette[0].RGBA()
+	assert.Zero(t, a)
+	b := p.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !sameColor(p.At(x, y), decoded.At(x, y)) {
+				t.Fatalf("pixel at (%d, %d) is %v, expected %v", x, y, decoded.At(x, y), p.At(x, y))
+			}
+		}
+	}
+
+	// Opaque images don't need tRNS
+	buf.Reset()
+	if err := EncodePalettedPNG(&buf, image.NewPaletted(b, blackWhite)); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, buf.String(), "tRNS")
+
+	assert.Error(t, EncodePalettedPNG(&buf, image.NewPaletted(b, nil)))
+}
+
+func TestDitherSubImage(t *testing.T) {
+	img := loadImage(peppers, t).(*image.RGBA)
+	r := image.Rect(100, 150, 300, 250)
+
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	d.Serpentine = true
+	sub := d.Dither(img.SubImage(r))
+	assert.Equal(t, r, sub.Bounds())
+
+	// Same as dithering a copy that starts at (0, 0)
+	cp := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(cp, cp.Bounds(), loadImage(peppers, t), r.Min, draw.Src)
+	expected := d.Dither(cp)
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			if sub.At(x+r.Min.X, y+r.Min.Y) != expected.At(x, y) {
+				t.Fatalf("pixel at (%d, %d) is different", x, y)
+			}
+		}
+	}
+}
+
+func TestLinearizeTables(t *testing.T) {
+	for tf := TransferFunction(0); tf < numTransfers; tf++ {
+		for i := 0; i < 256; i++ {
+			expected := uint16(math.RoundToEven(tf.linearize1(float64(i)/255.0) * 65535.0))
+			if v := tf.linearize255to65535(uint8(i)); v != expected {
+				t.Fatalf("transfer %d: linearize255to65535(%d) = %d, expected %d", tf, i, v, expected)
+			}
+		}
+		for i := 0; i < 65536; i++ {
+			expected := uint16(math.RoundToEven(tf.linearize1(float64(i)/65535.0) * 65535.0))
+			if v := tf.linearize65535(uint16(i)); v != expected {
+				t.Fatalf("transfer %d: linearize65535(%d) = %d, expected %d", tf, i, v, expected)
+			}
+		}
+	}
+}
+
+func BenchmarkToLinearRGB(b *testing.B) {
+	colors := []color.Color{
+		color.RGBA{12, 34, 56, 255},
+		color.RGBA64{1234, 3456, 5678, 65535},
+	}
+	for _, c := range colors {
+		b.Run(fmt.Sprintf("%T", c), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				toLinearRGB(c, TransferSRGB)
+			}
+		})
+	}
+}
+
+func TestOklab(t *testing.T) {
+	white := linearToOklab(65535, 65535, 65535)
+	assert.InDelta(t, 1, white[0], 1e-4)
+	assert.InDelta(t, 0, white[1], 1e-4)
+	assert.InDelta(t, 0, white[2], 1e-4)
+	assert.Equal(t, [3]float32{}, linearToOklab(0, 0, 0))
+
+	rand.Seed(1)
+	for i := 0; i < 10000; i++ {
+		r, g, b := uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16))
+		r2, g2, b2 := oklabToLinear(linearToOklab(r, g, b), GamutMappingChroma)
+		if absDiff(r, r2) > 2 || absDiff(g, g2) > 2 || absDiff(b, b2) > 2 {
+			t.Fatalf("(%d, %d, %d) became (%d, %d, %d)", r, g, b, r2, g2, b2)
+		}
+	}
+
+	// Out of gamut colors keep their lightness and hue
+	lab := [3]float32{0.6, 0.5, 0}
+	lab2 := linearToOklab(oklabToLinear(lab, GamutMappingChroma))
+	assert.InDelta(t, lab[0], lab2[0], 1e-3)
+	assert.InDelta(t, 0, lab2[2], 1e-3)
+	assert.Greater(t, lab2[1], float32(0))
+	assert.Less(t, lab2[1], lab[1])
+}
+
+func TestGamutMapping(t *testing.T) {
+	inGamut := func(lab [3]float32) bool {
+		r, g, b := oklabToLinear1(float64(lab[0]), float64(lab[1]), float64(lab[2]))
+		for _, v := range [3]float64{r, g, b} {
+			if v < -1e-3 || v > 1+1e-3 {
+				return false
+			}
+		}
+		return true
+	}
+
+	lab := [3]float32{0.4, -0.25, 0.1} // Too saturated for its lightness
+	assert.False(t, inGamut(lab))
+	assert.Equal(t, lab, GamutMappingNone.mapOklab(lab))
+	assert.True(t, inGamut(GamutMappingClip.mapOklab(lab)))
+	chroma := GamutMappingChroma.mapOklab(lab)
+	assert.True(t, inGamut(chroma))
+	assert.InDelta(t, lab[0], chroma[0], 1e-3)
+	// Same hue, less chroma
+	assert.InDelta(t, lab[2]/lab[1], chroma[2]/chroma[1], 1e-2)
+	assert.Less(t, -chroma[1], -lab[1])
+
+	d := NewDitherer(redGreenYellowBlack)
+	d.ColorSpace = ColorSpaceOklab
+	d.Matrix = FloydSteinberg
+	d.GamutMapping = GamutMappingChroma
+	ditherAndCompareImage(peppers, "edm_peppers_floyd-steinberg_oklab_chroma_red-green-yellow-black.png", d, t)
+
+	d.GamutMapping = numGamutMappings
+	assert.Panics(t, func() { d.Dither(image.NewGray(image.Rect(0, 0, 1, 1))) })
+}
+
+// absDiff returns the absolute difference between two channel values.
+func absDiff(v1, v2 uint16) uint16 {
+	if v1 > v2 {
+		return v1 - v2
+	}
+	return v2 - v1
+}
+
+func TestColorSpaceOklab(t *testing.T) {
+	d := NewDitherer(redGreenYellowBlack)
+	d.ColorSpace = ColorSpaceOklab
+	d.Matrix = FloydSteinberg
+	ditherAndCompareImage(peppers, "edm_peppers_floyd-steinberg_oklab_red-green-yellow-black.png", d, t)
+
+	// Palette colors are always matched exactly
+	for i, c := range redGreenYellowBlack {
+		r, g, b := SRGBToLinear(c)
+		assert.Equal(t, i, d.closestColor(r, g, b))
+	}
+
+	d.ColorSpace = numColorSpaces
+	assert.Panics(t, func() { d.Dither(image.NewGray(image.Rect(0, 0, 1, 1))) })
+}
+
+func TestLinearLuminance(t *testing.T) {
+	assert.Equal(t, uint16(0), LinearLuminance(0, 0, 0))
+	assert.Equal(t, uint16(65535), LinearLuminance(65535, 65535, 65535))
+	assert.Equal(t, uint16(12345), LinearLuminance(12345, 12345, 12345))
+	// The weights are 0.2126, 0.7152, 0.0722
+	assert.Equal(t, uint16(13933), LinearLuminance(65535, 0, 0))
+	assert.Equal(t, uint16(46870), LinearLuminance(0, 65535, 0))
+	assert.Equal(t, uint16(4732), LinearLuminance(0, 0, 65535))
+
+	// Same as the weights colorDist and closestGray use, apart from rounding
+	rand.Seed(1)
+	for i := 0; i < 10000; i++ {
+		r, g, b := uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16)), uint16(rand.Intn(1<<16))
+		y := (lumaR*float64(r) + lumaG*float64(g) + lumaB*float64(b)) / lumaTotal
+		assert.InDelta(t, y, float64(LinearLuminance(r, g, b)), 1)
+	}
+}
+
+func TestSRGBConversion(t *testing.T) {
+	assert.Equal(t, [3]uint16{0, 0, 0}, toArray(SRGBToLinear(color.Black)))
+	assert.Equal(t, [3]uint16{65535, 65535, 65535}, toArray(SRGBToLinear(color.White)))
+	// sRGB 50% gray is about 21% in linear RGB
+	assert.Equal(t, [3]uint16{14146, 14146, 14146}, toArray(SRGBToLinear(color.Gray{128})))
+	// Unpremultiplied first
+	assert.Equal(t, toArray(SRGBToLinear(color.NRGBA{200, 100, 50, 255})),
+		toArray(SRGBToLinear(color.NRGBA{200, 100, 50, 128})))
+
+	// Round trip for all 8-bit values
+	for i := 0; i < 256; i++ {
+		r, g, b := LinearToSRGB(SRGBToLinear(color.Gray{uint8(i)}))
+		assert.Equal(t, uint8(i), uint8((uint32(r)+128)/257))
+		assert.Equal(t, r, g)
+		assert.Equal(t, r, b)
+	}
+}
+
+func toArray(r, g, b uint16) [3]uint16 {
+	return [3]uint16{r, g, b}
+}
+
+func TestPremultiply(t *testing.T) {
+	img := loadImage(dice, t)
+	if _, ok := img.(*image.NRGBA); !ok {
+		t.Fatalf("dice image is %T, expected *image.NRGBA", img)
+	}
+
+	// Colors other than 0 and 255 can be changed by rounding
+	palette := []color.Color{
+		color.RGBA{200, 60, 30, 255},
+		color.RGBA{90, 180, 120, 255},
+		color.RGBA{240, 220, 110, 255},
+		color.RGBA{20, 30, 50, 255},
+	}
+	d := NewDitherer(palette)
+	assert.True(t, d.Premultiply)
+	d.Matrix = FloydSteinberg
+
+	// Count semi-transparent pixels whose RGB isn't a palette color
+	inPalette := func(c color.NRGBA) bool {
+		for _, p := range palette {
+			pc := color.NRGBAModel.Convert(p).(color.NRGBA)
+			if c.R == pc.R && c.G == pc.G && c.B == pc.B {
+				return true
+			}
+		}
+		return false
+	}
+	countWrong := func(img *image.NRGBA) int {
+		n := 0
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c := img.NRGBAAt(x, y); c.A != 0 && !inPalette(c) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	// Premultiplied colors get rounded when stored in an *image.NRGBA
+	premult := d.Dither(loadImage(dice, t)).(*image.NRGBA)
+	if countWrong(premult) == 0 {
+		t.Error("expected some pixels to be changed by rounding")
+	}
+
+	d.Premultiply = false
+	ditherAndCompareImage(dice, "floyd-steinberg_straight_alpha.png", d, t)
+	straight := d.Dither(loadImage(dice, t)).(*image.NRGBA)
+	assert.Equal(t, 0, countWrong(straight))
+
+	// Copies store straight alpha too
+	pi := image.NewPaletted(image.Rect(0, 0, 4, 4), blackWhite)
+	_, ok := d.Dither(pi).(*image.NRGBA)
+	assert.True(t, ok)
+	d.Premultiply = true
+	_, ok = d.Dither(pi).(*image.RGBA)
+	assert.True(t, ok)
+}
+
+// circleMask returns a mask for the image that's opaque inside a circle in
+// the center.
+func circleMask(b image.Rectangle) *image.Alpha {
+	mask := image.NewAlpha(b)
+	cx, cy := (b.Min.X+b.Max.X)/2, (b.Min.Y+b.Max.Y)/2
+	r := b.Dx() / 3
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if (x-cx)*(x-cx)+(y-cy)*(y-cy) < r*r {
+				mask.SetAlpha(x, y, color.Alpha{255})
+			}
+		}
+	}
+	return mask
+}
+
+func TestDitherMasked(t *testing.T) {
+	orig := loadImage(peppers, t)
+	mask := circleMask(orig.Bounds())
+
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	img := d.DitherMasked(loadImage(peppers, t), mask)
+	expected := loadImage("images/output/floyd-steinberg_masked.png", t)
+	assert.Equal(t, expected.(*image.RGBA).Pix, img.(*image.RGBA).Pix)
+
+	checkMasked := func(img image.Image) {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if mask.AlphaAt(x, y).A == 0 && img.At(x, y) != orig.At(x, y) {
+					t.Fatalf("masked out pixel at (%d, %d) was changed", x, y)
+				}
+			}
+		}
+	}
+	checkMasked(img)
+
+	d.Matrix = nil
+	d.Mapper = Bayer(8, 8, 1)
+	checkMasked(d.DitherMasked(loadImage(peppers, t), mask))
+
+	// A fully opaque mask is the same as no mask
+	full := image.NewUniform(color.Opaque)
+	assert.Equal(t, d.Dither(loadImage(peppers, t)), d.DitherMasked(loadImage(peppers, t), full))
+}
+
+func TestStrengthMap(t *testing.T) {
+	b := loadImage(peppers, t).Bounds()
+	// Strength increases from left to right
+	ramp := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			ramp.SetGray(x, y, color.Gray{uint8(x * 255 / (b.Dx() - 1))})
+		}
+	}
+
+	d := NewDitherer(redGreenYellowBlack)
+	d.StrengthMap = ramp
+	d.Matrix = FloydSteinberg
+	ditherAndCompareImage(peppers, "floyd-steinberg_strength_map.png", d, t)
+	d.Matrix = nil
+	d.Mapper = Bayer(8, 8, 1)
+	ditherAndCompareImage(peppers, "bayer_8x8_strength_map.png", d, t)
+
+	// No strength is the same as not dithering
+	img := loadImage(peppers, t)
+	none := NewDitherer(redGreenYellowBlack)
+	none.Mapper = func(x, y int, r, g, b uint16) (uint16, uint16, uint16) { return r, g, b }
+	expected := none.DitherCopy(img)
+	d.StrengthMap = image.NewUniform(color.Black)
+	assert.Equal(t, expected, d.DitherCopy(img))
+	d.Mapper = nil
+	d.Matrix = FloydSteinberg
+	assert.Equal(t, expected, d.DitherCopy(img))
+
+	// Full strength is the same as no map
+	d.StrengthMap = image.NewUniform(color.White)
+	d2 := NewDitherer(redGreenYellowBlack)
+	d2.Matrix = FloydSteinberg
+	assert.Equal(t, d2.DitherCopy(img), d.DitherCopy(img))
+}
+
+func TestEdgeEnhance(t *testing.T) {
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	// Before
+	ditherAndCompareImage(peppers, "edm_peppers_floyd-steinberg_red-green-yellow-black.png", d, t)
+	// After
+	d.EdgeEnhance = 0.5
+	ditherAndCompareImage(peppers, "floyd-steinberg_edge_enhance.png", d, t)
+
+	d.EdgeEnhance = -1
+	assert.Panics(t, func() { d.DitherCopy(loadImage(peppers, t)) })
+}
+
+func TestPreNoise(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	d.PreNoise = 0.05
+	ditherAndCompareImage(gradient, "floyd-steinberg_pre_noise.png", d, t)
+
+	// The noise doesn't change between calls
+	img := loadImage(gradient, t)
+	assert.Equal(t, d.DitherCopy(img), d.DitherCopy(img))
+
+	d.PreNoise = -1
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestThresholdModulation(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	d.ThresholdModulation = Bayer(4, 4, 0.2)
+	ditherAndCompareImage(gradient, "floyd-steinberg_threshold_modulation.png", d, t)
+}
+
+// flip returns a copy of img, flipped horizontally and/or vertically.
+func flip(img image.Image, horizontal, vertical bool) *image.RGBA {
+	b := img.Bounds()
+	f := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			fx, fy := x, y
+			if horizontal {
+				fx = b.Max.X - 1 - (x - b.Min.X)
+			}
+			if vertical {
+				fy = b.Max.Y - 1 - (y - b.Min.Y)
+			}
+			f.Set(fx, fy, img.At(x, y))
+		}
+	}
+	return f
+}
+
+// sameTile returns whether two images are the same inside r.
+func sameTile(a, b *image.RGBA, r image.Rectangle) bool {
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if a.RGBAAt(x, y) != b.RGBAAt(x, y) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestBidirectionalPasses(t *testing.T) {
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	d.BidirectionalPasses = 1
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg.png", d, t)
+	d.BidirectionalPasses = 2
+	ditherAndCompareImage(gradient, "floyd-steinberg_2_passes.png", d, t)
+	d.BidirectionalPasses = 4
+	ditherAndCompareImage(gradient, "floyd-steinberg_4_passes.png", d, t)
+
+	// Each pass is the same as dithering the flipped image top-to-bottom and
+	// flipping it back, so every tile of the output has to be one of those
+	img := loadImage(peppers, t)
+	d = NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	var passes []*image.RGBA
+	for _, flips := range [][2]bool{{false, false}, {false, true}, {true, false}, {true, true}} {
+		passes = append(passes, flip(d.DitherCopy(flip(img, flips[0], flips[1])), flips[0], flips[1]))
+	}
+	d.BidirectionalPasses = 4
+	dst := d.DitherCopy(img)
+	b := dst.Bounds()
+	flipped := 0
+	for ty := b.Min.Y; ty < b.Max.Y; ty += passTileSize {
+		for tx := b.Min.X; tx < b.Max.X; tx += passTileSize {
+			tile := image.Rect(tx, ty, tx+passTileSize, ty+passTileSize).Intersect(b)
+			var matches []int
+			for p, pass := range passes {
+				if sameTile(dst, pass, tile) {
+					matches = append(matches, p)
+				}
+			}
+			if len(matches) == 0 {
+				t.Fatalf("tile %v doesn't match any pass", tile)
+			}
+			if matches[0] != 0 {
+				flipped++
+			}
+		}
+	}
+	// Otherwise the flipped passes weren't tested at all
+	assert.NotZero(t, flipped)
+
+	d.Serpentine = true
+	assert.Equal(t, d.DitherCopy(img), d.DitherCopy(img))
+
+	d.BidirectionalPasses = 3
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestDitherYCbCr(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, loadImage(peppers, t), nil); err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ycc, ok := img.(*image.YCbCr)
+	if !ok {
+		t.Fatalf("decoded JPEG is %T", img)
+	}
+	pix := append([]uint8(nil), ycc.Y...)
+	mask := circleMask(ycc.Bounds())
+
+	// The YCbCr colors are used at full precision, unlike when image/draw
+	// converts them to RGBA
+	full := func() *image.RGBA64 {
+		dst := image.NewRGBA64(ycc.Bounds())
+		for y := ycc.Rect.Min.Y; y < ycc.Rect.Max.Y; y++ {
+			for x := ycc.Rect.Min.X; x < ycc.Rect.Max.X; x++ {
+				dst.Set(x, y, ycc.At(x, y))
+			}
+		}
+		return dst
+	}
+
+	d := NewDitherer(redGreenYellowBlack)
+	d.Matrix = FloydSteinberg
+	assert.Equal(t, copyOfImage(d.Dither(full())), d.Dither(ycc))
+	assert.Equal(t, copyOfImage(d.DitherMasked(full(), mask)), d.DitherMasked(ycc, mask))
+
+	d.Matrix = nil
+	d.Mapper = Bayer(4, 4, 1)
+	assert.Equal(t, copyOfImage(d.Dither(full())), d.Dither(ycc))
+	assert.Equal(t, copyOfImage(d.DitherMasked(full(), mask)), d.DitherMasked(ycc, mask))
+
+	// Not changed
+	assert.Equal(t, pix, ycc.Y)
+
+	d.Premultiply = false
+	assert.IsType(t, &image.NRGBA{}, d.Dither(ycc))
+}
+
+func TestDitherGray(t *testing.T) {
+	img := loadImage(gradient, t)
+	grays := []color.Color{color.Black, color.Gray{85}, color.Gray{170}, color.White}
+
+	for _, d := range []*Ditherer{NewDitherer(blackWhite), NewDitherer(grays)} {
+		d.Matrix = FloydSteinberg
+		rgba := d.DitherCopy(img)
+
+		gray := image.NewGray(rgba.Bounds())
+		copyImage(gray, rgba)
+		assert.Equal(t, gray, d.DitherGray(img))
+		gray16 := image.NewGray16(rgba.Bounds())
+		copyImage(gray16, rgba)
+		assert.Equal(t, gray16, d.DitherGray16(img))
+
+		d.Matrix = nil
+		d.Mapper = Bayer(8, 8, 1)
+		rgba = d.DitherCopy(img)
+		copyImage(gray, rgba)
+		assert.Equal(t, gray, d.DitherGray(img))
+	}
+
+	d := NewDitherer(redGreenBlack)
+	d.Matrix = FloydSteinberg
+	assert.Panics(t, func() { d.DitherGray(img) })
+}
+
+func TestDitherCMYK(t *testing.T) {
+	img := loadImage(peppers, t)
+	richBlack := color.CMYK{128, 128, 128, 255}
+	palette := []color.Color{
+		color.CMYK{0, 0, 0, 0},
+		color.CMYK{255, 0, 0, 0},
+		color.CMYK{0, 255, 0, 0},
+		color.CMYK{0, 0, 255, 0},
+		richBlack,
+	}
+	d := NewDitherer(palette)
+	d.Matrix = FloydSteinberg
+
+	rgba := d.DitherCopy(img)
+	cmyk := d.DitherCMYK(img)
+	assert.Equal(t, rgba.Rect, cmyk.Rect)
+	for y := cmyk.Rect.Min.Y; y < cmyk.Rect.Max.Y; y++ {
+		for x := cmyk.Rect.Min.X; x < cmyk.Rect.Max.X; x++ {
+			c := cmyk.CMYKAt(x, y)
+			// Same color as usual, but stored as the exact palette color
+			assert.Equal(t, color.RGBA64Model.Convert(rgba.At(x, y)), color.RGBA64Model.Convert(c))
+			assert.Contains(t, palette, color.Color(c))
+		}
+	}
+	// The rich black is kept, instead of being converted from RGB black
+	assert.Contains(t, cmyk.Pix, uint8(128))
+
+	// Other palettes are converted
+	d = NewDitherer(redGreenBlack)
+	d.Mapper = Bayer(8, 8, 1)
+	expected := image.NewCMYK(img.Bounds())
+	copyImage(expected, d.DitherCopy(img))
+	assert.Equal(t, expected, d.DitherCMYK(img))
+}
+
+func TestDitherBinary(t *testing.T) {
+	img := loadImage(gradient, t)
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+
+	p := d.DitherPaletted(img)
+	bm := d.DitherBinary(img)
+	assert.Equal(t, p.Rect, bm.Rect)
+	assert.Equal(t, (p.Rect.Dx()+7)/8, bm.Stride)
+	for y := p.Rect.Min.Y; y < p.Rect.Max.Y; y++ {
+		for x := p.Rect.Min.X; x < p.Rect.Max.X; x++ {
+			if p.ColorIndexAt(x, y) != bm.ColorIndexAt(x, y) {
+				t.Fatalf("pixel at (%d, %d) is wrong", x, y)
+			}
+		}
+	}
+
+	// Check the packing, with a width that isn't a multiple of 8
+	src := image.NewGray(image.Rect(5, 5, 15, 7))
+	for x := 5; x < 15; x += 2 {
+		src.SetGray(x, 5, color.Gray{255})
+		src.SetGray(x+1, 6, color.Gray{255})
+	}
+	d.Matrix = nil
+	d.Mapper = Threshold(0.5)
+	bm = d.DitherBinary(src)
+	assert.Equal(t, []uint8{0b10101010, 0b10000000, 0b01010101, 0b01000000}, bm.Pix)
+	assert.Equal(t, color.Color(color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff}), bm.At(5, 5))
+	assert.Equal(t, color.Color(color.RGBA64{0, 0, 0, 0xffff}), bm.At(6, 5))
+
+	d = NewDitherer(redGreenBlack)
+	d.Matrix = FloydSteinberg
+	assert.Panics(t, func() { d.DitherBinary(img) })
+}
+
+func TestErrorThreshold(t *testing.T) {
+	// A flat area that's slightly lighter than black
+	img := image.NewGray16(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray16{delinearize65535(1000)}), image.Point{}, draw.Src)
+	countWhite := func(img image.Image) int {
+		n := 0
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if sameColor(img.At(x, y), color.White) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	assert.NotZero(t, countWhite(d.DitherCopy(img)))
+
+	// The error is below the threshold, so it never builds up
+	d.ErrorThreshold = 0.02
+	assert.Zero(t, countWhite(d.DitherCopy(img)))
+
+	// Gradients are still dithered, except close to black and white
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg_error_threshold.png", d, t)
+
+	d.ErrorThreshold = -1
+	assert.Panics(t, func() { d.Dither(img) })
+}
+
+func TestGrayscaleMatch(t *testing.T) {
+	green := color.RGBA{0, 255, 0, 255}
+
+	// Unweighted, green is closer to black, but its luminance is closer to white
+	d := NewDitherer(blackWhite)
+	d.LuminanceWeighting = false
+	assert.True(t, sameColor(color.Black, d.GetColorModel().Convert(green)))
+	d.GrayscaleMatch = true
+	assert.True(t, sameColor(color.White, d.GetColorModel().Convert(green)))
+
+	// No effect on palettes with colors
+	d = NewDitherer([]color.Color{color.Black, color.White, color.RGBA{255, 0, 0, 255}})
+	d.LuminanceWeighting = false
+	d.GrayscaleMatch = true
+	assert.True(t, sameColor(color.Black, d.GetColorModel().Convert(green)))
+
+	// Error diffusion keeps the luminance of saturated colors
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, img.Bounds(), image.NewUniform(green), image.Point{}, draw.Src)
+	d = NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	d.GrayscaleMatch = true
+	out := d.DitherCopy(img)
+	white := 0
+	b := out.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := out.At(x, y)
+			if sameColor(c, color.White) {
+				white++
+			} else if !sameColor(c, color.Black) {
+				t.Fatalf("unexpected color %v at (%d, %d)", c, x, y)
+			}
+		}
+	}
+	assert.InDelta(t, 0.7152, float64(white)/float64(b.Dx()*b.Dy()), 0.01)
+}
+
+func TestDitherGray16Precision(t *testing.T) {
+	// Close dark values, which 8 bits can't tell apart
+	var palette []color.Color
+	img := image.NewGray16(image.Rect(0, 0, 256, 4))
+	for x := 0; x < 256; x++ {
+		v := uint16(x*7 + 3)
+		palette = append(palette, color.Gray16{v})
+		for y := 0; y < 4; y++ {
+			img.SetGray16(x, y, color.Gray16{v})
+		}
+	}
+	d := NewDitherer(palette)
+	d.Matrix = FloydSteinberg
+	d.Transfer = TransferLinear
+	assert.Equal(t, img, d.DitherGray16(img))
+	dst := image.NewGray16(img.Bounds())
+	copy(dst.Pix, img.Pix)
+	assert.Equal(t, img, d.Dither(dst))
+
+	// A smooth ramp is dithered between 16-bit palette colors
+	ramp := image.NewGray16(image.Rect(0, 0, 1000, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 1000; x++ {
+			ramp.SetGray16(x, y, color.Gray16{uint16(x)})
+		}
+	}
+	d = NewDitherer([]color.Color{color.Gray16{0}, color.Gray16{1000}})
+	d.Matrix = FloydSteinberg
+	d.Transfer = TransferLinear
+	out := d.DitherGray16(ramp)
+	for x := 0; x < 1000; x += 100 {
+		var sum int
+		for y := 0; y < 16; y++ {
+			for xx := x; xx < x+100; xx++ {
+				sum += int(out.Gray16At(xx, y).Y)
+			}
+		}
+		assert.InDelta(t, x+50, sum/1600, 20, "x = %d", x)
+	}
+}
+
+func TestRoundClampMode(t *testing.T) {
+	for _, tc := range []struct {
+		i                   float32
+		even, halfUp, floor uint16
+	}{
+		{-3, 0, 0, 0},
+		{0.5, 0, 1, 0},
+		{1.5, 2, 2, 1},
+		{2.5, 2, 3, 2},
+		{2.7, 3, 3, 2},
+		{65534.5, 65534, 65535, 65534},
+		{70000, 65535, 65535, 65535},
+	} {
+		assert.Equal(t, tc.even, RoundClampMode(tc.i, RoundToEven), "%v", tc.i)
+		assert.Equal(t, RoundClamp(tc.i), RoundClampMode(tc.i, RoundToEven), "%v", tc.i)
+		assert.Equal(t, tc.halfUp, RoundClampMode(tc.i, RoundHalfUp), "%v", tc.i)
+		assert.Equal(t, tc.floor, RoundClampMode(tc.i, Floor), "%v", tc.i)
+	}
+	assert.Panics(t, func() { RoundClampMode(1, numRoundings) })
+
+	d := NewDitherer(blackWhite)
+	d.Matrix = FloydSteinberg
+	d.Rounding = RoundToEven
+	ditherAndCompareImage(gradient, "edm_floyd-steinberg.png", d, t)
+
+	// Rounding down loses some of the error every time it's diffused
+	img := loadImage(gradient, t)
+	even := d.DitherCopy(img)
+	d.Rounding = Floor
+	assert.NotEqual(t, even, d.DitherCopy(img))
+
+	d.Rounding = numRoundings
+	assert.Panics(t, func() { d.Dither(img) })
+}
+
+func TestPreserveExtremes(t *testing.T) {
+	palette := []color.Color{
+		color.Black,
+		color.Gray{64},
+		color.Gray{192},
+		color.White,
+	}
+	// Colorful on the left, nearly black on top right, nearly white on bottom
+	// right
+	src := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			switch {
+			case x < 32:
+				src.Set(x, y, color.RGBA{uint8(x * 8), uint8(y * 4), 128, 255})
+			case y < 32:
+				src.Set(x, y, color.RGBA{6, 8, 2, 255})
+			default:
+				src.Set(x, y, color.RGBA{250, 247, 255, 255})
+			}
+		}
+	}
+	extremes := func(img image.Image) bool {
+		for y := 0; y < 64; y++ {
+			for x := 32; x < 64; x++ {
+				r, _, _, _ := img.At(x, y).RGBA()
+				if (y < 32 && r != 0) || (y >= 32 && r != 0xffff) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	d := NewDitherer(palette)
+	d.Matrix = FloydSteinberg
+	assert.False(t, extremes(d.DitherCopy(src)))
+	d.PreserveExtremes = true
+	assert.True(t, extremes(d.DitherCopy(src)))
+
+	d.Matrix = nil
+	d.Mapper = Bayer(4, 4, 1)
+	d.PreserveExtremes = false
+	assert.False(t, extremes(d.DitherCopy(src)))
+	d.PreserveExtremes = true
+	assert.True(t, extremes(d.DitherCopy(src)))
+}
+
+func TestLuminanceWeighting(t *testing.T) {
+	d := NewDitherer([]color.Color{
+		color.Black,
+		color.White,
+		color.RGBA{255, 0, 0, 255},
+		color.RGBA{0, 255, 0, 255},
+		color.RGBA{0, 0, 255, 255},
+	})
+	assert.Equal(t, 3, d.closestColor(40000, 40000, 0))
+	d.LuminanceWeighting = false
+	assert.Equal(t, 2, d.closestColor(40000, 40000, 0))
+
+	d.Matrix = FloydSteinberg
+	ditherAndCompareImage(peppers, "floyd-steinberg_unweighted.png", d, t)
+}
+
+func TestDitherAll(t *testing.T) {
+	imgs := []image.Image{loadImage(peppers, t), loadImage(gradient, t), loadImage(dice, t)}
+	for i := 0; i < 5; i++ {
+		imgs = append(imgs, copyOfImage(imgs[0]).SubImage(image.Rect(i*50, i*20, i*50+100, i*20+80)))
+	}
+	copies := func() []image.Image {
+		srcs := make([]image.Image, len(imgs))
+		for i := range imgs {
+			srcs[i] = copyOfImage(imgs[i])
+		}
+		return srcs
+	}
+
+	d := NewDitherer(redGreenYellowBlack)
+	for _, single := range []bool{false, true} {
+		d.SingleThreaded = single
+		for _, matrix := range []bool{true, false} {
+			d.Matrix, d.Mapper = FloydSteinberg, nil
+			if !matrix {
+				d.Matrix, d.Mapper = nil, Bayer(8, 8, 1)
+			}
+
+			srcs := copies()
+			dsts := d.DitherAll(srcs)
+			assert.Len(t, dsts, len(srcs))
+			for i := range srcs {
+				// Changed in place
+				assert.Same(t, srcs[i], dsts[i])
+				assert.Equal(t, d.Dither(copyOfImage(imgs[i])), copyOfImage(dsts[i]))
+			}
+		}
+	}
+
+	assert.Empty(t, d.DitherAll(nil))
+}
+
+func TestToASCII(t *testing.T) {
+	p := image.NewPaletted(image.Rect(0, 0, 4, 2), []color.Color{
+		color.White,
+		color.Black,
+		color.Transparent,
+		color.Gray{128},
+	})
+	p.Pix = []uint8{
+		0, 1, 2, 3,
+		3, 3, 1, 0,
+	}
+	assert.Equal(t, "#  .\n.. #\n", ToASCII(p, []rune(" .#")))
+	// Palette colors are spread out over longer ramps
+	assert.Equal(t, "█  ▒\n▒▒ █\n", ToASCII(p, []rune(" ░▒▓█")))
+	// And share characters with shorter ones
+	assert.Equal(t, "@. @\n@@.@\n", ToASCII(p, []rune(".@")))
+
+	// Indexes outside the palette are spaces
+	p.Pix[0] = 200
+	assert.Equal(t, "   .\n.. #\n", ToASCII(p, []rune(" .#")))
+
+	// Palettes with more than 256 colors, of which only the first 256 can be
+	// used
+	big := make(color.Palette, 300)
+	for i := range big {
+		big[i] = color.Gray16{uint16(i * 200)}
+	}
+	p = image.NewPaletted(image.Rect(0, 0, 2, 1), big)
+	p.Pix = []uint8{0, 255}
+	assert.Equal(t, " #\n", ToASCII(p, []rune(" .#")))
+
+	assert.Panics(t, func() { ToASCII(p, nil) })
+}
+
+func TestToANSI(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 3))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	img.SetNRGBA(0, 1, color.NRGBA{0, 0, 255, 255})
+	img.SetNRGBA(1, 1, color.NRGBA{0, 255, 0, 255})
+	img.SetNRGBA(0, 2, color.NRGBA{255, 255, 255, 255})
+
+	var buf bytes.Buffer
+	if err := ToANSI(&buf, img, 0); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t,
+		"\x1b[38;2;255;0;0;48;2;0;0;255m▀\x1b[38;2;0;255;0;49m▄\x1b[0m\n"+
+			"\x1b[38;2;255;255;255;49m▀\x1b[39;49m \x1b[0m\n",
+		buf.String(),
+	)
+
+	// Scaled down to fit
+	buf.Reset()
+	src := loadImage(peppers, t)
+	if err := ToANSI(&buf, src, 40); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	h := (src.Bounds().Dy()*40 + src.Bounds().Dx()/2) / src.Bounds().Dx()
+	assert.Equal(t, (h+1)/2, len(lines))
+	for _, line := range lines {
+		assert.Equal(t, 40, strings.Count(line, "▀"))
+	}
+}
+
+func TestOrderedDitherMatrixToImage(t *testing.T) {
+	img := BayerMatrix(2, 2).ToImage()
+	assert.Equal(t, image.Rect(0, 0, 2, 2), img.Bounds())
+	// The matrix is {0, 3}, {2, 1}
+	assert.Equal(t, color.Gray16{16383}, img.Gray16At(0, 0))
+	assert.Equal(t, color.Gray16{65535}, img.Gray16At(1, 0))
+	assert.Equal(t, color.Gray16{49151}, img.Gray16At(0, 1))
+	assert.Equal(t, color.Gray16{32767}, img.Gray16At(1, 1))
+
+	img = Vertical5x3.ToImage()
+	assert.Equal(t, image.Rect(0, 0, len(Vertical5x3.Matrix[0]), len(Vertical5x3.Matrix)), img.Bounds())
+}
+
+func TestSoftNearest(t *testing.T) {
+	img := loadImage(peppers, t)
+	d := NewDitherer(redGreenYellowBlack)
+	d.Special = SoftNearest
+	dst := d.DitherCopy(img)
+	assert.Equal(t, dst, d.DitherCopy(img))
+	d.SingleThreaded = true
+	assert.Equal(t, dst, d.DitherCopy(img))
+
+	// Linear middle gray comes out half black and half white
+	gray := image.NewUniform(color.Gray{188})
+	src := image.NewGray(image.Rect(0, 0, 100, 100))
+	draw.Draw(src, src.Bounds(), gray, image.Point{}, draw.Src)
+	d = NewDitherer(blackWhite)
+	d.Special = SoftNearest
+	bw := d.DitherCopy(src)
+	white := 0
+	for i := 0; i < len(bw.Pix); i += 4 {
+		if bw.Pix[i] == 255 {
+			white++
+		}
+	}
+	assert.InDelta(t, 5000, white, 250)
+
+	// Palette colors stay the same
+	d = NewDitherer(redGreenYellowBlack)
+	d.Special = SoftNearest
+	dithered := d.DitherCopy(img)
+	assert.Equal(t, dithered, d.DitherCopy(dithered))
+
+	d.Special = LumaDiffusion + 1
+	assert.Panics(t, func() { d.DitherCopy(img) })
+	d.Special = SoftNearest
+	d.Matrix = FloydSteinberg
+	assert.Panics(t, func() { d.DitherCopy(img) })
+}
+
+func TestLumaDiffusion(t *testing.T) {
+	d := NewDitherer(append(redGreenYellowBlack, color.White, color.RGBA{0, 0, 255, 255}))
+	d.Special = LumaDiffusion
+	ditherAndCompareImage(peppers, "luma_diffusion_peppers.png", d, t)
+
+	// A flat red only uses the reds, and keeps its lightness
+	reds := []color.Color{color.Black, color.White, color.RGBA{128, 0, 0, 255}, color.RGBA{255, 0, 0, 255}}
+	d = NewDitherer(reds)
+	d.Special = LumaDiffusion
+	src := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.RGBA{200, 0, 0, 255}), image.Point{}, draw.Src)
+	dst := d.DitherCopy(src)
+	var sum float64
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := dst.RGBAAt(x, y)
+			if c.G != 0 || c.B != 0 || c.R == 0 {
+				t.Fatalf("color %v at (%d, %d) isn't red", c, x, y)
+			}
+			r, g, b := toLinearRGB(c, TransferSRGB)
+			sum += float64(linearToOklab(r, g, b)[0])
+		}
+	}
+	r, g, b := toLinearRGB(color.RGBA{200, 0, 0, 255}, TransferSRGB)
+	assert.InDelta(t, linearToOklab(r, g, b)[0], sum/(64*64), 0.01)
+
+	// Masked pixels are left alone
+	mask := image.NewAlpha(src.Bounds())
+	draw.Draw(mask, image.Rect(0, 0, 32, 64), image.Opaque, image.Point{}, draw.Src)
+	masked := d.DitherMasked(copyOfImage(src), mask).(*image.RGBA)
+	assert.Equal(t, src.Pix[len(src.Pix)-4:], masked.Pix[len(masked.Pix)-4:])
+	assert.Equal(t, dst.Pix[:4], masked.Pix[:4])
+
+	// The options of the other Dither methods work too
+	img := loadImage(peppers, t)
+	bounds := img.Bounds()
+	d = NewDitherer(redGreenYellowBlack)
+	d.Special = LumaDiffusion
+	d.Serpentine = true
+	expected := d.Dither(copyOfImage(img))
+
+	var s Scratch
+	assert.Equal(t, expected, d.DitherWithScratch(copyOfImage(img), &s))
+	assert.NotNil(t, s.lights)
+	assert.Equal(t, expected, d.DitherWithScratch(copyOfImage(img), &s))
+
+	dst = copyOfImage(img)
+	var carry ErrorCarry
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 50 {
+		d.DitherRegionCarry(dst, image.Rect(bounds.Min.X, y, bounds.Max.X, y+50), &carry)
+	}
+	assert.Equal(t, expected, dst)
+	assert.Empty(t, carry.errs)
+
+	prev := d.DitherPaletted(img)
+	brighter := copyOfImage(img)
+	for i := range brighter.Pix {
+		if i%4 != 3 && brighter.Pix[i] < 235 {
+			brighter.Pix[i] += 20
+		}
+	}
+	assert.NotEqual(t, prev.Pix, d.DitherPaletted(brighter).Pix)
+	// Further apart than any two colors, so every pixel is kept
+	assert.Equal(t, prev.Pix, d.DitherStable(prev, brighter, 2).Pix)
+
+	d.Matrix = FloydSteinberg
+	assert.Panics(t, func() { d.DitherCopy(src) })
+}
+
+func TestValidateForFormat(t *testing.T) {
+	d := NewDitherer(redGreenYellowBlack)
+	for _, format := range []string{"gif", "PNG", "webp", "jpeg", "jpg"} {
+		assert.NoError(t, d.ValidateForFormat(format), format)
+	}
+	assert.NoError(t, d.ValidateForGIF())
+	assert.Error(t, d.ValidateForFormat("bmp"))
+
+	d = NewDitherer(append(redGreenYellowBlack, color.Transparent))
+	assert.NoError(t, d.ValidateForGIF())
+	assert.NoError(t, d.ValidateForFormat("webp"))
+	assert.Error(t, d.ValidateForFormat("jpeg"))
+
+	d = NewDitherer(append(redGreenYellowBlack, color.Transparent, color.RGBA{}))
+	assert.Error(t, d.ValidateForGIF())
+
+	d = NewDitherer(append(redGreenYellowBlack, color.NRGBA{255, 255, 255, 128}))
+	assert.Error(t, d.ValidateForGIF())
+	assert.NoError(t, d.ValidateForFormat("png"))
+
+	big := make([]color.Color, 257)
+	for i := range big {
+		big[i] = color.RGBA{uint8(i), uint8(i / 2), 0, 255}
+	}
+	d = NewDitherer(big)
+	assert.Error(t, d.ValidateForGIF())
+	assert.Error(t, d.ValidateForFormat("webp"))
+	assert.NoError(t, d.ValidateForFormat("png"))
+}
+
+func TestDitherErrorMap(t *testing.T) {
+	img := loadImage(peppers, t)
+	b := img.Bounds()
+
+	// Quantizing only, so the errors are easy to check
+	d := NewDitherer(redGreenYellowBlack)
+	dst, errMap := d.DitherErrorMap(copyOfImage(img))
+	assert.Equal(t, d.DitherCopy(img), dst)
+	assert.Equal(t, b, errMap.Bounds())
+	for y := b.Min.Y; y < b.Max.Y; y += 7 {
+		for x := b.Min.X; x < b.Max.X; x += 7 {
+			r, g, bl := SRGBToLinear(img.At(x, y))
+			pr, pg, pb := SRGBToLinear(dst.At(x, y))
+			e := float64(int(r)-int(pr))*float64(int(r)-int(pr)) +
+				float64(int(g)-int(pg))*float64(int(g)-int(pg)) +
+				float64(int(bl)-int(pb))*float64(int(bl)-int(pb))
+			assert.InDelta(t, math.Sqrt(e/3), float64(errMap.Gray16At(x, y).Y), 1)
+		}
+	}
+
+	// Palette colors have no error
+	_, errMap = d.DitherErrorMap(dst)
+	assert.Equal(t, image.NewGray16(b), errMap)
+
+	d.Matrix = FloydSteinberg
+	dst, errMap = d.DitherErrorMap(copyOfImage(img))
+	assert.Equal(t, d.DitherCopy(img), dst)
+	assert.NotEqual(t, image.NewGray16(b), errMap)
+}
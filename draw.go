@@ -47,7 +47,11 @@ func subset(p1 []color.Color, p2 []color.Color) bool {
 //
 // Draw ignores whether dst has a palette or not, and just uses the internal Ditherer
 // palette. If the dst image passed has a palette (i.e. is of the type *image.Paletted),
-// and the palette is the not the same as the Ditherer's palette, it will panic.
+// the dithered pixels are set to the nearest color in the dst palette. The palettes
+// don't have to be the same: the dst palette can be in a different order, or have
+// extra colors. Any Ditherer palette colors that aren't in the dst palette will be
+// approximated, which means the result isn't properly dithered anymore, so it's best
+// to make sure they're all there.
 func (d *Ditherer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
 	if d.invalid() {
 		panic("dither: invalid Ditherer")
@@ -55,10 +59,7 @@ func (d *Ditherer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp i
 
 	dst2 := dst
 	paletted := false
-	if p, ok := dst.(*image.Paletted); ok {
-		if !samePalette(d.palette, p.Palette) {
-			panic("dither: Draw: dst was an *image.Paletted that doesn't have the same palette")
-		}
+	if _, ok := dst.(*image.Paletted); ok {
 		// src needs to copied onto dst, and then dst is dithered
 		// But dst is paletted and so the copy will change colors
 		// So instead an RGBA copy of dst is made, and then values are copied back
@@ -95,6 +96,8 @@ func (d *Ditherer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp i
 	if paletted {
 		// The dithered values in the RGBA image need to copied back into the
 		// original paletted image. See above.
+		// draw.Draw picks the nearest dst palette color for each pixel, so this
+		// works even if the palettes are different.
 		copyImage(dst, dst2)
 	}
 }
@@ -0,0 +1,209 @@
+package dither
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// Encode dithers a copy of the src image and writes it to w, encoded in the
+// given format. The src image remains unchanged. The format is one of "png",
+// "gif", "webp", "jpeg", or "jpg", ignoring case.
+//
+// PNG and GIF images are encoded as paletted images when the palette has 256
+// colors or less, which keeps the file size small. Transparency is handled the
+// same way as DitherPaletted. GIF doesn't support more than 256 colors, so an
+// error is returned if the palette is bigger than that. WebP images are
+// encoded losslessly with EncodeWebP, which also requires 256 colors or less.
+//
+// JPEG is supported for convenience, but it's lossy and will not keep the
+// dithered pixels intact, even though the highest quality is used. PNG or GIF
+// should be used instead whenever possible.
+func (d *Ditherer) Encode(w io.Writer, src image.Image, format string) error {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+
+	switch strings.ToLower(format) {
+	case "png":
+		if len(d.palette) <= 256 {
+			return EncodePalettedPNG(w, d.DitherPaletted(src))
+		}
+		return png.Encode(w, d.DitherCopy(src))
+	case "gif":
+		if len(d.palette) > 256 {
+			return errors.New("dither: Encode: palette has over 256 colors which GIF doesn't support")
+		}
+		return gif.Encode(w, d.DitherPaletted(src), nil)
+	case "webp":
+		if len(d.palette) > 256 {
+			return errors.New("dither: Encode: palette has over 256 colors which EncodeWebP doesn't support")
+		}
+		return EncodeWebP(w, d.DitherPaletted(src))
+	case "jpeg", "jpg":
+		return jpeg.Encode(w, d.DitherCopy(src), &jpeg.Options{Quality: 100})
+	}
+	return errors.New("dither: Encode: unknown format: " + format)
+}
+
+// ValidateForGIF returns an error if the palette can't be used for GIF images,
+// which is the same as ValidateForFormat("gif").
+func (d *Ditherer) ValidateForGIF() error {
+	return d.validateFor("gif", "ValidateForGIF")
+}
+
+// ValidateForFormat returns an error if the palette can't be used for images
+// in the given format, which is one of the formats Encode supports. This can
+// be used to find problems with a palette up front, instead of getting a panic
+// from DitherPaletted or an error from Encode later.
+//
+//   - GIF supports 256 colors at most, and at most one of them can be
+//     transparent. The others must be opaque, because GIF doesn't support
+//     partial transparency.
+//   - WebP supports 256 colors at most, since EncodeWebP only writes paletted
+//     images.
+//   - JPEG doesn't support transparency, so all the colors must be opaque.
+//   - PNG supports any palette.
+//
+// An error is also returned if the format isn't supported.
+func (d *Ditherer) ValidateForFormat(format string) error {
+	return d.validateFor(strings.ToLower(format), "ValidateForFormat")
+}
+
+// validateFor implements ValidateForFormat, and uses name in the errors.
+func (d *Ditherer) validateFor(format, name string) error {
+	transparent, partial := 0, 0
+	for _, c := range d.palette {
+		switch _, _, _, a := c.RGBA(); a {
+		case 0:
+			transparent++
+		case 0xffff:
+		default:
+			partial++
+		}
+	}
+
+	switch format {
+	case "gif":
+		if len(d.palette) > 256 {
+			return errors.New("dither: " + name + ": palette has over 256 colors which GIF doesn't support")
+		}
+		if transparent > 1 {
+			return errors.New("dither: " + name + ": palette has more than one transparent color which GIF doesn't support")
+		}
+		if partial > 0 {
+			return errors.New("dither: " + name + ": palette has partially transparent colors which GIF doesn't support")
+		}
+	case "webp":
+		if len(d.palette) > 256 {
+			return errors.New("dither: " + name + ": palette has over 256 colors which EncodeWebP doesn't support")
+		}
+	case "jpeg", "jpg":
+		if transparent > 0 || partial > 0 {
+			return errors.New("dither: " + name + ": palette has transparent colors which JPEG doesn't support")
+		}
+	case "png":
+	default:
+		return errors.New("dither: " + name + ": unknown format: " + format)
+	}
+	return nil
+}
+
+// EncodePalettedPNG writes the image to w as an indexed PNG, using the
+// smallest bit depth that fits the palette. Transparent palette colors, like
+// the ones used by DitherPaletted, are written to the tRNS chunk, so PNG
+// viewers show those pixels as transparent.
+//
+// The tRNS chunk holds the alpha values of the palette colors from the start of
+// the palette up to the last transparent one. So if any transparent colors come
+// after opaque ones, they are moved to the start of the palette in the encoded
+// image, which keeps the chunk small. The pixels still have the same colors.
+// The image itself isn't changed.
+//
+// The palette must have 1 to 256 colors.
+func EncodePalettedPNG(w io.Writer, p *image.Paletted) error {
+	if len(p.Palette) < 1 || len(p.Palette) > 256 {
+		return errors.New("dither: EncodePalettedPNG: palette must have 1 to 256 colors")
+	}
+
+	// New order of the palette, with the colors that aren't opaque first
+	var order []int
+	for i, c := range p.Palette {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			order = append(order, i)
+		}
+	}
+	if len(order) == 0 || order[len(order)-1] == len(order)-1 {
+		// Already at the start
+		return png.Encode(w, p)
+	}
+	for i, c := range p.Palette {
+		if _, _, _, a := c.RGBA(); a == 0xffff {
+			order = append(order, i)
+		}
+	}
+
+	var index [256]uint8 // Old index to new index
+	palette := make(color.Palette, len(p.Palette))
+	for i, j := range order {
+		palette[i] = p.Palette[j]
+		index[j] = uint8(i)
+	}
+	cp := image.NewPaletted(p.Rect, palette)
+	w2 := p.Rect.Dx()
+	for y := 0; y < p.Rect.Dy(); y++ {
+		src := p.Pix[y*p.Stride : y*p.Stride+w2]
+		dst := cp.Pix[y*cp.Stride : y*cp.Stride+w2]
+		for x, i := range src {
+			dst[x] = index[i]
+		}
+	}
+	return png.Encode(w, cp)
+}
+
+// DitherFrames dithers copies of every frame, and returns a GIF animation of
+// them that's ready to be encoded with gif.EncodeAll. delays holds the delay of
+// each frame in 100ths of a second, and must be the same length as frames, or
+// nil for no delays.
+//
+// All the frames use the Ditherer's palette, which is set as the global color
+// table of the GIF. This is smaller than giving each frame its own table.
+// The size of the GIF is set so that every frame fits.
+//
+// The function will panic if the palette has over 256 colors, or the number of
+// delays is wrong. Transparency is handled the same way as DitherPaletted.
+func (d *Ditherer) DitherFrames(frames []image.Image, delays []int) *gif.GIF {
+	if len(d.palette) > 256 {
+		panic("dither: DitherFrames: palette has over 256 colors which GIF doesn't support")
+	}
+	if delays == nil {
+		delays = make([]int, len(frames))
+	} else if len(delays) != len(frames) {
+		panic("dither: DitherFrames: number of delays doesn't match the number of frames")
+	}
+
+	g := &gif.GIF{
+		Image: make([]*image.Paletted, len(frames)),
+		Delay: append([]int(nil), delays...),
+	}
+	palette := color.Palette(copyPalette(d.palette))
+	var bounds image.Rectangle
+	for i, frame := range frames {
+		g.Image[i] = d.DitherPaletted(frame)
+		// Share the same palette to save memory. It's also what tells the
+		// encoder to use the global color table.
+		g.Image[i].Palette = palette
+		bounds = bounds.Union(frame.Bounds())
+	}
+	g.Config = image.Config{
+		ColorModel: palette,
+		Width:      bounds.Max.X,
+		Height:     bounds.Max.Y,
+	}
+	return g
+}
@@ -1,10 +1,18 @@
 package dither
 
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"strings"
+)
+
 // ErrorDiffusionMatrix holds the matrix for the error-diffusion type of dithering.
 // An example of this would be Floyd-Steinberg or Atkinson.
 //
 // Zero values can be used to represent pixels that have already been processed.
-// The current pixel is assumed to be the right-most zero value in the top row.
+// The current pixel is assumed to be the right-most zero value in the top row,
+// unless Ditherer.MatrixOrigin is set.
 type ErrorDiffusionMatrix [][]float32
 
 // CurrentPixel returns the index the current pixel.
@@ -34,6 +42,271 @@ func (e ErrorDiffusionMatrix) Offset(x, y, curPx int) (int, int) {
 	return x - curPx, y
 }
 
+// ScanOrder is the order pixels are processed in when diffusing error. It's
+// used by Ditherer.ScanOrder.
+type ScanOrder int
+
+const (
+	// RasterHorizontal processes each row left-to-right, from top to bottom.
+	RasterHorizontal ScanOrder = iota
+
+	// SerpentineHorizontal is like RasterHorizontal, but every other row goes
+	// right-to-left. This is the same as Ditherer.Serpentine.
+	SerpentineHorizontal
+
+	// RasterVertical processes each column top-to-bottom, from left to right.
+	RasterVertical
+
+	// SerpentineVertical is like RasterVertical, but every other column goes
+	// bottom-to-top.
+	SerpentineVertical
+
+	// Diagonal processes each anti-diagonal from bottom-left to top-right,
+	// starting at the top-left corner of the image. Error is diffused to the
+	// next anti-diagonal the way it would be to the next row.
+	Diagonal
+
+	numScanOrders
+)
+
+// ErrorDiffusionKernel is an ErrorDiffusionMatrix along with the position of
+// the current pixel inside it. Unlike a plain ErrorDiffusionMatrix, it can be
+// stored as JSON and loaded back, for example from a config file:
+//
+//     {"matrix": [[0, 0, 0.4375], [0.1875, 0.3125, 0.0625]], "origin_x": 1, "origin_y": 0}
+//
+// Use Ditherer.SetKernel to dither with it.
+//
+// When unmarshalling, the origin fields can be left out, and the current pixel
+// will be found the same way as ErrorDiffusionMatrix.CurrentPixel does.
+type ErrorDiffusionKernel struct {
+	Matrix ErrorDiffusionMatrix `json:"matrix"`
+
+	// OriginX and OriginY are the column and row of the current pixel in Matrix.
+	OriginX int `json:"origin_x"`
+	OriginY int `json:"origin_y"`
+}
+
+// Validate returns an error if the kernel can't be used for dithering. The
+// matrix must have at least one row, all rows must be the same non-zero length,
+// and the origin must be a zero value inside the matrix.
+//
+// Pixels are processed left to right and top to bottom, so the matrix also
+// can't diffuse error upward, or to the left of the current pixel in its own
+// row. Those pixels have already been set, and the error would be lost.
+func (k ErrorDiffusionKernel) Validate() error {
+	if err := k.Matrix.shape(); err != nil {
+		return err
+	}
+	if k.OriginY < 0 || k.OriginY >= len(k.Matrix) ||
+		k.OriginX < 0 || k.OriginX >= len(k.Matrix[0]) {
+		return errors.New("dither: error diffusion origin is outside the matrix")
+	}
+	if k.Matrix[k.OriginY][k.OriginX] != 0 {
+		return errors.New("dither: error diffusion origin is not a zero value")
+	}
+	if k.Matrix.diffusesBackward(k.OriginX, k.OriginY) {
+		return errors.New("dither: error diffusion matrix diffuses to processed pixels")
+	}
+	return nil
+}
+
+// shape returns an error if the matrix is empty, or if its rows aren't all the
+// same length.
+func (m ErrorDiffusionMatrix) shape() error {
+	if len(m) == 0 || len(m[0]) == 0 {
+		return errors.New("dither: error diffusion matrix is empty")
+	}
+	for _, row := range m {
+		if len(row) != len(m[0]) {
+			return errors.New("dither: error diffusion matrix is not rectangular")
+		}
+	}
+	return nil
+}
+
+// NewErrorDiffusionKernel creates a kernel from a custom matrix, where the
+// current pixel is at column originX of the first row. Unlike a plain
+// ErrorDiffusionMatrix, the current pixel doesn't have to be found by looking
+// for zeros, so any matrix works, including ones where the first row has more
+// zeros after the current pixel.
+//
+// The rows are copied, and the kernel is checked with Validate. An
+// ErrorDiffusionMatrix can't store the current pixel itself, so use the
+// returned kernel with Ditherer.SetKernel.
+func NewErrorDiffusionKernel(rows [][]float32, originX int) (ErrorDiffusionKernel, error) {
+	m := make(ErrorDiffusionMatrix, len(rows))
+	for i, row := range rows {
+		m[i] = append([]float32(nil), row...)
+	}
+	k := ErrorDiffusionKernel{Matrix: m, OriginX: originX}
+	if err := k.Validate(); err != nil {
+		return ErrorDiffusionKernel{}, err
+	}
+	return k, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The kernel is validated, see
+// Validate. If the origin isn't specified, the first row of the matrix must
+// start with zeros followed by a non-zero value, so that the current pixel can
+// be found.
+func (k *ErrorDiffusionKernel) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Matrix  ErrorDiffusionMatrix `json:"matrix"`
+		OriginX *int                 `json:"origin_x"`
+		OriginY *int                 `json:"origin_y"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	k2 := ErrorDiffusionKernel{Matrix: aux.Matrix}
+	if aux.OriginY != nil {
+		k2.OriginY = *aux.OriginY
+	}
+	if aux.OriginX != nil {
+		k2.OriginX = *aux.OriginX
+	} else if len(aux.Matrix) > 0 {
+		// Only the heuristic used by CurrentPixel can be used, so make sure
+		// it doesn't have to fall back on guessing.
+		k2.OriginX = -1
+		for i, v := range aux.Matrix[0] {
+			if v != 0 {
+				k2.OriginX = i - 1
+				break
+			}
+		}
+		if k2.OriginX < 0 {
+			return errors.New("dither: error diffusion matrix has no detectable current pixel")
+		}
+	}
+	if err := k2.Validate(); err != nil {
+		return err
+	}
+	*k = k2
+	return nil
+}
+
+// ApplyErrorDiffusion runs error diffusion over a buffer of pixels, the same
+// way the Ditherer does when Matrix is set, but each pixel is quantized by the
+// provided function instead of being matched to a palette. It's a building
+// block for experimenting with error diffusion, like trying out custom
+// quantizers, without the rest of the Ditherer.
+//
+// pix holds the pixels row by row, starting at the top left, and width is the
+// number of pixels in each row. The Ditherer uses linear RGB values, but any
+// values can be used, as long as quantize uses the same ones. quantize is
+// called for each pixel in the order they're processed, with the position of
+// the pixel and its color, including the error diffused to it so far. The
+// pixel is set to the returned color, and the difference between the two is
+// diffused to the pixels around it using the kernel. Values are rounded with
+// RoundClamp after error is added to them.
+//
+// The pixels are processed in the given order, which works like
+// Ditherer.ScanOrder.
+//
+// An error is returned if the kernel isn't valid, see Validate, if width
+// doesn't evenly divide the number of pixels, or if the order isn't valid.
+func ApplyErrorDiffusion(pix [][3]uint16, width int, k ErrorDiffusionKernel, order ScanOrder, quantize func(x, y int, r, g, b uint16) (uint16, uint16, uint16)) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+	if width <= 0 || len(pix)%width != 0 {
+		return errors.New("dither: ApplyErrorDiffusion: width doesn't evenly divide the pixels")
+	}
+	if order < 0 || order >= numScanOrders {
+		return errors.New("dither: ApplyErrorDiffusion: invalid ScanOrder")
+	}
+
+	// Quantization error of the current pixel
+	var er, eg, eb float32
+
+	b := image.Rect(0, 0, width, len(pix)/width)
+	errorDiffusion(
+		newScanner(b, order, false),
+		false, false, k.Matrix, image.Point{k.OriginX, k.OriginY},
+		func(x, y int) bool {
+			old := pix[y*width+x]
+			r, g, b := quantize(x, y, old[0], old[1], old[2])
+			pix[y*width+x] = [3]uint16{r, g, b}
+			er = float32(int32(old[0]) - int32(r))
+			eg = float32(int32(old[1]) - int32(g))
+			eb = float32(int32(old[2]) - int32(b))
+			return true
+		},
+		func(p image.Point, w float32) {
+			if !p.In(b) {
+				return
+			}
+			c := &pix[p.Y*width+p.X]
+			c[0] = RoundClamp(float32(c[0]) + er*w)
+			c[1] = RoundClamp(float32(c[1]) + eg*w)
+			c[2] = RoundClamp(float32(c[2]) + eb*w)
+		},
+	)
+	return nil
+}
+
+// errorDiffusion goes through the pixels in the order set by sc, and diffuses
+// the error of each one using the matrix, with the current pixel at origin.
+// It's the core of ApplyErrorDiffusion and the Ditherer's Matrix dithering.
+//
+// quantize is called for each pixel. If it returns true, diffuse is called for
+// each pixel the error is diffused to, with the weight from the matrix, which
+// it should multiply the error by. That includes pixels outside of the image.
+//
+// If flipLines is true the lines are processed in reverse, like bottom-to-top,
+// and if flipPos is true, the pixels along each line are, like right-to-left.
+// The matrix is reflected to match, so that error is only diffused to pixels
+// that haven't been processed yet.
+func errorDiffusion(sc scanner, flipLines, flipPos bool, matrix ErrorDiffusionMatrix, origin image.Point, quantize func(x, y int) bool, diffuse func(p image.Point, w float32)) {
+	lineMin, lineMax := sc.lines()
+	for j := lineMin; j < lineMax; j++ {
+		line := j
+		if flipLines {
+			line = lineMax - 1 - (j - lineMin)
+		}
+		// Whether this line is being done backwards, like right-to-left
+		reverse := flipPos != (sc.serpentine && line%2 == 0)
+		posMin, posMax := sc.positions(line)
+
+		for i := posMin; i < posMax; i++ {
+			pos := i
+			if reverse {
+				pos = posMax - 1 - (i - posMin)
+			}
+			x, y := sc.point(line, pos)
+			if !quantize(x, y) {
+				continue
+			}
+
+			// Diffuse error in two dimensions
+			for yy := range matrix {
+				for xx, w := range matrix[yy] {
+					if w == 0 {
+						// Skip, because it won't affect anything
+						continue
+					}
+
+					// Get the coords of the pixel the error is being applied to
+					deltaX, deltaY := xx-origin.X, yy-origin.Y
+					if reverse {
+						// Reflect the matrix horizontally because we're going right-to-left
+						// Otherwise the matrix would change pixels that have already been set
+						deltaX *= -1
+					}
+					if flipLines {
+						// Same thing, but for going bottom-to-top
+						deltaY *= -1
+					}
+					deltaX, deltaY = sc.delta(deltaY, deltaX)
+					diffuse(image.Point{x + deltaX, y + deltaY}, w)
+				}
+			}
+		}
+	}
+}
+
 // ErrorDiffusionStrength modifies an existing error diffusion matrix so that it will
 // be applied with the specified strength.
 //
@@ -60,6 +333,41 @@ func ErrorDiffusionStrength(edm ErrorDiffusionMatrix, strength float32) ErrorDif
 	return edm2
 }
 
+// sum returns the sum of all the values in the matrix.
+func (e ErrorDiffusionMatrix) sum() float32 {
+	var sum float32
+	for _, row := range e {
+		for _, v := range row {
+			sum += v
+		}
+	}
+	return sum
+}
+
+// diffusesBackward returns true if the matrix has a non-zero value above the
+// current pixel, or to the left of it in the same row. Those pixels will have
+// already been processed.
+func (e ErrorDiffusionMatrix) diffusesBackward(originX, originY int) bool {
+	for y := 0; y <= originY; y++ {
+		end := len(e[y])
+		if y == originY {
+			end = originX
+		}
+		for x := 0; x < end; x++ {
+			if e[y][x] != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalized returns a copy of the matrix scaled so its values sum to 1.
+// The sum must be positive.
+func (e ErrorDiffusionMatrix) normalized() ErrorDiffusionMatrix {
+	return ErrorDiffusionStrength(e, 1/e.sum())
+}
+
 var Simple2D = ErrorDiffusionMatrix{
 	{0, 0.5},
 	{0.5, 0},
@@ -98,6 +406,9 @@ var Burkes = ErrorDiffusionMatrix{
 	{2.0 / 32, 4.0 / 32, 8.0 / 32, 4.0 / 32, 2.0 / 32},
 }
 
+// Sierra is the original three-row matrix by Frankie Sierra, from 1989. It
+// diffuses error over a large area like JarvisJudiceNinke, but is a bit faster
+// and has slightly more contrast.
 var Sierra = ErrorDiffusionMatrix{
 	{0, 0, 0, 5.0 / 32, 3.0 / 32},
 	{2.0 / 32, 4.0 / 32, 5.0 / 32, 4.0 / 32, 2.0 / 32},
@@ -107,6 +418,8 @@ var Sierra = ErrorDiffusionMatrix{
 // Sierra3 is another name for the original Sierra matrix.
 var Sierra3 = Sierra
 
+// TwoRowSierra is Frankie Sierra's two-row version of Sierra, from 1990. It
+// produces output very similar to Sierra, while touching fewer pixels.
 var TwoRowSierra = ErrorDiffusionMatrix{
 	{0, 0, 0, 4.0 / 16, 3.0 / 16},
 	{1.0 / 16, 2.0 / 16, 3.0 / 16, 2.0 / 16, 1.0 / 16},
@@ -115,6 +428,9 @@ var TwoRowSierra = ErrorDiffusionMatrix{
 // Sierra2 is another name for TwoRowSierra
 var Sierra2 = TwoRowSierra
 
+// SierraLite is the smallest of Frankie Sierra's matrices. It is very fast,
+// but has more visible artifacts than the larger Sierra matrices, similar to
+// FloydSteinberg.
 var SierraLite = ErrorDiffusionMatrix{
 	{0, 0, 2.0 / 4},
 	{1.0 / 4, 1.0 / 4, 0},
@@ -123,6 +439,10 @@ var SierraLite = ErrorDiffusionMatrix{
 // Sierra2_4A (usually written as Sierra2-4A) is another name for SierraLite.
 var Sierra2_4A = SierraLite
 
+// SierraFilterLite is another name for SierraLite. Frankie Sierra originally
+// called it "Filter Lite".
+var SierraFilterLite = SierraLite
+
 // StevenPigeon is an error diffusion matrix developed by Steven Pigeon.
 // Source: https://hbfs.wordpress.com/2013/12/31/dithering/
 var StevenPigeon = ErrorDiffusionMatrix{
@@ -130,3 +450,50 @@ var StevenPigeon = ErrorDiffusionMatrix{
 	{0, 2.0 / 14, 2.0 / 14, 2.0 / 14, 0},
 	{1.0 / 14, 0, 1.0 / 14, 0, 1.0 / 14},
 }
+
+// AllErrorDiffusionMatrices returns a map of all the error diffusion matrices
+// in this library, keyed by lowercase hyphenated names like "floyd-steinberg".
+// Alternate names for the same matrix, like Sierra3, are not included.
+//
+// A new map is returned each time, so it is safe to modify. The matrices are
+// not copied though, and should not be modified.
+func AllErrorDiffusionMatrices() map[string]ErrorDiffusionMatrix {
+	return map[string]ErrorDiffusionMatrix{
+		"simple2d":              Simple2D,
+		"floyd-steinberg":       FloydSteinberg,
+		"false-floyd-steinberg": FalseFloydSteinberg,
+		"jarvis-judice-ninke":   JarvisJudiceNinke,
+		"atkinson":              Atkinson,
+		"stucki":                Stucki,
+		"burkes":                Burkes,
+		"sierra":                Sierra,
+		"two-row-sierra":        TwoRowSierra,
+		"sierra-lite":           SierraLite,
+		"steven-pigeon":         StevenPigeon,
+	}
+}
+
+// edmAliases maps alternate matrix names to the names used by
+// AllErrorDiffusionMatrices.
+var edmAliases = map[string]string{
+	"sierra3":            "sierra",
+	"sierra2":            "two-row-sierra",
+	"sierra2-4a":         "sierra-lite",
+	"sierra-filter-lite": "sierra-lite",
+	"filter-lite":        "sierra-lite",
+}
+
+// ErrorDiffusionMatrixByName returns the error diffusion matrix with the given
+// name, and whether it was found. Names are the ones used by
+// AllErrorDiffusionMatrices, and alternate names like "sierra3" or "sierra2-4a"
+// are accepted as well. Names are not case-sensitive.
+//
+// The returned matrix is not a copy, and should not be modified.
+func ErrorDiffusionMatrixByName(name string) (ErrorDiffusionMatrix, bool) {
+	name = strings.ToLower(name)
+	if alias, ok := edmAliases[name]; ok {
+		name = alias
+	}
+	edm, ok := AllErrorDiffusionMatrices()[name]
+	return edm, ok
+}
@@ -28,27 +28,11 @@ func main() {
 	d := dither.NewDitherer(palette)
 	d.Matrix = dither.FloydSteinberg // Why not?
 
-	// Decode first frame and get image.Config for use in gif.GIF.
-	// gif.GIF requires *image.Paletted is used, so DitherPaletted
-	// is called instead of Dither.
+	// Decode all the frames
 
-	f, err := os.Open("../input/ball_001.png")
-	if err != nil {
-		panic(err)
-	}
-	img, _, err := image.Decode(f)
-	if err != nil {
-		panic(err)
-	}
-	f.Close()
-	firstFrame, config := d.DitherPalettedConfig(img)
-
-	frames := make([]*image.Paletted, numFrames)
-	frames[0] = firstFrame
-
-	// Decode other frames
-	for i := 1; i < numFrames; i++ {
-		f, err := os.Open(fmt.Sprintf("../input/ball_0%02d.png", i))
+	frames := make([]image.Image, numFrames)
+	for i := range frames {
+		f, err := os.Open(fmt.Sprintf("../input/ball_0%02d.png", i+1))
 		if err != nil {
 			panic(err)
 		}
@@ -57,8 +41,7 @@ func main() {
 			panic(err)
 		}
 		f.Close()
-
-		frames[i] = d.DitherPaletted(img)
+		frames[i] = img
 	}
 
 	// Frame delay - same for each frame
@@ -67,23 +50,18 @@ func main() {
 		delays[i] = 7
 	}
 
-	// Setup GIF and encode
-	g := gif.GIF{
-		Image: frames,
-		Delay: delays,
-
-		// By specifying a Config, we can set a global color table for the GIF.
-		// This is more efficient then each frame having its own color table, which
-		// is the default when there's no config.
-		Config: config,
-	}
+	// Dither the frames into a GIF. gif.GIF requires *image.Paletted is used,
+	// which DitherFrames takes care of. It also sets a global color table for
+	// the GIF, which is more efficient than each frame having its own color
+	// table.
+	g := d.DitherFrames(frames, delays)
 
 	f2, err := os.Create("../output/gif_animation.gif")
 	if err != nil {
 		panic(err)
 	}
 
-	err = gif.EncodeAll(f2, &g)
+	err = gif.EncodeAll(f2, g)
 	if err != nil {
 		panic(err)
 	}
@@ -2,4 +2,7 @@ module github.com/makeworld-the-better-one/dither/v2
 
 go 1.15
 
-require github.com/stretchr/testify v1.8.4
+require (
+	github.com/stretchr/testify v1.8.4
+	golang.org/x/image v0.10.0
+)
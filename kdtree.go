@@ -0,0 +1,128 @@
+package dither
+
+import (
+	"image/color"
+	"math"
+	"sort"
+)
+
+// kdTreeMinColors is the palette size at which a k-d tree starts being faster
+// than checking every palette color.
+const kdTreeMinColors = 32
+
+// colorWeights are the channel weights used by colorDist, as floats.
+var colorWeights = [3]float64{
+	float64(lumaR) / lumaTotal, float64(lumaG) / lumaTotal, float64(lumaB) / lumaTotal,
+}
+
+// kdTree is a 3-dimensional k-d tree of linear palette colors, used to find
+// the closest palette color faster than checking every color.
+//
+// It returns the exact same results as Ditherer.closestColorLinear.
+type kdTree struct {
+	nodes   []kdNode
+	palette [][3]uint16
+}
+
+type kdNode struct {
+	// i is the palette index of the color stored in this node
+	i    int
+	axis int
+	// left and right are indexes into kdTree.nodes, or -1 if there is no child
+	left, right int
+}
+
+// newKDTree creates a kdTree of the linear palette colors. Transparent
+// palette colors are skipped.
+func newKDTree(palette []color.Color, linearPalette [][3]uint16) *kdTree {
+	t := &kdTree{
+		nodes:   make([]kdNode, 0, len(linearPalette)),
+		palette: linearPalette,
+	}
+	idxs := make([]int, 0, len(linearPalette))
+	for i := range linearPalette {
+		if !isTransparent(palette[i]) {
+			idxs = append(idxs, i)
+		}
+	}
+	t.build(idxs)
+	return t
+}
+
+// build adds the provided palette indexes to the tree, and returns the node
+// index of the root of the subtree.
+func (t *kdTree) build(idxs []int) int {
+	if len(idxs) == 0 {
+		return -1
+	}
+
+	// Split along the axis with the largest weighted spread
+	axis, spread := 0, -1.0
+	for a := 0; a < 3; a++ {
+		min, max := uint16(math.MaxUint16), uint16(0)
+		for _, i := range idxs {
+			v := t.palette[i][a]
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if s := colorWeights[a] * float64(max-min); s > spread {
+			axis, spread = a, s
+		}
+	}
+
+	sort.Slice(idxs, func(i, j int) bool {
+		return t.palette[idxs[i]][axis] < t.palette[idxs[j]][axis]
+	})
+	mid := len(idxs) / 2
+
+	n := len(t.nodes)
+	t.nodes = append(t.nodes, kdNode{i: idxs[mid], axis: axis})
+	left := t.build(idxs[:mid])
+	right := t.build(idxs[mid+1:])
+	t.nodes[n].left = left
+	t.nodes[n].right = right
+	return n
+}
+
+// nearest returns the index of the palette color closest to the provided
+// linear RGB color.
+func (t *kdTree) nearest(r, g, b uint16) int {
+	s := kdSearch{q: [3]uint16{r, g, b}, color: -1, best: math.MaxUint32}
+	t.search(&s, 0)
+	return s.color
+}
+
+// kdSearch holds the state of a search through a kdTree.
+type kdSearch struct {
+	q     [3]uint16
+	color int
+	best  uint32
+}
+
+func (t *kdTree) search(s *kdSearch, n int) {
+	node := &t.nodes[n]
+	dist := colorDist(s.q[0], s.q[1], s.q[2], t.palette[node.i])
+	if dist < s.best || (dist == s.best && node.i < s.color) {
+		s.color, s.best = node.i, dist
+	}
+
+	delta := float64(s.q[node.axis]) - float64(t.palette[node.i][node.axis])
+	near, far := node.left, node.right
+	if delta > 0 {
+		near, far = far, near
+	}
+	if near >= 0 {
+		t.search(s, near)
+	}
+
+	// Every color on the far side is at least this far away. colorDist
+	// rounds down by less than 4, so account for that. Colors at the same
+	// distance still need to be checked, in case they have a lower index.
+	if far >= 0 && colorWeights[node.axis]*delta*delta/4-4 <= float64(s.best) {
+		t.search(s, far)
+	}
+}
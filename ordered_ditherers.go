@@ -1,5 +1,13 @@
 package dither
 
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+)
+
 // This file contains matrices I've found from around the Internet. They can
 // be used with PixelMapperFromMatrix.
 
@@ -287,3 +295,279 @@ var ClusteredDotDiagonal8x8_3 = OrderedDitherMatrix{
 	},
 	Max: 32,
 }
+
+// GenerateClusteredDot generates a clustered-dot OrderedDitherMatrix that's
+// size pixels wide and tall, like the ClusteredDot matrices in this library,
+// but at any size. Larger sizes can represent more levels of gray, but the dots
+// are further apart.
+//
+// If diagonal is false, there's one dot in the center of the matrix, which
+// spirals outwards as the image gets darker. The dots form a grid, like
+// ClusteredDot4x4, which is exactly what a size of 4 returns.
+//
+// If diagonal is true, the dots are at a 45 degree angle, like
+// ClusteredDotDiagonal8x8, which is exactly what a size of 8 returns. The
+// matrix is split into four squares, with dark dots growing in the top left
+// and bottom right ones, and light dots shrinking in the others. At 50% gray,
+// that makes a checkerboard. Unlike the diagonal matrices from Ulichney's
+// book, values aren't repeated, so every one of the size*size+1 levels of gray
+// is used.
+//
+// size must be at least 1, and even if diagonal is true, otherwise the
+// function will panic.
+func GenerateClusteredDot(size int, diagonal bool) OrderedDitherMatrix {
+	if size < 1 {
+		panic("dither: GenerateClusteredDot: size must be at least 1")
+	}
+	if diagonal && size%2 != 0 {
+		panic("dither: GenerateClusteredDot: size must be even for diagonal matrices")
+	}
+
+	max := uint(size * size)
+	matrix := make([][]uint, size)
+	for y := range matrix {
+		matrix[y] = make([]uint, size)
+	}
+	if !diagonal {
+		for i, p := range spiralOrder(size) {
+			matrix[p.Y][p.X] = uint(i)
+		}
+		return OrderedDitherMatrix{Matrix: matrix, Max: max}
+	}
+
+	half := size / 2
+	for i, p := range spiralOrder(half) {
+		// Both dark dots grow at the same time, and so do both light dots.
+		// The light dots are flipped along the diagonal, the same way they
+		// are in ClusteredDotDiagonal8x8.
+		v := uint(2 * i)
+		fx, fy := half-1-p.Y, half-1-p.X
+		matrix[p.Y][p.X] = v
+		matrix[p.Y+half][p.X+half] = v + 1
+		matrix[fy][fx+half] = max - 1 - v
+		matrix[fy+half][fx] = max - 2 - v
+	}
+	return OrderedDitherMatrix{Matrix: matrix, Max: max}
+}
+
+// spiralOrder returns the positions in a size*size square, sorted by their
+// distance from its center. Positions at the same distance go clockwise.
+func spiralOrder(size int) []image.Point {
+	c := float64(size-1) / 2
+	points := make([]image.Point, 0, size*size)
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			points = append(points, image.Point{x, y})
+		}
+	}
+	dist := func(p image.Point) float64 {
+		dx, dy := float64(p.X)-c, float64(p.Y)-c
+		return dx*dx + dy*dy
+	}
+	angle := func(p image.Point) float64 {
+		// y goes down, so this increases clockwise
+		return math.Atan2(float64(p.Y)-c, float64(p.X)-c)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if di, dj := dist(points[i]), dist(points[j]); di != dj {
+			return di < dj
+		}
+		return angle(points[i]) < angle(points[j])
+	})
+	return points
+}
+
+// AllOrderedDitherMatrices returns a map of all the ordered dither matrices in
+// this library, keyed by lowercase hyphenated names like "clustered-dot-4x4".
+//
+// A new map is returned each time, so it is safe to modify. The matrices are
+// not copied though, and should not be modified.
+func AllOrderedDitherMatrices() map[string]OrderedDitherMatrix {
+	return map[string]OrderedDitherMatrix{
+		"clustered-dot-4x4":             ClusteredDot4x4,
+		"clustered-dot-diagonal-8x8":    ClusteredDotDiagonal8x8,
+		"vertical-5x3":                  Vertical5x3,
+		"horizontal-3x5":                Horizontal3x5,
+		"clustered-dot-diagonal-6x6":    ClusteredDotDiagonal6x6,
+		"clustered-dot-diagonal-8x8-2":  ClusteredDotDiagonal8x8_2,
+		"clustered-dot-diagonal-16x16":  ClusteredDotDiagonal16x16,
+		"clustered-dot-6x6":             ClusteredDot6x6,
+		"clustered-dot-spiral-5x5":      ClusteredDotSpiral5x5,
+		"clustered-dot-horizontal-line": ClusteredDotHorizontalLine,
+		"clustered-dot-vertical-line":   ClusteredDotVerticalLine,
+		"clustered-dot-8x8":             ClusteredDot8x8,
+		"clustered-dot-6x6-2":           ClusteredDot6x6_2,
+		"clustered-dot-6x6-3":           ClusteredDot6x6_3,
+		"clustered-dot-diagonal-8x8-3":  ClusteredDotDiagonal8x8_3,
+	}
+}
+
+// OrderedDitherMatrixByName returns the ordered dither matrix with the given
+// name, and whether it was found. Names are the ones used by
+// AllOrderedDitherMatrices, and are not case-sensitive.
+//
+// The returned matrix is not a copy, and should not be modified.
+func OrderedDitherMatrixByName(name string) (OrderedDitherMatrix, bool) {
+	odm, ok := AllOrderedDitherMatrices()[strings.ToLower(name)]
+	return odm, ok
+}
+
+// transformed returns a copy of the matrix with w columns and h rows, where the
+// value at (x, y) is taken from the value at f(x, y) in odm. Max is kept.
+func (odm OrderedDitherMatrix) transformed(w, h int, f func(x, y int) (int, int)) OrderedDitherMatrix {
+	m := make([][]uint, h)
+	for y := range m {
+		m[y] = make([]uint, w)
+		for x := range m[y] {
+			xx, yy := f(x, y)
+			m[y][x] = odm.Matrix[yy][xx]
+		}
+	}
+	return OrderedDitherMatrix{Matrix: m, Max: odm.Max}
+}
+
+// FlipH returns a copy of the matrix flipped horizontally, so each row is
+// reversed.
+func FlipH(odm OrderedDitherMatrix) OrderedDitherMatrix {
+	w, h := len(odm.Matrix[0]), len(odm.Matrix)
+	return odm.transformed(w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+}
+
+// FlipV returns a copy of the matrix flipped vertically, so the rows are in
+// reverse order.
+func FlipV(odm OrderedDitherMatrix) OrderedDitherMatrix {
+	w, h := len(odm.Matrix[0]), len(odm.Matrix)
+	return odm.transformed(w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+}
+
+// Rotate90 returns a copy of the matrix rotated 90 degrees clockwise. The
+// width and height are swapped.
+func Rotate90(odm OrderedDitherMatrix) OrderedDitherMatrix {
+	w, h := len(odm.Matrix[0]), len(odm.Matrix)
+	return odm.transformed(h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+}
+
+// Transpose returns a copy of the matrix with the rows and columns swapped.
+// This is how Horizontal3x5 and ClusteredDotVerticalLine were made from
+// Vertical5x3 and ClusteredDotHorizontalLine.
+func Transpose(odm OrderedDitherMatrix) OrderedDitherMatrix {
+	w, h := len(odm.Matrix[0]), len(odm.Matrix)
+	return odm.transformed(h, w, func(x, y int) (int, int) { return y, x })
+}
+
+// Scale returns a copy of the matrix with each value repeated n times in both
+// directions, so it's n times as wide and tall. When dithering, this makes
+// the dots n times larger, for a chunkier look. Unlike a larger matrix, no new
+// threshold values are added, so there are no extra levels of gray.
+//
+// n must be at least 1, otherwise the function will panic.
+func Scale(odm OrderedDitherMatrix, n int) OrderedDitherMatrix {
+	if n < 1 {
+		panic("dither: Scale: n must be at least 1")
+	}
+	w, h := len(odm.Matrix[0]), len(odm.Matrix)
+	return odm.transformed(w*n, h*n, func(x, y int) (int, int) { return x / n, y / n })
+}
+
+// ToImage returns the matrix as a grayscale image, with one pixel for each
+// value, which is useful for looking at custom or generated matrices. The
+// value v becomes the gray (v+1)/Max, the same threshold PixelMapperFromMatrix
+// uses, so 0 is the darkest and Max-1 is white. Values that are too large are
+// also white.
+func (odm OrderedDitherMatrix) ToImage() *image.Gray16 {
+	img := image.NewGray16(image.Rect(0, 0, len(odm.Matrix[0]), len(odm.Matrix)))
+	for y, row := range odm.Matrix {
+		for x, v := range row {
+			g := uint64(v+1) * 65535 / uint64(odm.Max)
+			if g > 65535 {
+				g = 65535
+			}
+			img.SetGray16(x, y, color.Gray16{uint16(g)})
+		}
+	}
+	return img
+}
+
+// Halftone generates an OrderedDitherMatrix for round-dot halftoning, like
+// printers use. Dots are placed in a grid of square cells, size pixels wide,
+// which is rotated by angle degrees. Like the other clustered-dot matrices, the
+// dots grow from the center of each cell as the image gets darker.
+//
+// The returned matrix can be used with PixelMapperFromMatrix.
+//
+// An angle of 0 returns a size*size matrix. Other angles need a larger matrix
+// to tile seamlessly, and the angle and size have to be approximated so that
+// the corners of the cells land exactly on pixels. For example, a 45 degree
+// angle with a size of 4 actually uses cells that are about 4.24 pixels wide,
+// and returns a 6x6 matrix with two dots. Angles that aren't "nice", like 15
+// degrees, can return very large matrices, especially with larger sizes.
+//
+// The angle is in degrees, and only angles between 0 and 90 are different,
+// because the grid is square. Other angles are moved into that range.
+//
+// size must be at least 1, otherwise the function will panic.
+func Halftone(size int, angle float64) OrderedDitherMatrix {
+	if size < 1 {
+		panic("dither: Halftone: size must be at least 1")
+	}
+
+	angle = math.Mod(angle, 90)
+	if angle < 0 {
+		angle += 90
+	}
+	rad := angle * math.Pi / 180
+
+	// The cell grid is defined by the vectors (a, b) and (-b, a). They're
+	// rounded to integers so that the grid repeats over whole pixels.
+	a := int(math.Round(float64(size) * math.Cos(rad)))
+	b := int(math.Round(float64(size) * math.Sin(rad)))
+	if a == 0 && b == 0 {
+		a = 1
+	}
+	if a == 0 {
+		// 90 degrees, which is the same as 0
+		a, b = b, 0
+	}
+
+	// The grid repeats horizontally and vertically every n/gcd(a, b) pixels.
+	n := a*a + b*b
+	g, h := a, b
+	for h != 0 {
+		g, h = h, g%h
+	}
+	dim := n / g
+
+	type cell struct {
+		x, y int
+		dist float64
+	}
+	cells := make([]cell, 0, dim*dim)
+	for y := 0; y < dim; y++ {
+		for x := 0; x < dim; x++ {
+			// Position of the pixel center in the rotated grid, in cells
+			px, py := float64(x)+0.5, float64(y)+0.5
+			u := (float64(a)*px + float64(b)*py) / float64(n)
+			v := (-float64(b)*px + float64(a)*py) / float64(n)
+			// Distance from the center of the cell, in the range [-1, 1]
+			cu := 2*(u-math.Floor(u)) - 1
+			cv := 2*(v-math.Floor(v)) - 1
+			cells = append(cells, cell{x, y, cu*cu + cv*cv})
+		}
+	}
+	// Pixels closest to a cell center are darkened first
+	sort.SliceStable(cells, func(i, j int) bool {
+		return cells[i].dist < cells[j].dist
+	})
+
+	matrix := make([][]uint, dim)
+	for y := range matrix {
+		matrix[y] = make([]uint, dim)
+	}
+	for i, c := range cells {
+		matrix[c.y][c.x] = uint(i)
+	}
+	return OrderedDitherMatrix{
+		Matrix: matrix,
+		Max:    uint(dim * dim),
+	}
+}
@@ -0,0 +1,104 @@
+package dither
+
+import (
+	"image"
+	"image/color"
+)
+
+// PalettedLarge is like *image.Paletted, but each pixel is a uint16 index
+// into the palette instead of a uint8, so the palette can have up to 65536
+// colors. It is returned by DitherPalettedLarge.
+type PalettedLarge struct {
+	// Pix holds the image's pixels, as palette indices. The pixel at
+	// (x, y) starts at Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)*1].
+	Pix []uint16
+	// Stride is the Pix stride (in pixels, not bytes) between vertically
+	// adjacent pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+	// Palette is the image's palette.
+	Palette color.Palette
+}
+
+// NewPalettedLarge returns a new PalettedLarge image with the given bounds and
+// palette.
+func NewPalettedLarge(r image.Rectangle, p color.Palette) *PalettedLarge {
+	w, h := r.Dx(), r.Dy()
+	if w < 0 || h < 0 {
+		w, h = 0, 0
+	}
+	return &PalettedLarge{
+		Pix:     make([]uint16, w*h),
+		Stride:  w,
+		Rect:    r,
+		Palette: p,
+	}
+}
+
+func (p *PalettedLarge) ColorModel() color.Model { return p.Palette }
+
+func (p *PalettedLarge) Bounds() image.Rectangle { return p.Rect }
+
+func (p *PalettedLarge) At(x, y int) color.Color {
+	if len(p.Palette) == 0 {
+		return nil
+	}
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return p.Palette[0]
+	}
+	i := p.PixOffset(x, y)
+	return p.Palette[p.Pix[i]]
+}
+
+// PixOffset returns the index of the element of Pix that corresponds to the
+// pixel at (x, y).
+func (p *PalettedLarge) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
+
+// Set sets the pixel at (x, y) to the palette color closest to c.
+func (p *PalettedLarge) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	i := p.PixOffset(x, y)
+	p.Pix[i] = uint16(p.Palette.Index(c))
+}
+
+func (p *PalettedLarge) ColorIndexAt(x, y int) uint16 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	i := p.PixOffset(x, y)
+	return p.Pix[i]
+}
+
+func (p *PalettedLarge) SetColorIndex(x, y int, index uint16) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	i := p.PixOffset(x, y)
+	p.Pix[i] = index
+}
+
+// SubImage returns an image representing the portion of the image p visible
+// through r. The returned value shares pixels with the original image.
+func (p *PalettedLarge) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	// If r1 and r2 are Rectangles, r1.Intersect(r2) is not guaranteed to be inside
+	// either r1 or r2 if the intersection is empty. Without explicitly checking for
+	// this, the Pix[i:] expression below can panic.
+	if r.Empty() {
+		return &PalettedLarge{
+			Palette: p.Palette,
+		}
+	}
+	i := p.PixOffset(r.Min.X, r.Min.Y)
+	return &PalettedLarge{
+		Pix:     p.Pix[i:],
+		Stride:  p.Stride,
+		Rect:    r,
+		Palette: p.Palette,
+	}
+}
@@ -0,0 +1,593 @@
+package dither
+
+// This file contains functions for creating a palette from an image, also
+// known as color quantization, and for cleaning up palettes.
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// histColor is a linear RGB color, and how many pixels in an image have it.
+type histColor struct {
+	c     [3]uint16
+	count int
+}
+
+// histogram returns all the distinct linear RGB colors in the image, and how
+// many pixels have each color. Fully transparent pixels are skipped.
+func histogram(img image.Image) []histColor {
+	counts := make(map[[3]uint16]int)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, a := unpremultAndLinearize(img.At(x, y), TransferSRGB)
+			if a == 0 {
+				continue
+			}
+			counts[[3]uint16{r, g, b}]++
+		}
+	}
+
+	hist := make([]histColor, 0, len(counts))
+	for c, n := range counts {
+		hist = append(hist, histColor{c, n})
+	}
+	// Map iteration order is random, so sort to keep results deterministic
+	sort.Slice(hist, func(i, j int) bool {
+		a, b := hist[i].c, hist[j].c
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		if a[1] != b[1] {
+			return a[1] < b[1]
+		}
+		return a[2] < b[2]
+	})
+	return hist
+}
+
+// linearToColor converts a linear RGB color to an opaque 8-bit sRGB color.
+func linearToColor(r, g, b uint16) color.RGBA {
+	// Convert 16-bit values to 8-bit, with rounding
+	to8 := func(v uint16) uint8 {
+		return uint8((uint32(delinearize65535(v)) + 128) / 257)
+	}
+	return color.RGBA{to8(r), to8(g), to8(b), 255}
+}
+
+// MedianCut returns a palette of up to n colors that represent the image well,
+// using the median cut algorithm. The palette can then be passed to
+// NewDitherer.
+//
+// Colors are split into boxes in linear RGB space, with each channel weighted
+// like they are when the Ditherer compares colors. The box with the largest
+// range is split in half at its median, until there are n boxes. Each palette
+// color is the average of the colors in a box.
+//
+// Fully transparent pixels are ignored. If the image has fewer than n distinct
+// colors, fewer colors are returned. If n is less than 1 or the image is fully
+// transparent, nil is returned.
+//
+// The returned colors are always of the type color.RGBA, and are opaque.
+func MedianCut(img image.Image, n int) []color.Color {
+	if n < 1 {
+		return nil
+	}
+	hist := histogram(img)
+	if len(hist) == 0 {
+		return nil
+	}
+
+	boxes := [][]histColor{hist}
+	for len(boxes) < n {
+		// Find the box with the largest range in any channel
+		box, channel, best := -1, 0, 0.0
+		for i, bx := range boxes {
+			if len(bx) < 2 {
+				// Can't be split
+				continue
+			}
+			ch, rng := boxRange(bx)
+			if box == -1 || rng > best {
+				box, channel, best = i, ch, rng
+			}
+		}
+		if box == -1 {
+			// All boxes have a single color
+			break
+		}
+
+		bx := boxes[box]
+		sort.SliceStable(bx, func(i, j int) bool {
+			return bx[i].c[channel] < bx[j].c[channel]
+		})
+
+		// Split at the median pixel, but make sure both halves have a color
+		total := 0
+		for _, hc := range bx {
+			total += hc.count
+		}
+		split, sum := 1, 0
+		for i, hc := range bx {
+			sum += hc.count
+			if sum*2 >= total {
+				split = i + 1
+				break
+			}
+		}
+		if split >= len(bx) {
+			split = len(bx) - 1
+		}
+
+		boxes[box] = bx[:split]
+		boxes = append(boxes, bx[split:])
+	}
+
+	palette := make([]color.Color, len(boxes))
+	for i, bx := range boxes {
+		var sums [3]uint64
+		total := uint64(0)
+		for _, hc := range bx {
+			for ch := 0; ch < 3; ch++ {
+				sums[ch] += uint64(hc.c[ch]) * uint64(hc.count)
+			}
+			total += uint64(hc.count)
+		}
+		palette[i] = linearToColor(
+			uint16((sums[0]+total/2)/total),
+			uint16((sums[1]+total/2)/total),
+			uint16((sums[2]+total/2)/total),
+		)
+	}
+	return palette
+}
+
+// boxRange returns the channel with the largest weighted range of values in
+// the box, and that range.
+func boxRange(bx []histColor) (int, float64) {
+	min := bx[0].c
+	max := bx[0].c
+	for _, hc := range bx[1:] {
+		for ch := 0; ch < 3; ch++ {
+			if hc.c[ch] < min[ch] {
+				min[ch] = hc.c[ch]
+			}
+			if hc.c[ch] > max[ch] {
+				max[ch] = hc.c[ch]
+			}
+		}
+	}
+	channel, rng := 0, -1.0
+	for ch := 0; ch < 3; ch++ {
+		if r := colorWeights[ch] * float64(max[ch]-min[ch]); r > rng {
+			channel, rng = ch, r
+		}
+	}
+	return channel, rng
+}
+
+// KMeansPalette returns a palette of up to k colors that represent the image
+// well, using k-means clustering. This is slower than MedianCut, but usually
+// creates palettes that look better.
+//
+// Colors are clustered in linear RGB space, with each channel weighted like
+// they are when the Ditherer compares colors. The starting centers are chosen
+// with k-means++, using a random number generator seeded with seed, and then
+// refined for the given number of iterations. The same inputs always return
+// the same palette. If a cluster ever ends up empty, its center is moved to
+// the color furthest from its own center.
+//
+// Fully transparent pixels are ignored. If the image has k or fewer distinct
+// colors, those colors are returned. If k is less than 1 or the image is fully
+// transparent, nil is returned.
+//
+// The returned colors are always of the type color.RGBA, and are opaque.
+func KMeansPalette(img image.Image, k int, iterations int, seed int64) []color.Color {
+	if k < 1 {
+		return nil
+	}
+	hist := histogram(img)
+	if len(hist) == 0 {
+		return nil
+	}
+	if len(hist) <= k {
+		palette := make([]color.Color, len(hist))
+		for i, hc := range hist {
+			palette[i] = linearToColor(hc.c[0], hc.c[1], hc.c[2])
+		}
+		return palette
+	}
+
+	centers := kMeansPlusPlus(hist, k, rand.New(rand.NewSource(seed)))
+	assign := make([]int, len(hist))
+	dists := make([]float64, len(hist))
+
+	for it := 0; it < iterations; it++ {
+		// Assign each color to its closest center
+		changed := false
+		for i, hc := range hist {
+			best, bestDist := 0, math.Inf(1)
+			for j, cen := range centers {
+				if d := weightedDist(hc.c, cen); d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+			if it == 0 || assign[i] != best {
+				changed = true
+			}
+			assign[i] = best
+			dists[i] = bestDist
+		}
+		if !changed {
+			break
+		}
+
+		// Move each center to the mean of its colors
+		sums := make([][3]float64, k)
+		counts := make([]float64, k)
+		for i, hc := range hist {
+			n := float64(hc.count)
+			for ch := 0; ch < 3; ch++ {
+				sums[assign[i]][ch] += float64(hc.c[ch]) * n
+			}
+			counts[assign[i]] += n
+		}
+		for j := range centers {
+			if counts[j] == 0 {
+				// Empty cluster, reseed it with the worst fitting color
+				far := 0
+				for i := range dists {
+					if dists[i] > dists[far] {
+						far = i
+					}
+				}
+				centers[j] = toFloatColor(hist[far].c)
+				dists[far] = 0
+				continue
+			}
+			for ch := 0; ch < 3; ch++ {
+				centers[j][ch] = sums[j][ch] / counts[j]
+			}
+		}
+	}
+
+	palette := make([]color.Color, k)
+	for j, cen := range centers {
+		palette[j] = linearToColor(
+			uint16(math.Round(cen[0])),
+			uint16(math.Round(cen[1])),
+			uint16(math.Round(cen[2])),
+		)
+	}
+	return palette
+}
+
+// kMeansPlusPlus chooses k starting centers from the histogram colors. Each
+// center is picked randomly, weighted by the pixel count and the distance
+// from the closest center already picked.
+func kMeansPlusPlus(hist []histColor, k int, rng *rand.Rand) [][3]float64 {
+	total := 0
+	for _, hc := range hist {
+		total += hc.count
+	}
+	// Pick the first center by pixel count alone
+	pick := rng.Intn(total)
+	first := 0
+	for i, hc := range hist {
+		pick -= hc.count
+		if pick < 0 {
+			first = i
+			break
+		}
+	}
+
+	centers := make([][3]float64, 1, k)
+	centers[0] = toFloatColor(hist[first].c)
+	dists := make([]float64, len(hist))
+	for i, hc := range hist {
+		dists[i] = weightedDist(hc.c, centers[0])
+	}
+
+	for len(centers) < k {
+		sum := 0.0
+		for i, hc := range hist {
+			sum += dists[i] * float64(hc.count)
+		}
+		next := -1
+		if sum > 0 {
+			target := rng.Float64() * sum
+			for i, hc := range hist {
+				target -= dists[i] * float64(hc.count)
+				if target < 0 && dists[i] > 0 {
+					next = i
+					break
+				}
+			}
+		}
+		if next == -1 {
+			// Rounding errors, pick the furthest color instead
+			next = 0
+			for i := range dists {
+				if dists[i] > dists[next] {
+					next = i
+				}
+			}
+		}
+
+		cen := toFloatColor(hist[next].c)
+		centers = append(centers, cen)
+		for i, hc := range hist {
+			if d := weightedDist(hc.c, cen); d < dists[i] {
+				dists[i] = d
+			}
+		}
+	}
+	return centers
+}
+
+// weightedDist is colorDist for a float color.
+func weightedDist(c [3]uint16, cen [3]float64) float64 {
+	dist := 0.0
+	for ch := 0; ch < 3; ch++ {
+		d := float64(c[ch]) - cen[ch]
+		dist += colorWeights[ch] * d * d
+	}
+	return dist
+}
+
+func toFloatColor(c [3]uint16) [3]float64 {
+	return [3]float64{float64(c[0]), float64(c[1]), float64(c[2])}
+}
+
+// PopularityPalette returns a palette of up to n colors, made of the most
+// common colors in the image. Each channel of each pixel is reduced to the
+// given number of bits, which must be between 1 and 8, to group similar colors
+// together into buckets. The n buckets with the most pixels are returned, each
+// as the average color of its pixels.
+//
+// This is much faster than MedianCut and KMeansPalette, but colors that only
+// appear in small parts of the image are left out, even if they stand out.
+// It works well enough for many images though, especially ones with large
+// areas of flat color. Fewer bits make for bigger buckets, which helps
+// images with gradients and noise. 5 is a good default.
+//
+// Fully transparent pixels are ignored. If there are fewer than n buckets,
+// fewer colors are returned. If n is less than 1 or the image is fully
+// transparent, nil is returned.
+//
+// The returned colors are always of the type color.RGBA, and are opaque.
+func PopularityPalette(img image.Image, n int, bits int) []color.Color {
+	if bits < 1 || bits > 8 {
+		panic("dither: PopularityPalette: bits must be between 1 and 8")
+	}
+	if n < 1 {
+		return nil
+	}
+
+	type bucket struct {
+		key   uint32
+		sums  [3]uint64
+		count uint64
+	}
+	buckets := make(map[uint32]*bucket)
+	shift := uint(8 - bits)
+
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			key := uint32(c.R>>shift)<<16 | uint32(c.G>>shift)<<8 | uint32(c.B>>shift)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{key: key}
+				buckets[key] = bk
+			}
+			// Average in linear RGB, like the other palette functions
+			bk.sums[0] += uint64(TransferSRGB.linearize255to65535(c.R))
+			bk.sums[1] += uint64(TransferSRGB.linearize255to65535(c.G))
+			bk.sums[2] += uint64(TransferSRGB.linearize255to65535(c.B))
+			bk.count++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].count != sorted[j].count {
+			return sorted[i].count > sorted[j].count
+		}
+		// Keep results deterministic
+		return sorted[i].key < sorted[j].key
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	if len(sorted) == 0 {
+		return nil
+	}
+
+	palette := make([]color.Color, len(sorted))
+	for i, bk := range sorted {
+		palette[i] = linearToColor(
+			uint16((bk.sums[0]+bk.count/2)/bk.count),
+			uint16((bk.sums[1]+bk.count/2)/bk.count),
+			uint16((bk.sums[2]+bk.count/2)/bk.count),
+		)
+	}
+	return palette
+}
+
+// DedupePalette returns a copy of the palette with duplicate colors removed.
+// With a tolerance of 0, only exact duplicates are removed. Otherwise, opaque
+// colors are also removed if they're within the tolerance of a color that's
+// kept, which is useful for palettes put together from different sources.
+// Duplicates take up palette slots, and can make functions like Quantize
+// think palettes are different when they aren't.
+//
+// The tolerance uses the same distance the Ditherer uses to compare colors,
+// which is the squared Euclidean distance in linear RGB, with each channel
+// weighted by how much it contributes to luminance. It's scaled so that two
+// grays whose linear values are v apart, in the range [0, 65535], have a
+// distance of v*v/4.
+//
+// The first of the colors that are merged is the one kept, so the order of
+// the palette matters. Colors aren't changed or averaged, and they keep their
+// order. All fully transparent colors count as duplicates of each other.
+func DedupePalette(p []color.Color, tolerance uint32) []color.Color {
+	kept := make([]color.Color, 0, len(p))
+	// Linear versions of the kept colors, for opaque colors only
+	var linear [][3]uint16
+	transparent := false
+
+	for _, c := range p {
+		c64 := color.RGBA64Model.Convert(c).(color.RGBA64)
+		if c64.A == 0 {
+			if !transparent {
+				transparent = true
+				kept = append(kept, c)
+			}
+			continue
+		}
+
+		dupe := false
+		for _, k := range kept {
+			if color.RGBA64Model.Convert(k).(color.RGBA64) == c64 {
+				dupe = true
+				break
+			}
+		}
+		if !dupe && tolerance > 0 && c64.A == 0xffff {
+			r, g, b := toLinearRGB(c64, TransferSRGB)
+			for _, l := range linear {
+				if colorDist(r, g, b, l) <= tolerance {
+					dupe = true
+					break
+				}
+			}
+			if !dupe {
+				linear = append(linear, [3]uint16{r, g, b})
+			}
+		}
+		if !dupe {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// luminanceOrder returns the indexes of the palette colors, sorted by
+// LinearLuminance from dark to light. Fully transparent colors come first, and
+// colors with the same luminance keep their order.
+func luminanceOrder(p []color.Color) []int {
+	order := make([]int, len(p))
+	lums := make([]int, len(p))
+	for i, c := range p {
+		order[i] = i
+		if isTransparent(c) {
+			lums[i] = -1
+		} else {
+			lums[i] = int(LinearLuminance(SRGBToLinear(c)))
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return lums[order[i]] < lums[order[j]] })
+	return order
+}
+
+// SortPaletteByLuminance returns a copy of the palette sorted from dark to
+// light, using LinearLuminance. Fully transparent colors come first. Colors
+// with the same luminance keep their order, and the colors themselves aren't
+// changed.
+//
+// This is useful for showing palettes, and for anything that needs the
+// palette colors in order of brightness, like the ramp for ToASCII.
+func SortPaletteByLuminance(p []color.Color) []color.Color {
+	sorted := make([]color.Color, len(p))
+	for i, j := range luminanceOrder(p) {
+		sorted[i] = p[j]
+	}
+	return sorted
+}
+
+// grayChroma is the Oklab chroma below which SortPaletteByHue treats colors as
+// gray.
+const grayChroma = 0.01
+
+// SortPaletteByHue returns a copy of the palette sorted by hue, which is
+// usually the nicest way to show a palette. The hue is the angle in Oklab,
+// which goes from pinkish red through orange, yellow, green, and blue, and back
+// to purple.
+//
+// Fully transparent colors come first, then grays and nearly gray colors from
+// dark to light, and then the rest by hue. Colors that tie keep their order,
+// and the colors themselves aren't changed.
+func SortPaletteByHue(p []color.Color) []color.Color {
+	type key struct {
+		group int // 0 for transparent, 1 for gray, 2 for everything else
+		hue   float64
+		lum   uint16
+	}
+	keys := make([]key, len(p))
+	order := make([]int, len(p))
+	for i, c := range p {
+		order[i] = i
+		if isTransparent(c) {
+			continue
+		}
+		r, g, b := SRGBToLinear(c)
+		lab := linearToOklab(r, g, b)
+		keys[i].lum = LinearLuminance(r, g, b)
+		if math.Hypot(float64(lab[1]), float64(lab[2])) < grayChroma {
+			keys[i].group = 1
+			continue
+		}
+		keys[i].group = 2
+		keys[i].hue = math.Atan2(float64(lab[2]), float64(lab[1]))
+		if keys[i].hue < 0 {
+			keys[i].hue += 2 * math.Pi
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := keys[order[i]], keys[order[j]]
+		if a.group != b.group {
+			return a.group < b.group
+		}
+		if a.group == 1 {
+			return a.lum < b.lum
+		}
+		return a.hue < b.hue
+	})
+
+	sorted := make([]color.Color, len(p))
+	for i, j := range order {
+		sorted[i] = p[j]
+	}
+	return sorted
+}
+
+// GrayPalette returns a palette of n grays from black to white, evenly spaced
+// in linear light. That's how the Ditherer mixes colors, so each step adds the
+// same amount of light to a dithered image. Grays that are evenly spaced in
+// sRGB, like most hand-made ramps, have steps that are too small in the dark
+// end and too big in the light end.
+//
+// The colors are of the type color.Gray16, so that they're spaced exactly. The
+// function will panic if n is less than 2.
+func GrayPalette(n int) []color.Color {
+	if n < 2 {
+		panic("dither: GrayPalette: n must be at least 2")
+	}
+	p := make([]color.Color, n)
+	for i := range p {
+		p[i] = color.Gray16{delinearize65535(uint16((i*65535 + (n-1)/2) / (n - 1)))}
+	}
+	return p
+}
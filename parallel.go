@@ -12,7 +12,13 @@ import (
 // image up horizontally depending on the number of workers.
 //
 // Setting numWorkers to 0 or below will result in runtime.GOMAXPROCS(0) workers being used.
-func parallel(workers int, dst draw.Image, src image.Image, f func(x, y int, c color.Color) color.Color) {
+//
+// If serpentine is true, each worker goes right-to-left on every other line,
+// like error diffusion does.
+//
+// If newState isn't nil, it's called once for each worker, and the returned
+// value is passed to every call of f by that worker. Otherwise f gets nil.
+func parallel(workers int, serpentine bool, dst draw.Image, src image.Image, newState func() interface{}, f func(state interface{}, x, y int, c color.Color) color.Color) {
 	if workers <= 0 {
 		workers = runtime.GOMAXPROCS(0)
 	}
@@ -21,9 +27,19 @@ func parallel(workers int, dst draw.Image, src image.Image, f func(x, y int, c c
 	height := b.Dy()
 
 	worker := func(minY, maxY int) {
+		var state interface{}
+		if newState != nil {
+			state = newState()
+		}
 		for y := minY; y < maxY; y++ {
+			if serpentine && y%2 == 0 {
+				for x := b.Max.X - 1; x >= b.Min.X; x-- {
+					dst.Set(x, y, f(state, x, y, src.At(x, y)))
+				}
+				continue
+			}
 			for x := b.Min.X; x < b.Max.X; x++ {
-				dst.Set(x, y, f(x, y, src.At(x, y)))
+				dst.Set(x, y, f(state, x, y, src.At(x, y)))
 			}
 		}
 	}
@@ -1,7 +1,10 @@
 package dither
 
 import (
+	"errors"
 	"math/rand"
+	"sort"
+	"sync"
 )
 
 // PixelMapper is a function that takes the coordinate and color of a pixel,
@@ -15,11 +18,29 @@ import (
 // The provided RGB values are in the linear RGB space, and the returned values
 // must be as well. All dithering operations should be happening in this space
 // anyway, so this is done as a convenience. The RGB values are in the range
-// [0, 65535], and must be returned in the same range.
+// [0, 65535], and must be returned in the same range. LinearToSRGB and
+// SRGBToLinear can be used to convert between this space and sRGB.
 //
 // It must be thread-safe, as it will be called concurrently.
 type PixelMapper func(x, y int, r, g, b uint16) (uint16, uint16, uint16)
 
+// StatefulPixelMapper is like PixelMapper, but it can keep state for each
+// worker that's dithering the image, like a buffer or a random number
+// generator. This makes it possible to write fast mappers that don't need
+// locks. It's used by setting Ditherer.StatefulMapper.
+//
+// NewState is called once by each worker, before it starts mapping pixels.
+// Then Map is called for each pixel, with the state of the worker. Map works
+// the same way as a PixelMapper, and it must be thread-safe as well, but each
+// state value will only be used by one goroutine at a time.
+//
+// Each worker dithers a horizontal band of the image, from top to bottom.
+// With SingleThreaded there's only one worker.
+type StatefulPixelMapper interface {
+	NewState() interface{}
+	Map(state interface{}, x, y int, r, g, b uint16) (uint16, uint16, uint16)
+}
+
 // RandomNoiseGrayscale returns a PixelMapper that adds random noise to the
 // color before returning. This is the simplest form of dithering.
 //
@@ -30,6 +51,10 @@ type PixelMapper func(x, y int, r, g, b uint16) (uint16, uint16, uint16)
 //
 //     rand.Seed(time.Now().UnixNano())
 //
+// The random numbers are used in a different order each time, unless the
+// Ditherer has SingleThreaded set. For output that's the same each time and
+// can still be dithered in parallel, use RandomNoiseGrayscaleParallel.
+//
 // The noise added to each channel will be randomly chosen from within the range
 // of min (inclusive) and max (exclusive). To simplify things, you can consider
 // valid color values to range from 0 to 1. This means if you wanted the noise to
@@ -51,14 +76,7 @@ type PixelMapper func(x, y int, r, g, b uint16) (uint16, uint16, uint16)
 // distorting the image in an unexpected way.
 func RandomNoiseGrayscale(min, max float32) PixelMapper {
 	return PixelMapper(func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
-		// These values were taken from Wikipedia:
-		// https://en.wikipedia.org/wiki/Grayscale#Colorimetric_(perceptual_luminance-preserving)_conversion_to_grayscale
-		// 0.2126, 0.7152, 0.0722
-		// Then multiplied by 65535, to scale them for 16-bit color.
-		// Note that 13933 + 46871 + 4732 = 65536
-		//
-		// Basically, this takes linear RGB and gives a linear gray.
-		gray := (13933*uint32(r) + 46871*uint32(g) + 4732*uint32(b) + 1<<15) >> 16
+		gray := LinearLuminance(r, g, b)
 
 		new := RoundClamp(float32(gray) + 65535.0*(rand.Float32()*(max-min)+min))
 		return new, new, new
@@ -82,6 +100,125 @@ func RandomNoiseRGB(minR, maxR, minG, maxG, minB, maxB float32) PixelMapper {
 	})
 }
 
+// RandomNoiseGrayscaleSeeded is like RandomNoiseGrayscale, but it gets random
+// numbers from the provided rng instead of the global source. That means
+// rand.Seed doesn't need to be called, and the global source isn't affected.
+//
+// The PixelMapper is thread-safe, because access to rng is guarded by a mutex.
+// But to get the same output image each time, the Ditherer must have
+// SingleThreaded set to true, otherwise the pixels get the random numbers in a
+// different order. A new rng with the same seed must be used for each image.
+func RandomNoiseGrayscaleSeeded(min, max float32, rng *rand.Rand) PixelMapper {
+	var mu sync.Mutex
+	return PixelMapper(func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		gray := LinearLuminance(r, g, b)
+
+		mu.Lock()
+		n := rng.Float32()
+		mu.Unlock()
+
+		new := RoundClamp(float32(gray) + 65535.0*(n*(max-min)+min))
+		return new, new, new
+	})
+}
+
+// RandomNoiseRGBSeeded is like RandomNoiseRGB, but it gets random numbers from
+// the provided rng instead of the global source.
+//
+// See RandomNoiseGrayscaleSeeded for more details about thread-safety and
+// getting the same output each time.
+func RandomNoiseRGBSeeded(minR, maxR, minG, maxG, minB, maxB float32, rng *rand.Rand) PixelMapper {
+	var mu sync.Mutex
+	return PixelMapper(func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		mu.Lock()
+		nr, ng, nb := rng.Float32(), rng.Float32(), rng.Float32()
+		mu.Unlock()
+
+		return RoundClamp(float32(r) + 65535.0*(nr*(maxR-minR)+minR)),
+			RoundClamp(float32(g) + 65535.0*(ng*(maxG-minG)+minG)),
+			RoundClamp(float32(b) + 65535.0*(nb*(maxB-minB)+minB))
+	})
+}
+
+// RandomNoiseGrayscaleParallel is like RandomNoiseGrayscale, but the random
+// numbers come from the seed and the coordinates of each pixel, instead of a
+// random number generator that's shared by all the workers. That means the
+// output image is always the same for the same seed, no matter how many workers
+// are used or what order the pixels are dithered in. SingleThreaded doesn't
+// need to be set, and there's no locking between workers.
+func RandomNoiseGrayscaleParallel(min, max float32, seed int64) PixelMapper {
+	return PixelMapper(func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		gray := LinearLuminance(r, g, b)
+
+		n := pixelRand(seed, x, y, 0)
+		new := RoundClamp(float32(gray) + 65535.0*(n*(max-min)+min))
+		return new, new, new
+	})
+}
+
+// RandomNoiseRGBParallel is like RandomNoiseRGB, but the random numbers come
+// from the seed and the coordinates of each pixel.
+//
+// See RandomNoiseGrayscaleParallel for more details.
+func RandomNoiseRGBParallel(minR, maxR, minG, maxG, minB, maxB float32, seed int64) PixelMapper {
+	return PixelMapper(func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		return RoundClamp(float32(r) + 65535.0*(pixelRand(seed, x, y, 0)*(maxR-minR)+minR)),
+			RoundClamp(float32(g) + 65535.0*(pixelRand(seed, x, y, 1)*(maxG-minG)+minG)),
+			RoundClamp(float32(b) + 65535.0*(pixelRand(seed, x, y, 2)*(maxB-minB)+minB))
+	})
+}
+
+// pixelRand returns a random number in the range [0, 1) for the pixel, that
+// only depends on the arguments. n can be used to get more than one number
+// for the same pixel.
+func pixelRand(seed int64, x, y, n int) float32 {
+	// Mix everything together with the splitmix64 finalizer
+	// https://prng.di.unimi.it/splitmix64.c
+	z := uint64(seed) + uint64(x)*0x9e3779b97f4a7c15 + uint64(y)*0xc2b2ae3d27d4eb4f + uint64(n)*0x165667b19e3779f9
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	// Use the top 24 bits, which is all a float32 can represent exactly
+	return float32(z>>40) / (1 << 24)
+}
+
+// Threshold returns a PixelMapper that sets each channel to its minimum or
+// maximum value, depending on whether it's above the threshold level. This
+// isn't really dithering, but it's a useful baseline to compare dithering
+// results against.
+//
+// level should be in the range [0, 1], and is compared against linear RGB
+// values. The usual value is 0.5.
+func Threshold(level float32) PixelMapper {
+	t := 65535.0 * level
+	thresh := func(v uint16) uint16 {
+		if float32(v) > t {
+			return 65535
+		}
+		return 0
+	}
+	return PixelMapper(func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		return thresh(r), thresh(g), thresh(b)
+	})
+}
+
+// ThresholdGrayscale is like Threshold, but the color is converted to
+// grayscale first, and then that gray value is thresholded. This means it
+// always returns black or white.
+//
+// See Threshold for more details.
+func ThresholdGrayscale(level float32) PixelMapper {
+	t := 65535.0 * level
+	return PixelMapper(func(x, y int, r, g, b uint16) (uint16, uint16, uint16) {
+		gray := LinearLuminance(r, g, b)
+
+		if float32(gray) > t {
+			return 65535, 65535, 65535
+		}
+		return 0, 0, 0
+	})
+}
+
 func log2(v uint) uint {
 	// Sources:
 	// https://graphics.stanford.edu/~seander/bithacks.html#IntegerLogObvious
@@ -242,7 +379,8 @@ func convThresholdToAddition(scale float32, value uint, max uint) float32 {
 //
 // For grayscale output, I would recommend 1.0 for lighter images, or -1.0 for darker images.
 // If you cannot know beforehand, you may want to decrease that value, to reduce the risk of
-// making dark images really bright. Try staying between 0.5 and 1.0.
+// making dark images really bright. Try staying between 0.5 and 1.0. Or use
+// BayerStrengthFunc to lower the strength only in the dark parts of the image.
 //
 // If you're using a Bayer size larger than 4x4, just using 1.0 for strength should be fine
 // for most kinds of grayscale images.
@@ -255,10 +393,149 @@ func convThresholdToAddition(scale float32, value uint, max uint) float32 {
 //
 // Of course, experiment for yourself. And let me know if I'm wrong!
 func Bayer(x, y uint, strength float32) PixelMapper {
+	return PixelMapperFromMatrix(BayerMatrix(x, y), strength)
+}
+
+// BayerOffset is like Bayer, but the matrix is shifted by phaseX and phaseY.
+// See PixelMapperFromMatrixOffset for details.
+func BayerOffset(x, y uint, strength float32, phaseX, phaseY int) PixelMapper {
+	return PixelMapperFromMatrixOffset(BayerMatrix(x, y), strength, phaseX, phaseY)
+}
+
+// PatternMapper returns a PixelMapper that tiles the stamp across the image,
+// like an ordered dithering matrix, but with only two values. Where the stamp
+// is true, on is added to each channel, and elsewhere off is added. Like the
+// min and max of RandomNoiseGrayscale, they're in the range of colors from 0
+// to 1, so 0.25 moves a color a quarter of the way to white.
+//
+// This can be used for stripes, checkerboards, or any custom pattern, like a
+// logo. For example, this makes the midtones of the image come out as a
+// checkerboard, while darker and lighter colors stay solid:
+//
+//     d.Mapper = dither.PatternMapper([][]bool{
+//         {true, false},
+//         {false, true},
+//     }, 0.25, -0.25)
+//
+// The stamp must have at least one row, and every row must have the same
+// non-zero length, otherwise the function will panic.
+func PatternMapper(stamp [][]bool, on, off float32) PixelMapper {
+	if len(stamp) == 0 || len(stamp[0]) == 0 {
+		panic("dither: PatternMapper: stamp is empty")
+	}
+	ydim := len(stamp)
+	xdim := len(stamp[0])
+
+	precalc := make([][]float32, ydim)
+	for i, row := range stamp {
+		if len(row) != xdim {
+			panic("dither: PatternMapper: stamp rows have different lengths")
+		}
+		precalc[i] = make([]float32, xdim)
+		for j, v := range row {
+			if v {
+				precalc[i][j] = 65535.0 * on
+			} else {
+				precalc[i][j] = 65535.0 * off
+			}
+		}
+	}
+
+	return PixelMapper(func(xx, yy int, r, g, b uint16) (uint16, uint16, uint16) {
+		i := yy % ydim
+		if i < 0 {
+			i += ydim
+		}
+		j := xx % xdim
+		if j < 0 {
+			j += xdim
+		}
+		return RoundClamp(float32(r) + precalc[i][j]),
+			RoundClamp(float32(g) + precalc[i][j]),
+			RoundClamp(float32(b) + precalc[i][j])
+	})
+}
+
+// BayerScaled is like Bayer, but each value of the matrix covers scale*scale
+// pixels, which makes the dots larger. See Scale for details.
+func BayerScaled(x, y uint, strength float32, scale int) PixelMapper {
+	return PixelMapperFromMatrix(Scale(BayerMatrix(x, y), scale), strength)
+}
+
+// BayerStrengthFunc is like Bayer, but the strength can change with the
+// brightness of each pixel. See PixelMapperFromMatrixStrengthFunc for details.
+func BayerStrengthFunc(x, y uint, strength func(lum float32) float32) PixelMapper {
+	return PixelMapperFromMatrixStrengthFunc(BayerMatrix(x, y), strength)
+}
+
+// BayerAnimated is like Bayer, but the pattern is shifted differently for each
+// frame of an animation or video. Using the same pattern for every frame makes
+// it look static, like it's stuck to the screen, while the image moves behind
+// it. Shifting it spreads the dithering out over time, which looks smoother.
+//
+// frame should be the index of the frame, going up by one each frame. The
+// shift for each frame follows the order of the values in the Bayer matrix
+// itself, so consecutive frames are shifted as differently as possible, and
+// every shift is used before the pattern repeats after x*y frames. If the
+// shimmering is too distracting at the frame rate being used, try changing
+// frame less often, like using frame/2.
+//
+// The dimensions have the same restrictions as Bayer, and the function will
+// panic if they're not met.
+func BayerAnimated(x, y uint, strength float32, frame int) PixelMapper {
+	odm := BayerMatrix(x, y)
+
+	// Sort the positions in the matrix by their values, and use the position
+	// for this frame as the shift
+	type cell struct {
+		x, y int
+		v    uint
+	}
+	cells := make([]cell, 0, x*y)
+	for i, row := range odm.Matrix {
+		for j, v := range row {
+			cells = append(cells, cell{j, i, v})
+		}
+	}
+	sort.SliceStable(cells, func(i, j int) bool { return cells[i].v < cells[j].v })
+
+	n := frame % len(cells)
+	if n < 0 {
+		n += len(cells)
+	}
+	return PixelMapperFromMatrixOffset(odm, strength, cells[n].x, cells[n].y)
+}
+
+// BayerMatrix returns the Bayer matrix that Bayer uses, as an
+// OrderedDitherMatrix. This is useful if you'd like to inspect or modify the
+// matrix, before using it with PixelMapperFromMatrix. Max is always x*y.
+//
+// The dimensions have the same restrictions as Bayer, and the function will panic
+// if they're not met.
+func BayerMatrix(x, y uint) OrderedDitherMatrix {
+	odm, err := bayerMatrixErr(x, y)
+	if err != nil {
+		panic(err.Error())
+	}
+	return odm
+}
+
+// BayerErr is like Bayer, but returns an error instead of panicking when
+// the dimensions are invalid. This is useful when the dimensions come from
+// user input.
+func BayerErr(x, y uint, strength float32) (PixelMapper, error) {
+	odm, err := bayerMatrixErr(x, y)
+	if err != nil {
+		return nil, err
+	}
+	return PixelMapperFromMatrix(odm, strength), nil
+}
+
+func bayerMatrixErr(x, y uint) (OrderedDitherMatrix, error) {
 	var matrix [][]uint
 
 	if x == 0 || y == 0 {
-		panic("dither: Bayer: neither x or y can be zero")
+		return OrderedDitherMatrix{}, errors.New("dither: Bayer: neither x or y can be zero")
 	}
 	if x == 3 && y == 3 {
 		matrix = [][]uint{
@@ -285,26 +562,72 @@ func Bayer(x, y uint, strength float32) PixelMapper {
 		matrix = bayerMatrix(x, y)
 	} else {
 		// Neither are powers of two
-		panic("dither: Bayer: dimensions aren't both a power of two")
+		return OrderedDitherMatrix{}, errors.New("dither: Bayer: dimensions aren't both a power of two")
 	}
 
-	// Create precalculated matrix
-	scale := 65535.0 * strength
-	max := x * y
+	return OrderedDitherMatrix{
+		Matrix: matrix,
+		Max:    x * y,
+	}, nil
+}
 
-	precalc := make([][]float32, y)
+// BayerAnySize is like Bayer, but it accepts any dimensions, not just powers
+// of two. This is useful for letting users pick any size. It will still panic
+// if either dimension is zero.
+//
+// See BayerMatrixAnySize for how the matrix is made.
+func BayerAnySize(x, y uint, strength float32) PixelMapper {
+	return PixelMapperFromMatrix(BayerMatrixAnySize(x, y), strength)
+}
+
+// BayerMatrixAnySize returns a Bayer-like matrix of any size, as an
+// OrderedDitherMatrix. It will panic if either dimension is zero.
+//
+// For powers of two, the matrix is the same one BayerMatrix returns. For other
+// sizes, a Bayer matrix with the next largest power of two dimensions is
+// cropped to the right size, and then its values are renumbered to go from
+// 0 to x*y-1, keeping their order. The result isn't as even as a real Bayer
+// matrix, and so powers of two should be preferred when possible. Note that
+// the hand-derived 3x3, 5x3 and 3x5 matrices used by Bayer are not used here.
+func BayerMatrixAnySize(x, y uint) OrderedDitherMatrix {
+	if x == 0 || y == 0 {
+		panic("dither: BayerMatrixAnySize: neither x or y can be zero")
+	}
+
+	// Next largest powers of two
+	px, py := uint(1), uint(1)
+	for px < x {
+		px <<= 1
+	}
+	for py < y {
+		py <<= 1
+	}
+	full := bayerMatrix(px, py)
+
+	// Crop, and then replace each value with its rank
+	type cell struct {
+		x, y uint
+		v    uint
+	}
+	cells := make([]cell, 0, x*y)
 	for i := uint(0); i < y; i++ {
-		precalc[i] = make([]float32, x)
 		for j := uint(0); j < x; j++ {
-			precalc[i][j] = convThresholdToAddition(scale, matrix[i][j], max)
+			cells = append(cells, cell{j, i, full[i][j]})
 		}
 	}
+	sort.Slice(cells, func(i, j int) bool { return cells[i].v < cells[j].v })
 
-	return PixelMapper(func(xx, yy int, r, g, b uint16) (uint16, uint16, uint16) {
-		return RoundClamp(float32(r) + precalc[yy%int(y)][xx%int(x)]),
-			RoundClamp(float32(g) + precalc[yy%int(y)][xx%int(x)]),
-			RoundClamp(float32(b) + precalc[yy%int(y)][xx%int(x)])
-	})
+	matrix := make([][]uint, y)
+	for i := range matrix {
+		matrix[i] = make([]uint, x)
+	}
+	for rank, c := range cells {
+		matrix[c.y][c.x] = uint(rank)
+	}
+	return OrderedDitherMatrix{
+		Matrix: matrix,
+		Max:    x * y,
+	}
 }
 
 // PixelMapperFromMatrix takes an OrderedDitherMatrix, and will return
@@ -318,7 +641,27 @@ func Bayer(x, y uint, strength float32) PixelMapper {
 // See Bayer for a detailed explanation of strength. You can use this to change the
 // amount the matrix is applied to the image, and to reduce noise. Usually you'll
 // just want to set it to 1.0.
+//
+// The matrix is tiled across the image, wrapping around at its edges, so it
+// can be any size, and doesn't have to evenly divide the image. That includes
+// blue noise masks and other matrices made to tile seamlessly, which stay
+// seamless however they're cut off at the edges of the image. To hide any
+// structure left over from repeating the same tile, see
+// PixelMapperFromMatrixRandomOffset.
 func PixelMapperFromMatrix(odm OrderedDitherMatrix, strength float32) PixelMapper {
+	return PixelMapperFromMatrixOffset(odm, strength, 0, 0)
+}
+
+// PixelMapperFromMatrixOffset is like PixelMapperFromMatrix, but the matrix is
+// shifted by phaseX and phaseY. Normally the top left of the matrix is at
+// (0, 0) in the image, and with an offset the matrix value used for (x, y) is
+// the one that would be used for (x+phaseX, y+phaseY). Negative offsets work
+// too.
+//
+// This can be used to line up the pattern when dithering parts of an image
+// separately, or to change the offset for each frame of an animation, which
+// makes the pattern shimmer.
+func PixelMapperFromMatrixOffset(odm OrderedDitherMatrix, strength float32, phaseX, phaseY int) PixelMapper {
 	ydim := len(odm.Matrix)
 	xdim := len(odm.Matrix[0])
 	scale := 65535.0 * strength
@@ -332,9 +675,75 @@ func PixelMapperFromMatrix(odm OrderedDitherMatrix, strength float32) PixelMappe
 		}
 	}
 
+	// Keep the offsets in range, so only the coordinates can be negative
+	phaseX = (phaseX%xdim + xdim) % xdim
+	phaseY = (phaseY%ydim + ydim) % ydim
+
 	return PixelMapper(func(xx, yy int, r, g, b uint16) (uint16, uint16, uint16) {
-		return RoundClamp(float32(r) + precalc[yy%ydim][xx%xdim]),
-			RoundClamp(float32(g) + precalc[yy%ydim][xx%xdim]),
-			RoundClamp(float32(b) + precalc[yy%ydim][xx%xdim])
+		i := (yy + phaseY) % ydim
+		if i < 0 {
+			i += ydim
+		}
+		j := (xx + phaseX) % xdim
+		if j < 0 {
+			j += xdim
+		}
+		return RoundClamp(float32(r) + precalc[i][j]),
+			RoundClamp(float32(g) + precalc[i][j]),
+			RoundClamp(float32(b) + precalc[i][j])
+	})
+}
+
+// PixelMapperFromMatrixRandomOffset is like PixelMapperFromMatrixOffset, but
+// the offset is picked randomly using rng, when the PixelMapper is created.
+// Creating a new PixelMapper for each image shifts the matrix differently for
+// each one, which hides the repeating tile of large matrices, like blue noise
+// masks. rng isn't used after this function returns, so the PixelMapper is
+// thread-safe, and the same seed always gives the same offset.
+func PixelMapperFromMatrixRandomOffset(odm OrderedDitherMatrix, strength float32, rng *rand.Rand) PixelMapper {
+	phaseX := rng.Intn(len(odm.Matrix[0]))
+	phaseY := rng.Intn(len(odm.Matrix))
+	return PixelMapperFromMatrixOffset(odm, strength, phaseX, phaseY)
+}
+
+// PixelMapperFromMatrixStrengthFunc is like PixelMapperFromMatrix, but instead
+// of a single strength for the whole image, strength is called for each pixel
+// with its luminance, and returns the strength to use for that pixel. The
+// luminance is the LinearLuminance of the input color, scaled to the range
+// [0, 1]. See Bayer for what the strength values mean.
+//
+// This can be used to dither midtones fully, while leaving shadows and
+// highlights smooth. For example, this fixes the problem of Bayer matrices
+// making dark images brighter, by using almost no strength in the dark parts:
+//
+//     func(lum float32) float32 { return 4 * lum * (1 - lum) }
+//
+// strength may be called from many goroutines at once.
+func PixelMapperFromMatrixStrengthFunc(odm OrderedDitherMatrix, strength func(lum float32) float32) PixelMapper {
+	ydim := len(odm.Matrix)
+	xdim := len(odm.Matrix[0])
+
+	// Precalculated for a strength of 1
+	precalc := make([][]float32, ydim)
+	for i := 0; i < ydim; i++ {
+		precalc[i] = make([]float32, xdim)
+		for j := 0; j < xdim; j++ {
+			precalc[i][j] = convThresholdToAddition(65535.0, odm.Matrix[i][j], odm.Max)
+		}
+	}
+
+	return PixelMapper(func(xx, yy int, r, g, b uint16) (uint16, uint16, uint16) {
+		i := yy % ydim
+		if i < 0 {
+			i += ydim
+		}
+		j := xx % xdim
+		if j < 0 {
+			j += xdim
+		}
+		add := precalc[i][j] * strength(float32(LinearLuminance(r, g, b))/65535)
+		return RoundClamp(float32(r) + add),
+			RoundClamp(float32(g) + add),
+			RoundClamp(float32(b) + add)
 	})
 }
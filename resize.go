@@ -0,0 +1,117 @@
+package dither
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// DitherResize resizes the src image to w by h pixels and dithers it, in one
+// step. The returned image has bounds starting at (0, 0), and the src image
+// remains unchanged. The returned image type is the same as when Dither
+// copies the image.
+//
+// The image is resized using a box filter, also called area averaging: each
+// output pixel is the average of the src pixels it covers, weighted by how
+// much of each pixel is covered. This is made for scaling down, like for
+// thumbnails. The average is taken in linear RGB, using the Ditherer's transfer
+// function, so unlike most resizing it doesn't make the image darker. If
+// LinearRGB is false, the colors are averaged as they are instead.
+//
+// The resized pixels are computed while dithering, so no resized copy of the
+// image is kept in memory.
+func (d *Ditherer) DitherResize(src image.Image, w, h int) image.Image {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+	if w <= 0 || h <= 0 {
+		panic("dither: DitherResize: width and height must be above zero")
+	}
+
+	in := newResizedImage(src, w, h, d.transfer())
+	return d.ditherInto(d.newImage(in.rect), in, true, ditherOptions{})
+}
+
+// ResizeLinear returns a copy of the src image resized to w by h pixels, with
+// bounds starting at (0, 0). It uses the same box filter as DitherResize,
+// averaging the colors in linear RGB, assuming src is sRGB.
+//
+// Most resizing averages the sRGB values directly, which makes images darker,
+// especially ones with fine detail like dithered images. This can be used to
+// scale images down correctly before dithering them.
+func ResizeLinear(src image.Image, w, h int) *image.RGBA {
+	if w <= 0 || h <= 0 {
+		panic("dither: ResizeLinear: width and height must be above zero")
+	}
+
+	in := newResizedImage(src, w, h, TransferSRGB)
+	dst := image.NewRGBA(in.rect)
+	copyImage(dst, in)
+	return dst
+}
+
+// resizedImage is src resized to fit rect, with a box filter in linear RGB.
+// Its pixels are computed when At is called.
+type resizedImage struct {
+	src  image.Image
+	rect image.Rectangle
+	// sx and sy are the width and height of the area of src each pixel covers
+	sx, sy float64
+	tf     TransferFunction
+}
+
+func newResizedImage(src image.Image, w, h int, tf TransferFunction) *resizedImage {
+	return &resizedImage{
+		src:  src,
+		rect: image.Rect(0, 0, w, h),
+		sx:   float64(src.Bounds().Dx()) / float64(w),
+		sy:   float64(src.Bounds().Dy()) / float64(h),
+		tf:   tf,
+	}
+}
+
+func (r *resizedImage) ColorModel() color.Model { return color.NRGBA64Model }
+
+func (r *resizedImage) Bounds() image.Rectangle { return r.rect }
+
+func (r *resizedImage) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(r.rect)) {
+		return color.NRGBA64{}
+	}
+
+	sb := r.src.Bounds()
+	x0 := float64(sb.Min.X) + float64(x)*r.sx
+	y0 := float64(sb.Min.Y) + float64(y)*r.sy
+	x1, y1 := x0+r.sx, y0+r.sy
+
+	// Sums of the linear colors premultiplied by alpha, and of the alpha
+	// values, weighted by how much of each pixel is covered
+	var sum [4]float64
+	area := 0.0
+	for py := int(math.Floor(y0)); float64(py) < y1; py++ {
+		wy := math.Min(y1, float64(py+1)) - math.Max(y0, float64(py))
+		for px := int(math.Floor(x0)); float64(px) < x1; px++ {
+			wx := math.Min(x1, float64(px+1)) - math.Max(x0, float64(px))
+			cr, cg, cb, ca := unpremultAndLinearize(r.src.At(px, py), r.tf)
+			wa := wx * wy * float64(ca)
+			sum[0] += wa * float64(cr)
+			sum[1] += wa * float64(cg)
+			sum[2] += wa * float64(cb)
+			sum[3] += wx * wy * float64(ca)
+			area += wx * wy
+		}
+	}
+	if sum[3] == 0 {
+		return color.NRGBA64{}
+	}
+
+	delinearize := func(v float64) uint16 {
+		return uint16(math.RoundToEven(r.tf.delinearize1(math.Min(v/sum[3]/65535, 1)) * 65535))
+	}
+	return color.NRGBA64{
+		R: delinearize(sum[0]),
+		G: delinearize(sum[1]),
+		B: delinearize(sum[2]),
+		A: uint16(math.RoundToEven(math.Min(sum[3]/area, 65535))),
+	}
+}
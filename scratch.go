@@ -0,0 +1,94 @@
+package dither
+
+import (
+	"image"
+	"sync"
+	"sync/atomic"
+)
+
+// Scratch holds buffers used while dithering, so they can be reused by
+// Ditherer.DitherWithScratch instead of being allocated for every image.
+// The zero value is ready to use.
+//
+// A Scratch can be used with any Ditherer, and with images of any size. The
+// buffers grow to fit the largest image dithered with it.
+type Scratch struct {
+	// inUse is 1 while a call is using the buffers
+	inUse int32
+
+	lins   [][3]uint16
+	alphas []uint16
+	lights []float32
+}
+
+// acquire tries to mark the Scratch as in use. If it is already in use it
+// returns false.
+func (s *Scratch) acquire() bool {
+	return atomic.CompareAndSwapInt32(&s.inUse, 0, 1)
+}
+
+func (s *Scratch) release() {
+	atomic.StoreInt32(&s.inUse, 0)
+}
+
+// linearBuffer returns a buffer for n linear RGB colors. Its contents are
+// undefined.
+func (s *Scratch) linearBuffer(n int) [][3]uint16 {
+	if cap(s.lins) < n {
+		s.lins = make([][3]uint16, n)
+	}
+	return s.lins[:n]
+}
+
+// alphaBuffer returns a buffer for n alpha values. Its contents are undefined.
+func (s *Scratch) alphaBuffer(n int) []uint16 {
+	if cap(s.alphas) < n {
+		s.alphas = make([]uint16, n)
+	}
+	return s.alphas[:n]
+}
+
+// lightnessBuffer returns a buffer for n lightness errors, used by
+// LumaDiffusion. Its contents are undefined.
+func (s *Scratch) lightnessBuffer(n int) []float32 {
+	if cap(s.lights) < n {
+		s.lights = make([]float32, n)
+	}
+	return s.lights[:n]
+}
+
+// ScratchPool holds Scratch values that can be shared by many goroutines, like
+// the handlers of a server that dithers images. Each call gets its own Scratch
+// from the pool, so there are no data races, and the buffers are reused
+// between calls instead of being allocated each time. The zero value is ready
+// to use.
+//
+// Like sync.Pool, which it's built on, unused Scratch values can be freed by
+// the garbage collector at any time.
+type ScratchPool struct {
+	pool sync.Pool
+}
+
+// Get returns a Scratch from the pool, or a new one if the pool is empty. It
+// should be given back with Put once it's not being used anymore.
+func (p *ScratchPool) Get() *Scratch {
+	if s, ok := p.pool.Get().(*Scratch); ok {
+		return s
+	}
+	return &Scratch{}
+}
+
+// Put adds the Scratch to the pool, so it can be returned by Get. It must not
+// be used after that.
+func (p *ScratchPool) Put(s *Scratch) {
+	p.pool.Put(s)
+}
+
+// Dither dithers the image with the Ditherer like Ditherer.DitherWithScratch,
+// using a Scratch from the pool. It's safe to call from many goroutines at
+// once.
+func (p *ScratchPool) Dither(d *Ditherer, src image.Image) image.Image {
+	s := p.Get()
+	defer p.Put(s)
+	return d.DitherWithScratch(src, s)
+}
@@ -1,9 +1,194 @@
 package dither
 
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
 // SpecialDither is used to represent dithering algorithms that require custom
 // code, because they cannot be represented by a PixelMapper or error diffusion
 // matrix.
-//
-// There are currently no SpecialDither options, but they will be added in the
-// future.
 type SpecialDither int
+
+const (
+	// SoftNearest picks randomly between the two palette colors closest to
+	// each pixel, instead of always using the closest one. The closer color is
+	// more likely to be picked, in proportion to the distances, so on average
+	// the colors come out right. It's like random noise dithering, but the
+	// noise only mixes colors that are close, so it can look smoother.
+	//
+	// The random numbers come from the position of each pixel, so the same
+	// image is dithered the same way every time, with or without
+	// SingleThreaded. No seed or random number generator has to be set.
+	//
+	// Quantizer, PaletteWeights, and PaletteSelector aren't used.
+	SoftNearest SpecialDither = iota + 1
+
+	// LumaDiffusion is error diffusion that only diffuses the error in
+	// lightness, using the Floyd-Steinberg weights. Each pixel is set to the
+	// palette color closest to its own color, with the lightness error from
+	// the pixels before it added. The colors of the image are matched as
+	// closely as the palette allows, and only the brightness is dithered, so
+	// areas of flat color stay clean instead of being speckled with other hues.
+	//
+	// Colors are compared in Oklab, whatever ColorSpace is set to. Serpentine,
+	// ScanOrder, PaletteWeights, ExactColors, and PreserveExtremes are used like
+	// they are with Matrix, but Quantizer, PaletteSelector, and AlphaLevels
+	// aren't. It's always done in a single thread. DitherStable,
+	// DitherRegionCarry, and DitherWithScratch work like they do with Matrix,
+	// but the error carried over by DitherRegionCarry is lightness error, so
+	// an ErrorCarry can't be shared with a Ditherer that uses Matrix.
+	LumaDiffusion
+
+	numSpecials
+)
+
+// softNearest returns the palette index for the pixel at (x, y) for
+// SoftNearest. The RGB values must be linear.
+func (d *Ditherer) softNearest(x, y int, r, g, b uint16) int {
+	// The two closest colors and their distances
+	i1, i2 := -1, -1
+	d1, d2 := math.Inf(1), math.Inf(1)
+	lab := d.oklab(r, g, b)
+	for i := range d.linearPalette {
+		if d.transparents[i] {
+			continue
+		}
+		dist := d.paletteDist(i, r, g, b, lab)
+		if dist < d1 {
+			i2, d2 = i1, d1
+			i1, d1 = i, dist
+		} else if dist < d2 {
+			i2, d2 = i, dist
+		}
+	}
+	if i2 < 0 || d1 == 0 {
+		return i1
+	}
+
+	// The distances are squared, and the chance of each color is proportional
+	// to the actual distance to the other one
+	e1 := math.Sqrt(d1)
+	e2 := math.Sqrt(d2)
+	if float64(pixelRand(0, x, y, 3)) < e2/(e1+e2) {
+		return i1
+	}
+	return i2
+}
+
+// lumaDiffusion dithers in into img for LumaDiffusion. The Ditherer must be
+// linearized, and in must use its transfer function. Pixels where masked
+// returns true are copied without being dithered, and don't diffuse or
+// receive any error. The options are used like in ditherInto, except for mask,
+// which masked replaces. Error carried over with opts.carry is Oklab lightness
+// error, stored in the first channel.
+func (d *Ditherer) lumaDiffusion(img draw.Image, in image.Image, masked func(x, y int) bool, opts ditherOptions) {
+	s, carry, errMap := opts.s, opts.carry, opts.errMap
+	tf := d.transfer()
+	extreme := d.extremes(tf)
+	exact, _ := d.exactColors()
+
+	b := img.Bounds()
+	if s == nil || !s.acquire() {
+		s = &Scratch{}
+	} else {
+		defer s.release()
+	}
+	// Lightness error for each pixel, starting at the top left of the image
+	errs := s.lightnessBuffer(b.Dx() * b.Dy())
+	for i := range errs {
+		errs[i] = 0
+	}
+	offset := func(x, y int) int {
+		return (y-b.Min.Y)*b.Dx() + (x - b.Min.X)
+	}
+	if carry != nil {
+		// Add the error carried over from regions dithered before
+		for p, e := range carry.errs {
+			if !p.In(b) {
+				continue
+			}
+			for _, e := range e {
+				errs[offset(p.X, p.Y)] += e[0]
+			}
+			delete(carry.errs, p)
+		}
+	}
+
+	// Lines aren't always rows, see ScanOrder
+	sc := d.scanner(b)
+	lineMin, lineMax := sc.lines()
+	origin := FloydSteinberg.CurrentPixel()
+
+	for line := lineMin; line < lineMax; line++ {
+		// Same direction as Matrix uses
+		reverse := sc.serpentine && line%2 == 0
+		posMin, posMax := sc.positions(line)
+
+		for i := posMin; i < posMax; i++ {
+			pos := i
+			if reverse {
+				pos = posMax - 1 - (i - posMin)
+			}
+			x, y := sc.point(line, pos)
+			c := in.At(x, y)
+			if masked(x, y) {
+				img.Set(x, y, c)
+				continue
+			}
+			r, g, bl, a := unpremultAndLinearize(c, tf)
+			r, g, bl = d.grayscale(r, g, bl)
+			if a == 0 && d.transparent >= 0 {
+				img.Set(x, y, d.palette[d.transparent])
+				continue
+			}
+
+			i, ok := exact[color.RGBA64Model.Convert(c).(color.RGBA64)]
+			if !ok {
+				i = extreme(r, g, bl)
+			}
+			if i < 0 {
+				// Only the lightness is changed by the error
+				lab := linearToOklab(r, g, bl)
+				lab[0] = float32(math.Max(0, math.Min(1, float64(lab[0]+errs[offset(x, y)]))))
+				i = d.closestOklab(lab)
+				i = d.stableIndexDist(opts.prev, opts.stability, 1, x, y, i, func(j int) float64 {
+					return oklabDist(lab, d.oklabPalette[j])
+				})
+
+				e := lab[0] - d.oklabPalette[i][0]
+				for yy := range FloydSteinberg {
+					for xx, w := range FloydSteinberg[yy] {
+						if w == 0 {
+							continue
+						}
+						deltaX := xx - origin
+						if reverse {
+							deltaX *= -1
+						}
+						dx, dy := sc.delta(yy, deltaX)
+						p := image.Point{x + dx, y + dy}
+						if !p.In(b) {
+							if carry != nil {
+								carry.add(p, e*w, 0, 0)
+							}
+							continue
+						}
+						errs[offset(p.X, p.Y)] += e * w
+					}
+				}
+			}
+			if errMap != nil {
+				p := d.linearPalette[i]
+				errMap.SetGray16(x, y, errorMagnitude(
+					float32(int32(r)-int32(p[0])),
+					float32(int32(g)-int32(p[1])),
+					float32(int32(bl)-int32(p[2])),
+				))
+			}
+			img.Set(x, y, d.withAlpha(img, d.palette[i].(color.RGBA64), a))
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package dither
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Stats holds measurements of how far a dithered image is from the original,
+// and how often each palette color was used. They're returned by
+// DitherWithStats, and can be used to compare palettes and dithering methods.
+//
+// The errors are measured per RGB channel, with values in the range [0, 1].
+// Fully transparent pixels in the original image are left out, because they
+// have no color to compare to.
+type Stats struct {
+	// Pixels is the number of pixels the errors were measured over.
+	Pixels int
+
+	// SquaredError is the sum of the squared errors of every channel of every
+	// pixel, using gamma-encoded values like the ones stored in the image.
+	// Those are closer to how differences in color are perceived.
+	SquaredError float64
+	// MeanSquaredError is SquaredError divided by the number of channels that
+	// were measured.
+	MeanSquaredError float64
+
+	// LinearSquaredError is like SquaredError, but uses linear RGB values,
+	// which is what the Ditherer works in.
+	LinearSquaredError float64
+	// LinearMeanSquaredError is LinearSquaredError divided by the number of
+	// channels that were measured.
+	LinearMeanSquaredError float64
+
+	// PSNR is the peak signal-to-noise ratio in decibels, based on
+	// MeanSquaredError. Higher is better. It's +Inf if the images are the same.
+	PSNR float64
+
+	// ColorCounts holds the number of pixels that were set to each palette
+	// color, in the same order as the palette. Fully transparent pixels are
+	// only counted if the palette has a transparent color.
+	ColorCounts []int
+}
+
+// DitherWithStats dithers a copy of the src image like DitherCopy, and returns
+// it along with Stats comparing it to src. The src image remains unchanged.
+//
+// The Stats are computed in one extra pass over the image after dithering.
+// The returned image type is the same as when Dither copies the image.
+func (d *Ditherer) DitherWithStats(src image.Image) (image.Image, Stats) {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+
+	dst := d.Dither(d.copyOfImage(src))
+
+	// Only the built-in search can be trusted to find the palette color each
+	// pixel was set to
+	dl := *d.linearized()
+	dl.Quantizer = nil
+	dl.PaletteWeights = nil
+	tf := d.transfer()
+	stats := Stats{ColorCounts: make([]int, len(d.palette))}
+
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c1 := src.At(x, y)
+			c2 := dst.At(x, y)
+
+			r, g, bl, a := unpremultAndLinearize(c2, tf)
+			if a == 0 {
+				if d.transparent >= 0 {
+					stats.ColorCounts[d.transparent]++
+				}
+			} else if i := dl.closestColor(r, g, bl); i >= 0 {
+				stats.ColorCounts[i]++
+			}
+
+			or, og, ob, oa := unpremultAndLinearize(c1, tf)
+			if oa == 0 {
+				continue
+			}
+			stats.Pixels++
+			stats.LinearSquaredError += sqErr(or, r) + sqErr(og, g) + sqErr(ob, bl)
+
+			n1 := color.NRGBA64Model.Convert(c1).(color.NRGBA64)
+			n2 := color.NRGBA64Model.Convert(c2).(color.NRGBA64)
+			stats.SquaredError += sqErr(n1.R, n2.R) + sqErr(n1.G, n2.G) + sqErr(n1.B, n2.B)
+		}
+	}
+
+	if stats.Pixels > 0 {
+		n := float64(stats.Pixels * 3)
+		stats.MeanSquaredError = stats.SquaredError / n
+		stats.LinearMeanSquaredError = stats.LinearSquaredError / n
+		// The peak value is 1, so it's just the MSE
+		stats.PSNR = -10 * math.Log10(stats.MeanSquaredError)
+	}
+	return dst, stats
+}
+
+// Preview quantizes a copy of the src image to the closest palette colors,
+// without dithering it, and returns it along with an error score. This is
+// useful for tuning a palette before choosing how to dither: a palette that
+// covers the colors of the image well has a low score even without dithering.
+//
+// The score is the root mean squared error between src and the returned image,
+// using gamma-encoded values like Stats.MeanSquaredError does. It's in the
+// range [0, 1], and it's 0 if every pixel is already a palette color. For
+// more measurements, use DitherWithStats with a Ditherer that has no dithering
+// method set.
+//
+// Matrix, Mapper, StatefulMapper, and Special are ignored. Other settings that
+// change which palette color is closest, like PaletteWeights and ColorSpace,
+// are still used. The returned image type is the same as when Dither copies
+// the image.
+func (d *Ditherer) Preview(src image.Image) (image.Image, float64) {
+	if d.invalid() {
+		panic("dither: invalid Ditherer")
+	}
+
+	dd := *d
+	dd.Matrix = nil
+	dd.Mapper = nil
+	dd.StatefulMapper = nil
+	dd.Special = 0
+	dst, stats := dd.DitherWithStats(src)
+	return dst, math.Sqrt(stats.MeanSquaredError)
+}
+
+// sqErr returns the squared difference between two channel values, scaled to
+// the range [0, 1].
+func sqErr(v1, v2 uint16) float64 {
+	d := (float64(v1) - float64(v2)) / 65535
+	return d * d
+}
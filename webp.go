@@ -0,0 +1,411 @@
+package dither
+
+// This file contains a small lossless WebP (VP8L) encoder for paletted images.
+// It only uses the color indexing transform and prefix coding, without any
+// backward references (LZ77), which keeps it simple.
+//
+// The format is described here:
+// https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// EncodeWebP writes the image to w in the lossless WebP format, which is
+// supported by all modern browsers.
+//
+// The encoder is simple, and doesn't search for repeated patterns in the image
+// like PNG does. With palettes of a few colors the file size is about the same
+// as PNG, but with larger palettes it will be bigger. Use a full WebP encoder
+// if file size is important.
+//
+// The image must have a palette of 1 to 256 colors, like the images returned by
+// DitherPaletted. Transparent palette colors are supported.
+func EncodeWebP(w io.Writer, img *image.Paletted) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 {
+		return errors.New("dither: EncodeWebP: image is empty")
+	}
+	if width > 1<<14 || height > 1<<14 {
+		return errors.New("dither: EncodeWebP: image is too large for WebP")
+	}
+	if len(img.Palette) < 1 || len(img.Palette) > 256 {
+		return errors.New("dither: EncodeWebP: palette must have 1 to 256 colors")
+	}
+
+	// Palette as non-premultiplied ARGB
+	palette := make([]uint32, len(img.Palette))
+	hasAlpha := false
+	for i, c := range img.Palette {
+		nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+		palette[i] = uint32(nc.A)<<24 | uint32(nc.R)<<16 | uint32(nc.G)<<8 | uint32(nc.B)
+		if nc.A != 255 {
+			hasAlpha = true
+		}
+	}
+
+	// With small palettes, multiple pixels are bundled into one
+	var bundle uint
+	switch {
+	case len(palette) <= 2:
+		bundle = 3
+	case len(palette) <= 4:
+		bundle = 2
+	case len(palette) <= 16:
+		bundle = 1
+	}
+	bundledWidth := (width + 1<<bundle - 1) >> bundle
+	bitsPerIndex := uint(8 >> bundle)
+
+	// Green channel of each bundled pixel, the other channels are constant
+	greens := make([]uint8, bundledWidth*height)
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+width]
+		for x, idx := range row {
+			if int(idx) >= len(palette) {
+				return errors.New("dither: EncodeWebP: image has a pixel outside of the palette")
+			}
+			greens[y*bundledWidth+x>>bundle] |= idx << (bitsPerIndex * uint(x&(1<<bundle-1)))
+		}
+	}
+
+	bw := &webpBitWriter{}
+	bw.writeBits(0x2f, 8) // Signature
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3) // Version
+
+	// Color indexing transform
+	bw.writeBits(1, 1)
+	bw.writeBits(3, 2)
+	bw.writeBits(uint32(len(palette)-1), 8)
+	// The palette is stored as an image, with each color subtracted from the
+	// previous one
+	deltas := make([]uint32, len(palette))
+	prev := uint32(0)
+	for i, c := range palette {
+		deltas[i] = argbSub(c, prev)
+		prev = c
+	}
+	bw.writeBits(0, 1) // No color cache
+	writeARGBImage(bw, deltas)
+	bw.writeBits(0, 1) // No more transforms
+
+	// Main image
+	bw.writeBits(0, 1) // No color cache
+	bw.writeBits(0, 1) // No meta prefix codes
+	var greenHist [280]int
+	for _, g := range greens {
+		greenHist[g]++
+	}
+	green := writePrefixCode(bw, greenHist[:])
+	// Red, blue, alpha, and distance only ever have one symbol
+	writeSinglePrefixCode(bw, 0)
+	writeSinglePrefixCode(bw, 0)
+	writeSinglePrefixCode(bw, 255)
+	writeSinglePrefixCode(bw, 0)
+	for _, g := range greens {
+		green.write(bw, int(g))
+	}
+	bw.flush()
+
+	// RIFF container
+	data := bw.buf
+	padded := len(data) + len(data)%2
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+padded))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if len(data)%2 == 1 {
+		data = append(data, 0)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// argbSub subtracts each channel of b from a, modulo 256.
+func argbSub(a, b uint32) uint32 {
+	var out uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		out |= uint32(uint8(a>>shift)-uint8(b>>shift)) << shift
+	}
+	return out
+}
+
+// writeARGBImage writes the prefix codes and literal pixels of a subimage.
+func writeARGBImage(bw *webpBitWriter, pixels []uint32) {
+	// Histograms in the order green, red, blue, alpha
+	var hists [4][]int
+	hists[0] = make([]int, 280)
+	for i := 1; i < 4; i++ {
+		hists[i] = make([]int, 256)
+	}
+	shifts := [4]uint{8, 16, 0, 24}
+	for _, p := range pixels {
+		for i, s := range shifts {
+			hists[i][uint8(p>>s)]++
+		}
+	}
+	var codes [4]*webpPrefixCode
+	for i := range hists {
+		codes[i] = writePrefixCode(bw, hists[i])
+	}
+	writeSinglePrefixCode(bw, 0) // Distance
+	for _, p := range pixels {
+		for i, s := range shifts {
+			codes[i].write(bw, int(uint8(p>>s)))
+		}
+	}
+}
+
+// webpBitWriter writes bits least significant bit first.
+type webpBitWriter struct {
+	buf   []byte
+	bits  uint64
+	nbits uint
+}
+
+func (bw *webpBitWriter) writeBits(v uint32, n uint) {
+	bw.bits |= uint64(v) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits >>= 8
+		bw.nbits -= 8
+	}
+}
+
+func (bw *webpBitWriter) flush() {
+	if bw.nbits > 0 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits = 0
+		bw.nbits = 0
+	}
+}
+
+// webpPrefixCode is a canonical Huffman code. The codes are stored bit
+// reversed, so they can be written directly.
+type webpPrefixCode struct {
+	codes   []uint32
+	lengths []uint8
+}
+
+func (pc *webpPrefixCode) write(bw *webpBitWriter, symbol int) {
+	bw.writeBits(pc.codes[symbol], uint(pc.lengths[symbol]))
+}
+
+// writeSinglePrefixCode writes a prefix code with only one symbol, which
+// takes zero bits to write.
+func writeSinglePrefixCode(bw *webpBitWriter, symbol uint8) {
+	bw.writeBits(1, 1) // Simple code
+	bw.writeBits(0, 1) // One symbol
+	if symbol < 2 {
+		bw.writeBits(0, 1)
+		bw.writeBits(uint32(symbol), 1)
+	} else {
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(symbol), 8)
+	}
+}
+
+// codeLengthOrder is the order the code length code lengths are written in.
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writePrefixCode creates a prefix code for the histogram, writes it, and
+// returns it. At least one symbol must be used, and all the used symbols must
+// be literals under 256.
+func writePrefixCode(bw *webpBitWriter, hist []int) *webpPrefixCode {
+	var used []int
+	for sym, n := range hist {
+		if n > 0 {
+			used = append(used, sym)
+		}
+	}
+
+	if len(used) <= 2 {
+		// Simple code, each symbol takes zero or one bits
+		pc := &webpPrefixCode{
+			codes:   make([]uint32, len(hist)),
+			lengths: make([]uint8, len(hist)),
+		}
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.writeBits(0, 1)
+			bw.writeBits(uint32(used[0]), 1)
+		} else {
+			bw.writeBits(1, 1)
+			bw.writeBits(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			bw.writeBits(uint32(used[1]), 8)
+			pc.lengths[used[0]] = 1
+			pc.lengths[used[1]] = 1
+			pc.codes[used[1]] = 1
+		}
+		return pc
+	}
+
+	// Normal code
+	lengths := huffmanLengths(hist, 15)
+	pc := newWebpPrefixCode(lengths)
+
+	// The code lengths are themselves written with a prefix code
+	var clHist [19]int
+	for _, l := range lengths {
+		clHist[l]++
+	}
+	clLengths := huffmanLengths(clHist[:], 7)
+	clCode := newWebpPrefixCode(clLengths)
+	numCodeLengths := 19
+	for numCodeLengths > 4 && clLengths[codeLengthOrder[numCodeLengths-1]] == 0 {
+		numCodeLengths--
+	}
+
+	bw.writeBits(0, 1)
+	bw.writeBits(uint32(numCodeLengths-4), 4)
+	for _, sym := range codeLengthOrder[:numCodeLengths] {
+		bw.writeBits(uint32(clLengths[sym]), 3)
+	}
+	bw.writeBits(0, 1) // Write lengths for every symbol
+	for _, l := range lengths {
+		clCode.write(bw, int(l))
+	}
+	return pc
+}
+
+// huffmanLengths returns the code lengths of a complete Huffman code for the
+// histogram, with no code longer than maxLength. If only one symbol is used,
+// another one is added so the code is still complete.
+func huffmanLengths(hist []int, maxLength uint8) []uint8 {
+	freqs := make([]int, len(hist))
+	copy(freqs, hist)
+	used := 0
+	for _, n := range freqs {
+		if n > 0 {
+			used++
+		}
+	}
+	if used == 1 {
+		for i := range freqs {
+			if freqs[i] == 0 {
+				freqs[i] = 1
+				break
+			}
+		}
+	}
+
+	for {
+		lengths := huffmanLengthsUnlimited(freqs)
+		ok := true
+		for _, l := range lengths {
+			if l > maxLength {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return lengths
+		}
+		// Flatten the frequencies and try again
+		for i := range freqs {
+			if freqs[i] > 0 {
+				freqs[i] = freqs[i]/2 + 1
+			}
+		}
+	}
+}
+
+// huffmanLengthsUnlimited returns the code lengths of a Huffman code for the
+// frequencies, which must have at least two non-zero values.
+func huffmanLengthsUnlimited(freqs []int) []uint8 {
+	type node struct {
+		freq        int
+		sym         int // -1 for internal nodes
+		left, right int
+	}
+	var nodes []node
+	var active []int
+	for sym, n := range freqs {
+		if n > 0 {
+			nodes = append(nodes, node{n, sym, -1, -1})
+			active = append(active, len(nodes)-1)
+		}
+	}
+	for len(active) > 1 {
+		// Ties are broken by node index, to keep the output deterministic
+		sort.Slice(active, func(i, j int) bool {
+			a, b := nodes[active[i]], nodes[active[j]]
+			if a.freq != b.freq {
+				return a.freq < b.freq
+			}
+			return active[i] < active[j]
+		})
+		l, r := active[0], active[1]
+		nodes = append(nodes, node{nodes[l].freq + nodes[r].freq, -1, l, r})
+		active = append(active[2:], len(nodes)-1)
+	}
+
+	lengths := make([]uint8, len(freqs))
+	var walk func(n int, depth uint8)
+	walk = func(n int, depth uint8) {
+		if nodes[n].sym >= 0 {
+			lengths[nodes[n].sym] = depth
+			return
+		}
+		walk(nodes[n].left, depth+1)
+		walk(nodes[n].right, depth+1)
+	}
+	walk(active[0], 0)
+	return lengths
+}
+
+// newWebpPrefixCode assigns canonical codes to the code lengths.
+func newWebpPrefixCode(lengths []uint8) *webpPrefixCode {
+	var counts [16]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			counts[l]++
+		}
+	}
+	var next [16]uint32
+	code := uint32(0)
+	for l := 1; l < 16; l++ {
+		code = (code + counts[l-1]) << 1
+		next[l] = code
+	}
+
+	pc := &webpPrefixCode{
+		codes:   make([]uint32, len(lengths)),
+		lengths: lengths,
+	}
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		// Reverse the bits, since codes are read starting with the top bit
+		var rev uint32
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | (c>>i)&1
+		}
+		pc.codes[sym] = rev
+	}
+	return pc
+}